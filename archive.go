@@ -0,0 +1,78 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xcd0/html2md/convert"
+)
+
+//! パスがzipアーカイブを指すかどうかを拡張子で判定する。
+func IsZipPath(p string) bool {
+	return strings.EqualFold(filepath.Ext(p), ".zip")
+}
+
+//! 入力のディレクトリまたはzipアーカイブを開く。返した関数で閉じること。
+func OpenInput(inputPath string) (fs.FS, func() error, error) {
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		return nil, nil, errors.Errorf("入力ディレクトリが存在しません: %s", inputPath)
+	}
+	if info.IsDir() {
+		return os.DirFS(inputPath), func() error { return nil }, nil
+	}
+	if !IsZipPath(inputPath) {
+		return nil, nil, errors.Errorf("入力にはディレクトリかzipアーカイブを指定してください: %s", inputPath)
+	}
+	archive, err := zip.OpenReader(inputPath)
+	if err != nil {
+		return nil, nil, errors.Errorf("zipアーカイブを開けません: %v", err)
+	}
+	return archive, archive.Close, nil
+}
+
+//! srcを変換した結果をzipアーカイブに書き出す。一時ファイルに書き出してから置き換えるため、失敗した場合は前回のアーカイブがそのまま残る。
+//! zipへの出力は差分の反映を行わないため、--mode syncでも常にすべてのファイルを出力する。
+func ConvertToZip(ctx context.Context, src fs.FS, zipPath string, opts convert.Options) (*convert.Result, error) {
+	if _, err := os.Stat(zipPath); err == nil && opts.Mode == convert.ModeFailIfExists {
+		return nil, errors.Errorf("出力ファイルが既に存在します: %s (--mode clean または --mode sync を指定してください)", zipPath)
+	}
+	if opts.BookName == "" {
+		opts.BookName = strings.TrimSuffix(filepath.Base(zipPath), filepath.Ext(zipPath))
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(zipPath), filepath.Base(zipPath)+".*.tmp")
+	if err != nil {
+		return nil, errors.Errorf("出力ファイルの作成に失敗: %v", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	out := convert.NewZipFS(tmp)
+	result, err := convert.TreeTo(ctx, src, out, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, errors.Errorf("出力ファイルの書き込みに失敗: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), zipPath); err != nil {
+		return nil, errors.Errorf("出力ファイルの置き換えに失敗: %v", err)
+	}
+	committed = true
+	result.OutputDir = zipPath
+	return result, nil
+}
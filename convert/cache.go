@@ -0,0 +1,342 @@
+package convert
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 出力ディレクトリ内に置く、前回の変換内容の記録。隠しディレクトリのためsync時も削除されず、SUMMARY.mdにも載らない。
+const (
+	CacheDirName  = ".html2md"
+	CacheFileName = "manifest.json"
+)
+
+//! 前回の変換内容の記録。次回のsync時に変更のないファイルの変換を省略するために使う。
+type BuildCache struct {
+	OptionsHash string            `json:"options_hash"`      // 出力に影響するオプションのハッシュ。
+	BookName    string            `json:"book_name"`         // book.tomlのタイトルに使った名前。
+	Renames     map[string]string `json:"renames,omitempty"` // 衝突解決でリネームした相対パス。
+	Entries     []*ManifestEntry  `json:"entries"`           // 出力したエントリ。
+
+	records map[string]*ManifestEntry // 入力の相対パス → エントリ。
+	outputs map[string]*ManifestEntry // 出力の相対パス → エントリ。
+}
+
+//! 出力に影響するオプションのハッシュを返す。変換処理自体が変わる可能性があるため、バージョンも含める。
+//! 設定ファイルの規則は、適用するページだけを変換し直すためにページごとのハッシュ(RulesHash)で比べ、ここには含めない。
+func OptionsHash(opts *Options) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "version=%s\n", opts.Version)
+	fmt.Fprintf(h, "naming=%s\n", opts.Naming)
+	fmt.Fprintf(h, "collision=%s\n", opts.Collision)
+	fmt.Fprintf(h, "rename-prefix=%s\n", opts.RenamePrefix)
+	fmt.Fprintf(h, "direct=%t\n", opts.Direct)
+	fmt.Fprintf(h, "originals-dir=%s\n", opts.OriginalsDir)
+	fmt.Fprintf(h, "limits=%d,%d,%v,%s\n", opts.MaxFileSize, opts.MaxDepth, opts.Timeout, opts.LimitAction)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//! 設定ファイルの規則ごとの、前回の変換内容との比較に使う文字列と適用するページのパスのglob。
+type ruleDigest struct {
+	kind   string
+	digest string
+	paths  []string
+}
+
+//! ページごとの規則のハッシュを求めるための、設定ファイルの規則ごとの文字列の一覧。
+type ruleDigests []ruleDigest
+
+//! optsの変換規則・書き換え規則・プラグイン・スクリプト・置換規則を、規則ごとに文字列にする。
+//! スクリプトのファイルを読み込むため、変換全体で1回だけ呼ぶ。
+func newRuleDigests(opts *Options) ruleDigests {
+	var digests ruleDigests
+	for _, rule := range opts.effectiveRules() {
+		digests = append(digests, ruleDigest{"rule", rulesHash([]Rule{rule}), rule.Paths})
+	}
+	for _, rw := range opts.Rewrites {
+		digests = append(digests, ruleDigest{"rewrite", rewritesHash([]Rewrite{rw}), rw.Paths})
+	}
+	for _, p := range opts.Plugins {
+		digests = append(digests, ruleDigest{"plugin", pluginsHash([]Plugin{p}), p.Paths})
+	}
+	for _, s := range opts.Scripts {
+		digests = append(digests, ruleDigest{"script", scriptsHash([]Script{s}), s.Paths})
+	}
+	for _, r := range opts.Replaces {
+		digests = append(digests, ruleDigest{"replace", replacesHash([]Replace{r}), r.Paths})
+	}
+	return digests
+}
+
+//! pageRelのページに適用する規則だけを、指定した順に並べたハッシュを返す。
+//! 規則を変えた場合に、そのpathsに一致するページだけを変換し直すために使う。
+func (d ruleDigests) PageHash(pageRel string) string {
+	h := sha256.New()
+	for _, digest := range d {
+		if matchPaths(digest.paths, pageRel) {
+			fmt.Fprintf(h, "%s=%s\n", digest.kind, digest.digest)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//! 入力のファイルの内容のSHA-256を返す。
+func HashFile(src fs.FS, name string) (string, error) {
+	f, err := src.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//! 入力のファイルが前回から変わっていないことが分かっている場合に、前回記録したハッシュを返す。
+//! changedは前回の変換から変わった入力の相対パス(ディレクトリの場合は配下のすべて)で、nilの場合は分からないためfalseを返す。
+func (c *BuildCache) KnownHash(entry *ManifestEntry, changed []string) (string, bool) {
+	if c == nil || changed == nil {
+		return "", false
+	}
+	prev, ok := c.records[entry.Source]
+	if !ok || prev.Kind != entry.Kind || prev.Hash == "" {
+		return "", false
+	}
+	for _, p := range changed {
+		if entry.Source == p || strings.HasPrefix(entry.Source, p+"/") {
+			return "", false
+		}
+	}
+	return prev.Hash, true
+}
+
+//! エントリの入力の内容を表すハッシュを返す。
+//! 変換しないほど大きいHTMLは読み込まず、サイズと更新日時から求める。
+func HashEntry(src fs.FS, entry *ManifestEntry, opts *Options) (string, error) {
+	if entry.Kind == EntryConvert && opts.LimitAction == LimitActionSkip {
+		info, err := fs.Stat(src, entry.Source)
+		if err != nil {
+			return "", err
+		}
+		if sizeLimitHit(info.Size(), opts) != nil {
+			return fmt.Sprintf("size:%d:%d", info.Size(), info.ModTime().UnixNano()), nil
+		}
+	}
+	return HashFile(src, entry.Source)
+}
+
+//! 出力ディレクトリから前回の変換内容を読み込む。記録がない場合やオプションが変わった場合はnilを返す。
+func LoadBuildCache(outputDir, optionsHash string, logger *log.Logger) *BuildCache {
+	cache, err := ReadBuildCache(outputDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logf(logger, "前回の変換内容を読み込めないため、全ファイルを変換します: %v", err)
+		}
+		return nil
+	}
+	if cache.OptionsHash != optionsHash {
+		logf(logger, "前回とオプションが異なるため、全ファイルを変換します。")
+		return nil
+	}
+	return cache
+}
+
+//! 出力ディレクトリに記録された変換内容を、オプションを確認せずに読み込む。
+func ReadBuildCache(outputDir string) (*BuildCache, error) {
+	return ReadBuildCacheFS(os.DirFS(outputDir))
+}
+
+//! 出力(ディレクトリまたはzipアーカイブ)に記録された変換内容を、オプションを確認せずに読み込む。
+func ReadBuildCacheFS(out fs.FS) (*BuildCache, error) {
+	data, err := fs.ReadFile(out, path.Join(CacheDirName, CacheFileName))
+	if err != nil {
+		return nil, err
+	}
+	cache := &BuildCache{}
+	if err := json.Unmarshal(data, cache); err != nil {
+		return nil, err
+	}
+	cache.records = map[string]*ManifestEntry{}
+	cache.outputs = map[string]*ManifestEntry{}
+	for _, entry := range cache.Entries {
+		cache.records[entry.Source] = entry
+		if _, ok := cache.outputs[entry.Output]; !ok {
+			cache.outputs[entry.Output] = entry
+		}
+	}
+	return cache, nil
+}
+
+//! 出力先の相対パスから、変換元のエントリを返す。見つからない場合はnil。
+func (c *BuildCache) FindOutput(outRel string) *ManifestEntry {
+	return c.outputs[outRel]
+}
+
+//! 今回の変換内容を出力に記録する。
+func SaveBuildCache(out OutputFS, optionsHash, bookName string, manifest *Manifest) error {
+	cache := &BuildCache{
+		OptionsHash: optionsHash,
+		BookName:    bookName,
+		Renames:     manifest.Plan.Renames,
+		Entries:     manifest.Entries,
+	}
+	data, err := json.MarshalIndent(cache, "", "\t")
+	if err != nil {
+		return err
+	}
+	return WriteFile(out, path.Join(CacheDirName, CacheFileName), data)
+}
+
+//! 衝突解決のリネーム内容が前回と同じかどうかを返す。
+//! 異なる場合は変更のないページでもリンク先が変わるため、全ページを変換し直す必要がある。
+func (c *BuildCache) SameRenames(renames map[string]string) bool {
+	if c == nil || len(c.Renames) != len(renames) {
+		return false
+	}
+	for oldRel, newRel := range renames {
+		if c.Renames[oldRel] != newRel {
+			return false
+		}
+	}
+	return true
+}
+
+//! エントリの入力と出力先、適用する規則が前回から変わっておらず、出力が残っているかどうかを返す。entry.HashとRulesHashは計算済みであること。
+//! originalsは元のHTMLファイルの保存先。ページ内のリンク先の解決結果がpathsで変わる場合も変換し直すためfalseを返す。
+//! trueの場合は、前回記録したリンク先と警告、書き換え規則の適用数をentryに引き継ぐ。
+func (c *BuildCache) IsUpToDate(entry *ManifestEntry, out, originals fs.FS, paths *PathMap) bool {
+	if c == nil {
+		return false
+	}
+	prev, ok := c.records[entry.Source]
+	if !ok || prev.Kind != entry.Kind || prev.Hash != entry.Hash || prev.Output != entry.Output || prev.Original != entry.Original || prev.RulesHash != entry.RulesHash {
+		return false
+	}
+	if !linksUpToDate(prev.Links, paths) {
+		return false
+	}
+	if _, err := fs.Stat(out, entry.Output); err != nil {
+		return false
+	}
+	if entry.Original != "" {
+		if _, err := fs.Stat(originals, entry.Original); err != nil {
+			return false
+		}
+	}
+	entry.Links, entry.Warnings, entry.Rewrites, entry.Replaces = prev.Links, prev.Warnings, prev.Rewrites, prev.Replaces
+	return true
+}
+
+//! 前回出力して今回は出力しないファイルとディレクトリを削除し、削除した数を返す。originalsは元のHTMLファイルの保存先。
+func (c *BuildCache) RemoveStaleOutputs(manifest *Manifest, out, originals OutputFS, logger *log.Logger) (int, error) {
+	if c == nil {
+		return 0, nil
+	}
+	outputs, originalPaths, dirs := c.StaleEntries(manifest)
+
+	removed := 0
+	for _, stale := range []struct {
+		root  OutputFS
+		paths []string
+	}{{out, outputs}, {originals, originalPaths}} {
+		for _, p := range stale.paths {
+			ok, err := removeStaleFile(stale.root, p, logger)
+			if err != nil {
+				return removed, err
+			}
+			if ok {
+				removed++
+			}
+		}
+	}
+
+	// 深い階層から削除。mdbookの生成物などが残っている空でないディレクトリは残す。
+	for _, dir := range dirs {
+		if err := out.Remove(dir); err == nil {
+			logf(logger, "削除: %s", dir)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+//! 前回出力して今回は出力しないエントリを返す。outputsとdirsは出力ディレクトリから、originalsは元のHTMLの保存先からの相対パス。
+//! dirsは深い階層から順に並べる。
+func (c *BuildCache) StaleEntries(manifest *Manifest) (outputs, originals, dirs []string) {
+	current := map[string]bool{}
+	currentOriginals := map[string]bool{}
+	for _, entry := range manifest.Entries {
+		current[entry.Output] = true
+		if entry.Original != "" {
+			currentOriginals[entry.Original] = true
+		}
+	}
+
+	for _, prev := range c.Entries {
+		if prev.Kind == EntryDir {
+			if !current[prev.Output] {
+				dirs = append(dirs, prev.Output)
+			}
+			continue
+		}
+		if !current[prev.Output] {
+			outputs = append(outputs, prev.Output)
+		}
+		if prev.Original != "" && !currentOriginals[prev.Original] {
+			originals = append(originals, prev.Original)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	return outputs, originals, dirs
+}
+
+//! 不要になった出力ファイルを削除し、削除したかどうかを返す。既に存在しない場合は何もしない。
+func removeStaleFile(out OutputFS, name string, logger *log.Logger) (bool, error) {
+	if err := out.Remove(name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, errors.Errorf("不要な出力の削除に失敗 %s: %v", name, err)
+	}
+	logf(logger, "削除: %s", name)
+	return true, nil
+}
+
+//! SUMMARY.mdとbook.tomlを生成し直す必要があるかどうかを返す。
+//! 目次に載るページとディレクトリの構成、タイトル、book.tomlのタイトルのいずれかが変わった場合に生成し直す。
+func (c *BuildCache) SummaryChanged(manifest *Manifest, bookName string, out fs.FS) bool {
+	if c == nil || c.BookName != bookName {
+		return true
+	}
+	for _, name := range []string{"SUMMARY.md", "book.toml"} {
+		if _, err := fs.Stat(out, name); err != nil {
+			return true
+		}
+	}
+	return strings.Join(summaryKeys(c.Entries), "\n") != strings.Join(summaryKeys(manifest.Entries), "\n")
+}
+
+//! 目次の内容に影響するエントリの一覧を、比較用の文字列として返す。
+func summaryKeys(entries []*ManifestEntry) []string {
+	var keys []string
+	for _, entry := range entries {
+		if entry.Kind == EntryDir || entry.Title != "" {
+			keys = append(keys, entry.Kind+"\t"+entry.Output+"\t"+entry.Title)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
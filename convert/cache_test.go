@@ -0,0 +1,106 @@
+package convert
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func writeTestFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+//! sync時は変更のないページの変換を省略し、リンク先が増えたページと内容が変わったページだけを変換し直す。
+func TestTreeSync(t *testing.T) {
+	dir := t.TempDir()
+	inputDir, outputDir := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	writeTestFile(t, filepath.Join(inputDir, "a.html"), `<p><a href="b.html">b</a></p>`)
+	writeTestFile(t, filepath.Join(inputDir, "c.html"), `<p>c</p>`)
+	opts := DefaultOptions()
+	opts.Mode = ModeSync
+
+	steps := []struct {
+		name      string
+		change    func()
+		converted int
+		skipped   int
+		warnings  int
+	}{
+		{"first", func() {}, 2, 0, 1},
+		{"unchanged", func() {}, 0, 2, 1},
+		// リンク先のページができたため、a.htmlも変換し直す。
+		{"add target", func() { writeTestFile(t, filepath.Join(inputDir, "b.html"), `<p>b</p>`) }, 2, 1, 0},
+		{"edit", func() { writeTestFile(t, filepath.Join(inputDir, "c.html"), `<p>c2</p>`) }, 1, 2, 0},
+	}
+	for _, step := range steps {
+		step.change()
+		result, err := Tree(t.Context(), inputDir, outputDir, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if result.Converted != step.converted || result.Skipped != step.skipped || len(result.Warnings) != step.warnings {
+			t.Errorf("%s: converted %d, skipped %d, warnings %d; want %d, %d, %d", step.name,
+				result.Converted, result.Skipped, len(result.Warnings), step.converted, step.skipped, step.warnings)
+		}
+	}
+	if got := readTestFile(t, filepath.Join(outputDir, "c.md")); got != "c2" {
+		t.Errorf("c.md = %q, want c2", got)
+	}
+}
+
+//! 変わった入力を指定した場合も、並列に変換したページのハッシュと結果が正しく記録される。
+func TestBuildOutputChangedPaths(t *testing.T) {
+	src := fstest.MapFS{}
+	for i := range 200 {
+		src[fmt.Sprintf("pages/p%03d.html", i)] = &fstest.MapFile{Data: []byte(fmt.Sprintf("<p>%d</p>", i))}
+		src[fmt.Sprintf("other/o%03d.html", i)] = &fstest.MapFile{Data: []byte(fmt.Sprintf("<p>o%d</p>", i))}
+	}
+	opts := DefaultOptions()
+	opts.Jobs = 8
+	policy, err := ParseNamingPolicy(opts.Naming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := NewMemoryFS()
+	if _, err := BuildOutput(t.Context(), src, out, out, "book", policy, nil, nil, &opts); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := ReadBuildCacheFS(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pages/以下の半分だけ内容を変える。
+	for i := 0; i < 200; i += 2 {
+		src[fmt.Sprintf("pages/p%03d.html", i)] = &fstest.MapFile{Data: []byte(fmt.Sprintf("<p>%d changed</p>", i))}
+	}
+	opts.ChangedPaths = []string{"pages"}
+	result, err := BuildOutput(t.Context(), src, out, out, "book", policy, previous, nil, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Converted != 100 || result.Skipped != 300 {
+		t.Errorf("converted %d, skipped %d; want 100, 300", result.Converted, result.Skipped)
+	}
+	if data, _ := fs.ReadFile(out, "pages/p000.md"); string(data) != "0 changed" {
+		t.Errorf("pages/p000.md = %q, want %q", data, "0 changed")
+	}
+}
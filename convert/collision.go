@@ -0,0 +1,225 @@
+package convert
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// 衝突解決の方式。
+const (
+	CollisionSuffix = "suffix" // 2件目以降のファイル名に-2, -3...を付与する。
+	CollisionNewest = "newest" // 更新日時が最も新しいファイルのみを残す。
+	CollisionFail   = "fail"   // 衝突があればエラーとして終了する。
+)
+
+//! 命名ポリシーの適用で同一パスになるファイル群を表す構造体。
+type Collision struct {
+	Key   string   // ポリシー適用後の出力パスを小文字にしたもの。
+	Paths []string // 衝突している相対パス(ソート済み)。
+}
+
+//! 衝突解析の結果と解決内容を表す構造体。
+type CollisionPlan struct {
+	Collisions []Collision       // 検出した衝突。
+	Renames    map[string]string // 解決のために変更した相対パス(元→新)。リンク書き換えに使う。
+	Removed    []string          // newest方式で破棄した相対パス。
+
+	keys         map[string]bool // 解析時に存在した全ファイルの衝突判定キー。
+	policy       *NamingPolicy   // 解析に使った命名ポリシー。
+	renamePrefix string          // 元のHTMLファイル名に付与するプレフィックス。
+	originals    bool            // 元のHTMLファイルを出力に残すかどうか。
+}
+
+//! 衝突解決方式の値を検証する。
+func ValidateCollisionStrategy(strategy string) error {
+	switch strategy {
+	case CollisionSuffix, CollisionNewest, CollisionFail:
+		return nil
+	}
+	return errors.Errorf("不明な衝突解決方式です: %s (suffix, newest, failのいずれかを指定してください)", strategy)
+}
+
+//! 相対パスから命名ポリシー適用後の衝突判定キーを生成する。
+//! HTMLファイルは変換後の.mdファイルのパスで判定する。
+//! 大文字小文字を区別しないファイルシステムでの衝突も検出するため、キーは常に小文字にする。
+func collisionKey(relPath string, policy *NamingPolicy) string {
+	key := relPath
+	if strings.HasSuffix(strings.ToLower(key), ".html") {
+		key = path.Join(path.Dir(key), MarkdownFileName(path.Base(key)))
+	}
+	return strings.ToLower(policy.Path(key, false))
+}
+
+//! 元のHTMLファイルを出力に残す場合の、出力先の衝突判定キーを生成する。renamePrefixは元のHTMLファイル名に付与するプレフィックス。
+func originalKey(relPath string, policy *NamingPolicy, renamePrefix string) string {
+	original := path.Join(policy.Path(path.Dir(relPath), true), renamePrefix+policy.Name(path.Base(relPath), false))
+	return strings.ToLower(original)
+}
+
+//! 入力ファイルの相対パスの一覧から、命名ポリシーの適用により衝突するパスを解析する。
+//! renamePrefixは元のHTMLファイル名に付与するプレフィックス。originalsがtrueの場合は、出力に残す元のHTMLファイルの名前も衝突の対象にする。
+func AnalyzeCollisions(files []string, policy *NamingPolicy, renamePrefix string, originals bool) *CollisionPlan {
+	groups := map[string][]string{}
+	for _, relPath := range files {
+		key := collisionKey(relPath, policy)
+		groups[key] = append(groups[key], relPath)
+	}
+	if originals {
+		// 元のHTMLファイルの名前(<プレフィックス><名前>.html)が、他の入力ファイルの出力先と重ならないか確認する。
+		for _, relPath := range files {
+			if !strings.HasSuffix(strings.ToLower(relPath), ".html") {
+				continue
+			}
+			key := originalKey(relPath, policy, renamePrefix)
+			groups[key] = append(groups[key], relPath)
+		}
+	}
+
+	plan := &CollisionPlan{Renames: map[string]string{}, keys: map[string]bool{}, policy: policy, renamePrefix: renamePrefix, originals: originals}
+	seen := map[string]bool{}
+	for key, paths := range groups {
+		plan.keys[key] = true
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		// 出力先と元のHTMLファイルの両方で衝突する組は、1件の衝突として扱う。
+		if joined := strings.Join(paths, "\n"); !seen[joined] {
+			seen[joined] = true
+			plan.Collisions = append(plan.Collisions, Collision{Key: key, Paths: paths})
+		}
+	}
+	sort.Slice(plan.Collisions, func(i, j int) bool {
+		return plan.Collisions[i].Key < plan.Collisions[j].Key
+	})
+	return plan
+}
+
+//! 衝突内容をloggerに出力する。
+func ReportCollisions(plan *CollisionPlan, logger *log.Logger) {
+	if len(plan.Collisions) == 0 {
+		logf(logger, "命名ポリシーによるパスの衝突はありません。")
+		return
+	}
+	logf(logger, "命名ポリシーによるパスの衝突を%d件検出しました。", len(plan.Collisions))
+	for _, c := range plan.Collisions {
+		logf(logger, "衝突: %s ← %s", c.Key, strings.Join(c.Paths, ", "))
+	}
+}
+
+//! 指定した方式で衝突の解決内容を決め、planのRenamesとRemovedに記録する。ディスクは変更しない。
+//! modTimesはnewest方式で使う、相対パスごとの更新日時。解決内容はloggerに出力する。
+func ResolveCollisions(plan *CollisionPlan, strategy string, modTimes map[string]time.Time, logger *log.Logger) error {
+	if len(plan.Collisions) == 0 {
+		return nil
+	}
+
+	switch strategy {
+	case CollisionFail:
+		var lines []string
+		for _, c := range plan.Collisions {
+			lines = append(lines, fmt.Sprintf("%s ← %s", c.Key, strings.Join(c.Paths, ", ")))
+		}
+		return errors.Errorf("命名ポリシーによるパスの衝突があります:\n%s", strings.Join(lines, "\n"))
+
+	case CollisionSuffix:
+		// 既存のファイルと重複しない連番を選ぶため、解析時の全キーを使用済みとして扱う。
+		used := map[string]bool{}
+		for key := range plan.keys {
+			used[key] = true
+		}
+		for _, c := range plan.Collisions {
+			// 先頭(ソート順で最初)のファイルは元の名前のまま残す。
+			for _, oldRel := range c.Paths[1:] {
+				if _, ok := plan.Renames[oldRel]; ok {
+					continue // 別の衝突の解決で既に変更した。
+				}
+				newRel := nextSuffixedPath(oldRel, used, plan)
+				for _, key := range plan.outputKeys(newRel) {
+					used[key] = true
+				}
+				plan.Renames[oldRel] = newRel
+				logf(logger, "衝突解決(suffix): %s → %s", oldRel, newRel)
+			}
+		}
+
+	case CollisionNewest:
+		for _, c := range plan.Collisions {
+			// 更新日時が最も新しいファイルを残す。同時刻の場合はソート順で先のものを残す。
+			kept := c.Paths[0]
+			for _, p := range c.Paths[1:] {
+				if modTimes[p].After(modTimes[kept]) {
+					kept = p
+				}
+			}
+			for _, p := range c.Paths {
+				if _, ok := plan.Renames[p]; ok || p == kept {
+					continue
+				}
+				plan.Renames[p] = kept
+				plan.Removed = append(plan.Removed, p)
+				logf(logger, "衝突解決(newest): %s を破棄し %s を残しました", p, kept)
+			}
+		}
+
+	default:
+		return ValidateCollisionStrategy(strategy)
+	}
+	return nil
+}
+
+//! 衝突解決後の相対パスを返す。newest方式で破棄されたパスは残したファイルのパスになる。
+func (plan *CollisionPlan) Resolve(relPath string) string {
+	if newRel, ok := plan.Renames[relPath]; ok {
+		return newRel
+	}
+	return relPath
+}
+
+//! newest方式で破棄されたパスかどうかを返す。
+func (plan *CollisionPlan) IsRemoved(relPath string) bool {
+	for _, p := range plan.Removed {
+		if p == relPath {
+			return true
+		}
+	}
+	return false
+}
+
+//! 衝突しない連番付きのパスを生成する。例: dir/Page.html → dir/Page-2.html。
+func nextSuffixedPath(relPath string, used map[string]bool, plan *CollisionPlan) string {
+	dir := path.Dir(relPath)
+	name := path.Base(relPath)
+	ext := path.Ext(name)
+	if strings.EqualFold(ext, ".html") && strings.HasSuffix(strings.ToLower(strings.TrimSuffix(name, ext)), ".md") {
+		// .md.html は .md と .html の間に連番を入れずにまとめて拡張子として扱う。
+		ext = name[len(name)-len(".md.html"):]
+	}
+	stem := strings.TrimSuffix(name, ext)
+
+	for n := 2; ; n++ {
+		candidate := path.Join(dir, fmt.Sprintf("%s-%d%s", stem, n, ext))
+		free := true
+		for _, key := range plan.outputKeys(candidate) {
+			free = free && !used[key]
+		}
+		if free {
+			return candidate
+		}
+	}
+}
+
+//! 入力ファイルが出力に書き出すパスの衝突判定キーを返す。元のHTMLファイルを出力に残す場合はその名前も含める。
+func (plan *CollisionPlan) outputKeys(relPath string) []string {
+	keys := []string{collisionKey(relPath, plan.policy)}
+	if plan.originals && strings.HasSuffix(strings.ToLower(relPath), ".html") {
+		keys = append(keys, originalKey(relPath, plan.policy, plan.renamePrefix))
+	}
+	return keys
+}
@@ -0,0 +1,132 @@
+package convert
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolveCollisionsSuffix(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       []string
+		prefix      string
+		originals   bool
+		collisions  int
+		wantRenames map[string]string
+	}{
+		{
+			name:        "no collision",
+			files:       []string{"a.html", "b.html", "img/a.png"},
+			prefix:      "_",
+			originals:   true,
+			wantRenames: map[string]string{},
+		},
+		{
+			name:        "case only",
+			files:       []string{"Page.html", "page.html"},
+			prefix:      "_",
+			originals:   true,
+			collisions:  1,
+			wantRenames: map[string]string{"page.html": "page-2.html"},
+		},
+		{
+			// 連番の候補が既存のファイルの出力先と重なる場合は、次の番号にする。
+			name:        "suffix taken",
+			files:       []string{"Page.html", "page.html", "page-2.md"},
+			prefix:      "_",
+			originals:   true,
+			collisions:  1,
+			wantRenames: map[string]string{"page.html": "page-3.html"},
+		},
+		{
+			// プレフィックスで始まるファイルも衝突の対象にする。
+			name:        "prefixed sources",
+			files:       []string{"_under.html", "_Under.html"},
+			prefix:      "_",
+			originals:   true,
+			collisions:  1,
+			wantRenames: map[string]string{"_under.html": "_under-2.html"},
+		},
+		{
+			name:        "html and md",
+			files:       []string{"doc.html", "doc.md"},
+			prefix:      "_",
+			collisions:  1,
+			wantRenames: map[string]string{"doc.md": "doc-2.md"},
+		},
+		{
+			name:        ".md.html",
+			files:       []string{"A.md.html", "a.md.html"},
+			prefix:      "_",
+			collisions:  1,
+			wantRenames: map[string]string{"a.md.html": "a-2.md.html"},
+		},
+	}
+	policy, _ := ParseNamingPolicy("lower")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := AnalyzeCollisions(tt.files, policy, tt.prefix, tt.originals)
+			if len(plan.Collisions) != tt.collisions {
+				t.Fatalf("collisions = %v, want %d", plan.Collisions, tt.collisions)
+			}
+			if err := ResolveCollisions(plan, CollisionSuffix, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(plan.Renames, tt.wantRenames) {
+				t.Errorf("Renames = %v, want %v", plan.Renames, tt.wantRenames)
+			}
+		})
+	}
+}
+
+//! 衝突を解決した後は、出力先と元のHTMLファイルの保存先がすべて異なること。
+func TestResolveCollisionsUniqueOutputs(t *testing.T) {
+	files := []string{"_under.html", "_Under.html", "under.html", "Under.html", "under-2.html"}
+	policy, _ := ParseNamingPolicy("lower")
+	plan := AnalyzeCollisions(files, policy, "_", true)
+	if err := ResolveCollisions(plan, CollisionSuffix, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]string{}
+	for _, file := range files {
+		for _, key := range plan.outputKeys(plan.Resolve(file)) {
+			if other, ok := seen[key]; ok {
+				t.Errorf("%s and %s both write %s", other, file, key)
+			}
+			seen[key] = file
+		}
+	}
+}
+
+func TestResolveCollisionsNewest(t *testing.T) {
+	policy, _ := ParseNamingPolicy("lower")
+	plan := AnalyzeCollisions([]string{"A.html", "a.html", "b.html"}, policy, "_", true)
+	now := time.Now()
+	modTimes := map[string]time.Time{"A.html": now.Add(-time.Hour), "a.html": now}
+	if err := ResolveCollisions(plan, CollisionNewest, modTimes, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"A.html"}; !reflect.DeepEqual(plan.Removed, want) {
+		t.Errorf("Removed = %v, want %v", plan.Removed, want)
+	}
+	if got := plan.Resolve("A.html"); got != "a.html" {
+		t.Errorf("Resolve(A.html) = %q, want a.html", got)
+	}
+	if !plan.IsRemoved("A.html") || plan.IsRemoved("a.html") {
+		t.Errorf("IsRemoved: A.html=%t, a.html=%t", plan.IsRemoved("A.html"), plan.IsRemoved("a.html"))
+	}
+}
+
+func TestResolveCollisionsFail(t *testing.T) {
+	policy, _ := ParseNamingPolicy("lower")
+	plan := AnalyzeCollisions([]string{"A.html", "a.html"}, policy, "_", true)
+	if err := ResolveCollisions(plan, CollisionFail, nil, nil); err == nil {
+		t.Error("ResolveCollisions(fail) returned no error")
+	}
+
+	plan = AnalyzeCollisions([]string{"a.html", "b.html"}, policy, "_", true)
+	if err := ResolveCollisions(plan, CollisionFail, nil, nil); err != nil {
+		t.Errorf("ResolveCollisions(fail) without collisions: %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package convert
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+)
+
+// 設定ファイルの変換規則の処理。
+const (
+	RuleActionBold       = "bold"       // 内容を太字にする。
+	RuleActionItalic     = "italic"     // 内容を斜体にする。
+	RuleActionCode       = "code"       // 要素のテキストをインラインコードにする。
+	RuleActionDrop       = "drop"       // 要素を内容ごと除く。
+	RuleActionText       = "text"       // タグを除いて内容だけを残す。
+	RuleActionHtml       = "html"       // 要素をHTMLのまま残す。
+	RuleActionBlockquote = "blockquote" // 内容を引用にする。
+	RuleActionTemplate   = "template"   // templateの{content}を内容に、{text}を要素のテキストに置き換える。どちらも前後の空白は除く。
+	RuleActionDisable    = "disable"    // 同じ名前の組み込みの規則を無効にする。
+)
+
+//! 設定ファイルの内容。
+type Config struct {
+	Rules    []RuleConfig `toml:"rule"`    // 変換規則。
+	Rewrites []Rewrite    `toml:"rewrite"` // 変換前のDOMの書き換え規則。
+	Plugins  []Plugin     `toml:"plugin"`  // 外部コマンドによる変換のプラグイン。
+	Scripts  []Script     `toml:"script"`  // JavaScriptによる変換のフック。
+	Replaces []Replace    `toml:"replace"` // 変換後のMarkdownの置換規則。
+
+	dir string // 設定ファイルのあるディレクトリ。プラグインのコマンドとスクリプトの相対パスの基準。
+}
+
+//! 設定ファイルの[[rule]]。Go以外からよく使う変換を指定するための、Ruleの宣言的な記述。
+type RuleConfig struct {
+	Name     string   `toml:"name"`     // 規則の名前。組み込みの規則と同じ名前にすると置き換える。省略時はセレクター。
+	Selector string   `toml:"selector"` // 対象の要素のCSSセレクター。
+	Paths    []string `toml:"paths"`    // 適用するページの、入力の相対パスのglob。
+	Action   string   `toml:"action"`   // 処理。templateを指定した場合は省略できる。
+	Template string   `toml:"template"` // RuleActionTemplateの出力。
+}
+
+//! TOMLの設定ファイルを読み込む。不明な項目がある場合は、書き間違いに気付けるようエラーにする。
+func LoadConfig(path string) (*Config, error) {
+	config := &Config{dir: filepath.Dir(path)}
+	meta, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return nil, errors.Errorf("設定ファイルの読み込みに失敗: %v", err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		sort.Strings(keys)
+		return nil, errors.Errorf("設定ファイル %s に不明な項目があります: %s", path, strings.Join(keys, ", "))
+	}
+	return config, nil
+}
+
+//! 設定ファイルの内容をオプションに反映する。
+func (c *Config) Apply(opts *Options) error {
+	for i := range c.Rules {
+		rule, err := c.Rules[i].Rule()
+		if err != nil {
+			return errors.Errorf("%d番目の規則: %v", i+1, err)
+		}
+		opts.Rules = append(opts.Rules, rule)
+	}
+	for _, rw := range c.Rewrites {
+		if err := validateRewrite(rw); err != nil {
+			return err
+		}
+		opts.Rewrites = append(opts.Rewrites, rw)
+	}
+	for _, plugin := range c.Plugins {
+		if err := validatePlugin(plugin); err != nil {
+			return err
+		}
+		// ./plugin.pyのような相対パスのコマンドは、実行時のディレクトリによらず設定ファイルの場所から探す。
+		command := plugin.Command[0]
+		if c.dir != "" && strings.ContainsAny(command, `/\`) && !filepath.IsAbs(command) {
+			plugin.Command = append([]string{filepath.Join(c.dir, command)}, plugin.Command[1:]...)
+		}
+		opts.Plugins = append(opts.Plugins, plugin)
+	}
+	for _, script := range c.Scripts {
+		if err := validateScript(script); err != nil {
+			return err
+		}
+		if c.dir != "" && script.File != "" && !filepath.IsAbs(script.File) {
+			script.File = filepath.Join(c.dir, script.File)
+		}
+		opts.Scripts = append(opts.Scripts, script)
+	}
+	for _, r := range c.Replaces {
+		if err := validateReplace(r); err != nil {
+			return err
+		}
+		opts.Replaces = append(opts.Replaces, r)
+	}
+	return nil
+}
+
+//! 設定ファイルの規則をRuleに変換する。
+func (rc *RuleConfig) Rule() (Rule, error) {
+	action := rc.Action
+	if action == "" && rc.Template != "" {
+		action = RuleActionTemplate
+	}
+	name := rc.Name
+	if name == "" {
+		name = rc.Selector
+	}
+	rule := Rule{Name: name, Selector: rc.Selector, Paths: rc.Paths, Version: action + ":" + rc.Template}
+	if action == RuleActionDisable {
+		if rc.Name == "" {
+			return rule, errors.Errorf("disable には無効にする規則の name を指定してください")
+		}
+		return rule, nil
+	}
+	if rc.Selector == "" {
+		return rule, errors.Errorf("selector を指定してください")
+	}
+
+	switch action {
+	case RuleActionBold:
+		rule.Convert = wrapRule("**")
+	case RuleActionItalic:
+		rule.Convert = wrapRule("_")
+	case RuleActionCode:
+		rule.Convert = func(content string, sel *goquery.Selection) (string, bool) {
+			return inlineCode(sel.Text()), true
+		}
+	case RuleActionDrop:
+		rule.Convert = func(content string, sel *goquery.Selection) (string, bool) {
+			return "", true
+		}
+	case RuleActionText:
+		rule.Convert = func(content string, sel *goquery.Selection) (string, bool) {
+			return content, true
+		}
+	case RuleActionHtml:
+		rule.Convert = func(content string, sel *goquery.Selection) (string, bool) {
+			return outerHtmlWithoutMarkers(sel), true
+		}
+	case RuleActionBlockquote:
+		rule.Convert = func(content string, sel *goquery.Selection) (string, bool) {
+			return "\n\n" + quoteLines(content) + "\n\n", true
+		}
+	case RuleActionTemplate:
+		template := rc.Template
+		rule.Convert = func(content string, sel *goquery.Selection) (string, bool) {
+			return strings.NewReplacer("{content}", strings.TrimSpace(content), "{text}", strings.TrimSpace(sel.Text())).Replace(template), true
+		}
+	default:
+		return rule, errors.Errorf("不明な処理です: %s (bold, italic, code, drop, text, html, blockquote, template, disableのいずれかを指定してください)", action)
+	}
+	return rule, nil
+}
+
+//! 前後の空白を除いた内容をdelimで囲む規則を返す。内容が空の場合は何も出力しない。
+func wrapRule(delim string) RuleFunc {
+	return func(content string, sel *goquery.Selection) (string, bool) {
+		trimmed := strings.TrimSpace(content)
+		if trimmed == "" {
+			return "", true
+		}
+		return delim + trimmed + delim, true
+	}
+}
+
+//! テキストをインラインコードにする。テキスト中のバッククォートより長い区切りを使う。
+func inlineCode(text string) string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ""
+	}
+	fence := "`"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") {
+		text = " " + text + " "
+	}
+	return fence + text + fence
+}
+
+//! 各行の先頭に引用の記号を付ける。連続する空行は1行にまとめる。
+func quoteLines(content string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(content), "\n") {
+		quoted := strings.TrimRight("> "+line, " ")
+		if quoted == ">" && len(lines) > 0 && lines[len(lines)-1] == ">" {
+			continue
+		}
+		lines = append(lines, quoted)
+	}
+	return strings.Join(lines, "\n")
+}
+
+//! 規則の適用のために付けた属性を除いて、要素をHTMLにする。
+func outerHtmlWithoutMarkers(sel *goquery.Selection) string {
+	clone := sel.Clone()
+	clone.RemoveAttr(ruleMarkerAttr)
+	clone.Find("[" + ruleMarkerAttr + "]").RemoveAttr(ruleMarkerAttr)
+	html, err := goquery.OuterHtml(clone)
+	if err != nil {
+		return ""
+	}
+	return html
+}
@@ -0,0 +1,223 @@
+package convert
+
+import (
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+//! 2つの変換結果の比較結果。ページは変換内容の記録の入力の相対パスで対応付ける。
+type OutputDiff struct {
+	OptionsChanged bool        `json:"options_changed"`        // 出力に影響するオプションか、いずれかのページに適用する設定ファイルの規則が異なるかどうか。
+	Added          []*PageDiff `json:"added,omitempty"`        // 新しい変換結果にだけあるページ。入力の相対パス順。
+	Removed        []*PageDiff `json:"removed,omitempty"`      // 古い変換結果にだけあるページ。入力の相対パス順。
+	Changed        []*PageDiff `json:"changed,omitempty"`      // 出力先か内容が変わったページ。入力の相対パス順。
+	Unchanged      int         `json:"unchanged"`              // 出力先と内容が同じページの数。
+	SummaryDiff    string      `json:"summary_diff,omitempty"` // SUMMARY.mdの差分(unified diff)。同じ場合は空。
+	LinksAdded     int         `json:"links_added"`            // 全ページで増えたリンクの数。
+	LinksRemoved   int         `json:"links_removed"`          // 全ページで減ったリンクの数。
+}
+
+//! 差分があればtrueを返す。
+func (d *OutputDiff) HasChanges() bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0 || len(d.Changed) > 0 || d.SummaryDiff != ""
+}
+
+//! 1ページ分の差分。追加したページでは古い側が、削除したページでは新しい側が空になる。
+type PageDiff struct {
+	Source       string   `json:"source"`                  // 入力の相対パス。
+	OldOutput    string   `json:"old_output,omitempty"`    // 古い変換結果での出力の相対パス。
+	NewOutput    string   `json:"new_output,omitempty"`    // 新しい変換結果での出力の相対パス。
+	OldTitle     string   `json:"old_title,omitempty"`     // 古い変換結果でのSUMMARY.mdのタイトル。
+	NewTitle     string   `json:"new_title,omitempty"`     // 新しい変換結果でのSUMMARY.mdのタイトル。
+	LinksAdded   []string `json:"links_added,omitempty"`   // 増えたリンク先。画像は先頭に!を付ける。
+	LinksRemoved []string `json:"links_removed,omitempty"` // 減ったリンク先。画像は先頭に!を付ける。
+	Diff         string   `json:"diff,omitempty"`          // Markdownの差分(unified diff)。内容が同じ場合は空。
+}
+
+//! 出力先が変わったかどうかを返す。
+func (p *PageDiff) Moved() bool {
+	return p.OldOutput != "" && p.NewOutput != "" && p.OldOutput != p.NewOutput
+}
+
+//! 2つの変換結果(ディレクトリまたはzipアーカイブ)を比べる。どちらにも変換内容の記録(.html2md/manifest.json)が必要。
+//! 記録の入力の相対パスでページを対応付け、出力したMarkdownの内容、SUMMARY.md、ページ内のリンクを比べる。
+func CompareOutputs(oldOut, newOut fs.FS) (*OutputDiff, error) {
+	oldCache, err := ReadBuildCacheFS(oldOut)
+	if err != nil {
+		return nil, errors.Errorf("古い変換結果の変換内容の記録を読み込めません: %v", err)
+	}
+	newCache, err := ReadBuildCacheFS(newOut)
+	if err != nil {
+		return nil, errors.Errorf("新しい変換結果の変換内容の記録を読み込めません: %v", err)
+	}
+	diff := &OutputDiff{OptionsChanged: oldCache.OptionsHash != newCache.OptionsHash}
+
+	oldPages, newPages := markdownEntries(oldCache), markdownEntries(newCache)
+	sources := map[string]bool{}
+	for source := range oldPages {
+		sources[source] = true
+	}
+	for source := range newPages {
+		sources[source] = true
+	}
+	sorted := make([]string, 0, len(sources))
+	for source := range sources {
+		sorted = append(sorted, source)
+	}
+	sort.Strings(sorted)
+
+	for _, source := range sorted {
+		oldEntry, newEntry := oldPages[source], newPages[source]
+		page := &PageDiff{Source: source}
+		var oldMarkdown, newMarkdown string
+		if oldEntry != nil {
+			page.OldOutput, page.OldTitle = oldEntry.Output, oldEntry.Title
+			if oldMarkdown, err = readOutput(oldOut, oldEntry.Output); err != nil {
+				return nil, err
+			}
+		}
+		if oldEntry != nil && newEntry != nil && oldEntry.RulesHash != newEntry.RulesHash {
+			diff.OptionsChanged = true
+		}
+		if newEntry != nil {
+			page.NewOutput, page.NewTitle = newEntry.Output, newEntry.Title
+			if newMarkdown, err = readOutput(newOut, newEntry.Output); err != nil {
+				return nil, err
+			}
+		}
+		page.LinksAdded, page.LinksRemoved = diffLinks(markdownLinks(oldMarkdown), markdownLinks(newMarkdown))
+		diff.LinksAdded += len(page.LinksAdded)
+		diff.LinksRemoved += len(page.LinksRemoved)
+		if oldMarkdown != newMarkdown {
+			if page.Diff, err = UnifiedDiff(oldMarkdown, newMarkdown, displayOutput(page.OldOutput), displayOutput(page.NewOutput), 3); err != nil {
+				return nil, err
+			}
+		}
+
+		switch {
+		case oldEntry == nil:
+			diff.Added = append(diff.Added, page)
+		case newEntry == nil:
+			diff.Removed = append(diff.Removed, page)
+		case page.Diff != "" || page.Moved() || page.OldTitle != page.NewTitle:
+			diff.Changed = append(diff.Changed, page)
+		default:
+			diff.Unchanged++
+		}
+	}
+
+	oldSummary, _ := fs.ReadFile(oldOut, "SUMMARY.md")
+	newSummary, _ := fs.ReadFile(newOut, "SUMMARY.md")
+	if string(oldSummary) != string(newSummary) {
+		if diff.SummaryDiff, err = UnifiedDiff(string(oldSummary), string(newSummary), "SUMMARY.md (古い)", "SUMMARY.md (新しい)", 3); err != nil {
+			return nil, err
+		}
+	}
+	return diff, nil
+}
+
+//! 変換内容の記録から、Markdownを出力したエントリを入力の相対パスで引けるようにする。
+func markdownEntries(cache *BuildCache) map[string]*ManifestEntry {
+	entries := map[string]*ManifestEntry{}
+	for _, entry := range cache.Entries {
+		if entry.Kind != EntryDir && strings.EqualFold(path.Ext(entry.Output), ".md") {
+			entries[entry.Source] = entry
+		}
+	}
+	return entries
+}
+
+//! 変換結果のファイルを読み込む。
+func readOutput(out fs.FS, name string) (string, error) {
+	data, err := fs.ReadFile(out, name)
+	if err != nil {
+		return "", errors.Errorf("変換結果のファイルを読み込めません: %v", err)
+	}
+	return string(data), nil
+}
+
+//! 差分の見出しに使う出力の相対パスを返す。ページがない側は/dev/nullとする。
+func displayOutput(output string) string {
+	if output == "" {
+		return "/dev/null"
+	}
+	return output
+}
+
+//! Markdownのリンク先と画像の参照先を出現順に返す。画像は先頭に!を付ける。
+func markdownLinks(markdown string) []string {
+	if markdown == "" {
+		return nil
+	}
+	source := []byte(markdown)
+	doc := goldmark.New(goldmark.WithExtensions(extension.GFM)).Parser().Parse(text.NewReader(source))
+	var links []string
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link:
+			links = append(links, string(n.Destination))
+		case *ast.Image:
+			links = append(links, "!"+string(n.Destination))
+		case *ast.AutoLink:
+			links = append(links, string(n.URL(source)))
+		}
+		return ast.WalkContinue, nil
+	})
+	return links
+}
+
+//! 2つのリンクの一覧を同じリンク先の数も含めて比べ、増えたものと減ったものをそれぞれソートして返す。
+func diffLinks(oldLinks, newLinks []string) (added, removed []string) {
+	counts := map[string]int{}
+	for _, link := range oldLinks {
+		counts[link]--
+	}
+	for _, link := range newLinks {
+		counts[link]++
+	}
+	for link, count := range counts {
+		for ; count > 0; count-- {
+			added = append(added, link)
+		}
+		for ; count < 0; count++ {
+			removed = append(removed, link)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+//! 2つの文字列の行単位の差分をunified diffの形式で返す。同じ場合は空文字列を返す。
+func UnifiedDiff(a, b, fromFile, toFile string, context int) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        diffLines(a),
+		B:        diffLines(b),
+		FromFile: fromFile,
+		ToFile:   toFile,
+		Context:  context,
+	})
+}
+
+//! 差分を表示するために、改行を含めて行に分ける。末尾に改行がない行にも改行を付ける。
+func diffLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	} else {
+		lines[len(lines)-1] += "\n"
+	}
+	return lines
+}
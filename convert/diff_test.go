@@ -0,0 +1,93 @@
+package convert
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+//! inputをnamingの命名ポリシーでメモリ上に変換する。
+func convertToMemory(t *testing.T, input fstest.MapFS, naming string) *MemoryFS {
+	t.Helper()
+	out := NewMemoryFS()
+	opts := DefaultOptions()
+	opts.Naming = naming
+	if _, err := TreeTo(t.Context(), input, out, opts); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCompareOutputs(t *testing.T) {
+	oldInput := fstest.MapFS{
+		"A.html":    {Data: []byte(`<p>a</p>`)},
+		"b.html":    {Data: []byte(`<p><a href="A.html">a</a></p>`)},
+		"c.html":    {Data: []byte(`<p>c</p>`)},
+		"gone.html": {Data: []byte(`<p>gone</p>`)},
+	}
+	newInput := fstest.MapFS{
+		"A.html":   {Data: []byte(`<p>a2</p>`)},
+		"b.html":   {Data: []byte(`<p><a href="new.html">new</a></p>`)},
+		"c.html":   {Data: []byte(`<p>c</p>`)},
+		"new.html": {Data: []byte(`<p>new</p>`)},
+	}
+
+	t.Run("same", func(t *testing.T) {
+		diff, err := CompareOutputs(convertToMemory(t, oldInput, NamingLower), convertToMemory(t, oldInput, NamingLower))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff.HasChanges() || diff.OptionsChanged || diff.Unchanged != 4 {
+			t.Errorf("diff = %+v, want 4 unchanged pages", diff)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		diff, err := CompareOutputs(convertToMemory(t, oldInput, NamingLower), convertToMemory(t, newInput, NamingKeep))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !diff.HasChanges() || !diff.OptionsChanged || diff.Unchanged != 1 || diff.SummaryDiff == "" {
+			t.Errorf("diff = %+v, want changes with different options", diff)
+		}
+		sources := func(pages []*PageDiff) []string {
+			var names []string
+			for _, page := range pages {
+				names = append(names, page.Source)
+			}
+			return names
+		}
+		if got := sources(diff.Added); !reflect.DeepEqual(got, []string{"new.html"}) {
+			t.Errorf("added = %v, want [new.html]", got)
+		}
+		if got := sources(diff.Removed); !reflect.DeepEqual(got, []string{"gone.html"}) {
+			t.Errorf("removed = %v, want [gone.html]", got)
+		}
+		if got := sources(diff.Changed); !reflect.DeepEqual(got, []string{"A.html", "b.html"}) {
+			t.Fatalf("changed = %v, want [A.html b.html]", got)
+		}
+		moved, links := diff.Changed[0], diff.Changed[1]
+		if !moved.Moved() || moved.OldOutput != "a.md" || moved.NewOutput != "A.md" || moved.Diff == "" {
+			t.Errorf("A.html = %+v, want moved from a.md to A.md with a diff", moved)
+		}
+		if !reflect.DeepEqual(links.LinksAdded, []string{"new.md"}) || !reflect.DeepEqual(links.LinksRemoved, []string{"a.md"}) {
+			t.Errorf("b.html links = +%v -%v, want +[new.md] -[a.md]", links.LinksAdded, links.LinksRemoved)
+		}
+		if diff.LinksAdded != 1 || diff.LinksRemoved != 1 {
+			t.Errorf("links = +%d -%d, want +1 -1", diff.LinksAdded, diff.LinksRemoved)
+		}
+	})
+
+	t.Run("no manifest", func(t *testing.T) {
+		if _, err := CompareOutputs(fstest.MapFS{}, convertToMemory(t, oldInput, NamingLower)); err == nil {
+			t.Error("err = nil, want an error for an output without the manifest")
+		}
+	})
+}
+
+func TestDiffLinks(t *testing.T) {
+	added, removed := diffLinks([]string{"a.md", "b.md", "b.md", "!x.png"}, []string{"b.md", "c.md", "!x.png", "!y.png"})
+	if !reflect.DeepEqual(added, []string{"!y.png", "c.md"}) || !reflect.DeepEqual(removed, []string{"a.md", "b.md"}) {
+		t.Errorf("added %v, removed %v", added, removed)
+	}
+}
@@ -0,0 +1,163 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+)
+
+//! 1つのHTML文書をMarkdownに変換する。srcPathは変換後の出力先と相対リンクの解決に使う、文書のルートからの相対パス。
+//! 他のファイルの実在は確認できないため、相対リンクには命名ポリシーだけを適用する。
+//! 制限に達した場合はopts.LimitActionに従い、Page.Limitに記録する。LimitActionSkipの場合はMarkdownが空になる。
+func Document(r io.Reader, srcPath string, opts Options) (*Page, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	policy, err := ParseNamingPolicy(opts.Naming)
+	if err != nil {
+		return nil, err
+	}
+	htmlContent, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Errorf("HTMLの読み込みに失敗: %v", err)
+	}
+
+	pageRel := strings.TrimPrefix(path.Clean(filepath.ToSlash(srcPath)), "/")
+	page := &Page{Source: pageRel, Output: OutputPath(pageRel, policy)}
+	page.Title = PageTitle(page.Output)
+	converter, err := NewConverter(&opts)
+	if err != nil {
+		return nil, err
+	}
+	defer converter.Close()
+	if err := convertPage(context.Background(), converter, htmlContent, page, NewPathMap(policy), &opts); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+//! HTMLの内容をMarkdownに変換し、page.Markdownとpage.Linksに設定する。page.Sourceはリンク解決に使う変換前の相対パス。
+//! 変換の前後にプラグインとスクリプトを呼び出し、それらが設定したフロントマターはMarkdownの先頭に付ける。
+//! 最後に、フロントマターを含む出力の内容に置換規則を適用する。
+//! HTMLがサイズ・DOMの深さ・変換時間の制限に達した場合はopts.LimitActionに従って処理し、page.Limitに記録する。
+//! 時間切れの変換は、ConvertHtmlContentの処理の区切りで止まるまでconverterのバックグラウンドで実行される。
+func convertPage(ctx context.Context, converter *Converter, htmlContent []byte, page *Page, paths *PathMap, opts *Options) error {
+	hit := sizeLimitHit(int64(len(htmlContent)), opts)
+
+	if hit == nil {
+		// プラグインの処理時間は、変換時間の制限に含めない。
+		html, err := converter.runPlugins(PluginStageHtml, page, string(htmlContent))
+		if err != nil {
+			return err
+		}
+		htmlContent = []byte(html)
+
+		// 制限時間を過ぎても処理の区切りまでは変換が続くため、スクリプトには複製したページを渡し、変換できた場合だけ反映する。
+		scratch := *page
+		scratch.Warnings = append([]string(nil), page.Warnings...)
+		var links []*Link
+		markdown, timedOut, err := RunWithTimeout(ctx, opts.Timeout, opts.Logger, converter.background, func(ctx context.Context) (string, error) {
+			var markdown string
+			var err error
+			markdown, links, err = ConvertHtmlContent(ctx, converter, htmlContent, &scratch, paths, opts.MaxDepth)
+			return markdown, err
+		})
+		var depthErr *DepthLimitError
+		switch {
+		case timedOut:
+			hit = &LimitHit{Limit: LimitTimeout, Detail: fmt.Sprintf("> %v", opts.Timeout)}
+		case errors.As(err, &depthErr):
+			hit = &LimitHit{Limit: LimitDepth, Detail: fmt.Sprintf("%d > %d", depthErr.Depth, opts.MaxDepth)}
+		case err != nil:
+			return err
+		default:
+			page.FrontMatter = scratch.FrontMatter
+			page.Warnings = scratch.Warnings
+			page.Rewrites = scratch.Rewrites
+			if markdown, err = converter.runPlugins(PluginStageMarkdown, page, markdown); err != nil {
+				return err
+			}
+			if markdown, err = withFrontMatter(page.FrontMatter, markdown); err != nil {
+				return err
+			}
+			page.Markdown, page.Replaces = converter.applyReplaces(markdown, page.Source)
+			page.Links = links
+			return nil
+		}
+	}
+
+	// 制限に達した場合は、変換の代わりに指定された処理を行う。
+	hit.Source = page.Source
+	hit.Action = opts.LimitAction
+	opts.logf("制限に達しました: %v", hit)
+	markdown, _, err := LimitFallback(opts.LimitAction, htmlContent)
+	if err != nil {
+		return err
+	}
+	page.Markdown = markdown
+	page.Limit = hit
+	return nil
+}
+
+//! HTMLの内容をMarkdownに変換する。page.Sourceはリンク解決に使う変換前の相対パス。
+//! スクリプトが設定したフロントマターと警告、書き換え規則の適用数はpageに設定する。
+//! maxDepthが0より大きく、DOMの深さがそれを超える場合は変換せずに*DepthLimitErrorを返す。
+//! 解析・書き換え・スクリプト・Markdownへの変換の各段階の間でctxを確認し、取り消されていればctxのエラーを返す。
+func ConvertHtmlContent(ctx context.Context, converter *Converter, htmlContent []byte, page *Page, paths *PathMap, maxDepth int) (string, []*Link, error) {
+	pageRel := page.Source
+
+	// HTMLを解析。
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(htmlContent))
+	if err != nil {
+		return "", nil, errors.Errorf("HTML解析エラー: %v", err)
+	}
+
+	// 深く入れ子になったHTMLは変換に時間がかかるため、変換する前に深さを確認する。
+	if maxDepth > 0 {
+		if depth := DomDepth(doc.Nodes[0]); depth > maxDepth {
+			return "", nil, &DepthLimitError{Depth: depth}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+
+	// 書き換え規則とスクリプトでDOMを書き換えてから、リンクの変換とMarkdownへの変換を行う。
+	page.Rewrites = converter.Rewrite(doc, pageRel)
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	if err := converter.runBeforeScripts(doc, page); err != nil {
+		return "", nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+
+	// HTMLへの相対リンクを出力後のMarkdownファイルへのリンクに変換。
+	links := ConvertHtmlLinksToMd(doc, pageRel, paths)
+
+	// 変換規則を適用しながらHTMLをMarkdownに変換。
+	markdown := converter.Convert(doc, pageRel)
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	markdown, err = converter.runAfterScripts(markdown, page)
+	if err != nil {
+		return "", nil, err
+	}
+	return markdown, links, nil
+}
+
+//! HTMLファイル名から変換後のMarkdownファイル名を生成する(.html → .md、.md.md問題を回避)。
+func MarkdownFileName(htmlName string) string {
+	name := strings.TrimSuffix(htmlName, ".html")
+	return strings.TrimSuffix(name, ".md") + ".md"
+}
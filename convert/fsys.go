@@ -0,0 +1,343 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//! 変換結果の書き込み先。パスは出力のルートからのスラッシュ区切りの相対パス。
+//! fs.FSとして、書き込んだ内容や既存の出力を読み出せる。書き込みは複数のゴルーチンから並行して呼び出される。
+type OutputFS interface {
+	fs.FS
+
+	//! ディレクトリを親ディレクトリとともに作成する。既に存在する場合は何もしない。
+	MkdirAll(name string) error
+
+	//! ファイルを作成する。親ディレクトリも作成し、既存のファイルは置き換える。
+	//! modTimeがゼロ値でなければ、閉じた時点でファイルの更新日時に設定する。
+	Create(name string, modTime time.Time) (io.WriteCloser, error)
+
+	//! ファイルまたは空のディレクトリを削除する。存在しない場合はfs.ErrNotExistを返す。
+	Remove(name string) error
+}
+
+//! OutputFSにファイルを書き込む。
+func WriteFile(out OutputFS, name string, data []byte) error {
+	w, err := out.Create(name, time.Time{})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+//! 入力のファイルをOutputFSにコピーする。衝突解決のnewest方式や同期で使うため、更新日時を引き継ぐ。
+func CopyFromFS(src fs.FS, name string, out OutputFS, outName string) error {
+	srcFile, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+	dstFile, err := out.Create(outName, info.ModTime())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		return err
+	}
+	return dstFile.Close()
+}
+
+//! ディスク上のディレクトリに書き込むOutputFS。
+type DiskFS struct {
+	Dir string // 出力のルートディレクトリ。
+}
+
+//! dirに書き込むDiskFSを作成する。
+func NewDiskFS(dir string) *DiskFS {
+	return &DiskFS{Dir: dir}
+}
+
+//! 出力の相対パスをディスク上のパスに変換する。
+func (d *DiskFS) path(name string) string {
+	return filepath.Join(d.Dir, filepath.FromSlash(name))
+}
+
+func (d *DiskFS) Open(name string) (fs.File, error) {
+	return os.DirFS(d.Dir).Open(name)
+}
+
+func (d *DiskFS) MkdirAll(name string) error {
+	return os.MkdirAll(d.path(name), 0755)
+}
+
+//! 作業用ディレクトリでは前回の出力とハードリンクで共有しているファイルがあるため、
+//! 前回の出力を書き換えないよう、既存のファイルは削除してから新しく作る。
+func (d *DiskFS) Create(name string, modTime time.Time) (io.WriteCloser, error) {
+	p := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	return &diskFile{File: f, modTime: modTime}, nil
+}
+
+func (d *DiskFS) Remove(name string) error {
+	return os.Remove(d.path(name))
+}
+
+//! 閉じた時点で更新日時を設定するファイル。
+type diskFile struct {
+	*os.File
+	modTime time.Time
+}
+
+func (f *diskFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if f.modTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(f.Name(), f.modTime, f.modTime)
+}
+
+//! メモリ上に書き込むOutputFS。一時ディレクトリを使わずに変換結果を確認する場合に使う。
+//! ディレクトリはMkdirAllかCreateで作成したものだけが存在し、ルート(.)は常に存在する。
+type MemoryFS struct {
+	mu    sync.Mutex
+	files map[string]*memoryEntry // 相対パス → ファイルまたはディレクトリ。ルートは含まない。
+}
+
+//! MemoryFSのファイルまたはディレクトリ。登録後は変更しないため、ロックせずに読み出せる。
+type memoryEntry struct {
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+//! 空のMemoryFSを作成する。
+func NewMemoryFS() *MemoryFS {
+	return &MemoryFS{files: map[string]*memoryEntry{}}
+}
+
+func (m *MemoryFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.files[name]
+	if name == "." {
+		entry, ok = &memoryEntry{mode: fs.ModeDir | 0755}, true
+	}
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	info := &memoryFileInfo{name: path.Base(name), entry: entry}
+	if !entry.mode.IsDir() {
+		return &memoryReader{Reader: bytes.NewReader(entry.data), info: info}, nil
+	}
+	// ディレクトリの一覧は開いた時点の内容にする。
+	dir := &memoryDir{info: info}
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	for p, child := range m.files {
+		if rest, ok := strings.CutPrefix(p, prefix); ok && rest != "" && !strings.Contains(rest, "/") {
+			dir.entries = append(dir.entries, fs.FileInfoToDirEntry(&memoryFileInfo{name: rest, entry: child}))
+		}
+	}
+	sort.Slice(dir.entries, func(i, j int) bool { return dir.entries[i].Name() < dir.entries[j].Name() })
+	return dir, nil
+}
+
+func (m *MemoryFS) MkdirAll(name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for p := name; p != "."; p = path.Dir(p) {
+		if f, ok := m.files[p]; ok {
+			if !f.mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: name, Err: errors.Errorf("%s はファイルです", p)}
+			}
+			break
+		}
+		m.files[p] = &memoryEntry{mode: fs.ModeDir | 0755, modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *MemoryFS) Create(name string, modTime time.Time) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	if err := m.MkdirAll(path.Dir(name)); err != nil {
+		return nil, err
+	}
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	return &memoryFile{fsys: m, name: name, modTime: modTime}, nil
+}
+
+func (m *MemoryFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if f.mode.IsDir() {
+		for p := range m.files {
+			if strings.HasPrefix(p, name+"/") {
+				return &fs.PathError{Op: "remove", Path: name, Err: errors.Errorf("ディレクトリが空ではありません")}
+			}
+		}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+//! 書き込んだファイルとディレクトリの相対パスを、パス順に返す。
+func (m *MemoryFS) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//! 閉じた時点でMemoryFSに内容を登録するファイル。書き込み途中の内容は読み出せない。
+type memoryFile struct {
+	bytes.Buffer
+	fsys    *MemoryFS
+	name    string
+	modTime time.Time
+}
+
+func (f *memoryFile) Close() error {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if old, ok := f.fsys.files[f.name]; ok && old.mode.IsDir() {
+		return &fs.PathError{Op: "create", Path: f.name, Err: errors.Errorf("ディレクトリです")}
+	}
+	f.fsys.files[f.name] = &memoryEntry{data: f.Bytes(), mode: 0644, modTime: f.modTime}
+	return nil
+}
+
+//! MemoryFSのファイルまたはディレクトリの情報。
+type memoryFileInfo struct {
+	name  string
+	entry *memoryEntry
+}
+
+func (i *memoryFileInfo) Name() string       { return i.name }
+func (i *memoryFileInfo) Size() int64        { return int64(len(i.entry.data)) }
+func (i *memoryFileInfo) Mode() fs.FileMode  { return i.entry.mode }
+func (i *memoryFileInfo) ModTime() time.Time { return i.entry.modTime }
+func (i *memoryFileInfo) IsDir() bool        { return i.entry.mode.IsDir() }
+func (i *memoryFileInfo) Sys() any           { return nil }
+
+//! MemoryFSから開いたファイル。
+type memoryReader struct {
+	*bytes.Reader
+	info *memoryFileInfo
+}
+
+func (f *memoryReader) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memoryReader) Close() error               { return nil }
+
+//! MemoryFSから開いたディレクトリ。
+type memoryDir struct {
+	info    *memoryFileInfo
+	entries []fs.DirEntry // 開いた時点の子の一覧。名前順。
+	offset  int
+}
+
+func (d *memoryDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memoryDir) Close() error               { return nil }
+
+func (d *memoryDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.Errorf("ディレクトリです")}
+}
+
+func (d *memoryDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
+
+//! zipアーカイブに書き込むOutputFS。
+//! zipは1ファイルずつ順に書き込む形式のため、内容はメモリ上に溜めておき、Closeでパス順に書き出す。
+//! 同じ入力からは同じ順序のアーカイブになる。
+type ZipFS struct {
+	*MemoryFS
+	w io.Writer
+}
+
+//! wにzipアーカイブを書き出すZipFSを作成する。書き込みを終えたらCloseを呼ぶこと。
+func NewZipFS(w io.Writer) *ZipFS {
+	return &ZipFS{MemoryFS: NewMemoryFS(), w: w}
+}
+
+//! 書き込んだ内容をzipアーカイブとして書き出す。空のディレクトリもエントリとして残す。
+func (z *ZipFS) Close() error {
+	zw := zip.NewWriter(z.w)
+	for _, name := range z.Names() {
+		f := z.files[name]
+		header := &zip.FileHeader{Name: name, Modified: f.modTime, Method: zip.Deflate}
+		if f.mode.IsDir() {
+			header.Name += "/"
+			header.Method = zip.Store
+		}
+		header.SetMode(f.mode)
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return errors.Errorf("zipへの書き込みに失敗 %s: %v", name, err)
+		}
+		if _, err := w.Write(f.data); err != nil {
+			return errors.Errorf("zipへの書き込みに失敗 %s: %v", name, err)
+		}
+	}
+	return zw.Close()
+}
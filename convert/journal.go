@@ -0,0 +1,157 @@
+package convert
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// 作業用ディレクトリ内に置く、完了した処理の記録。中断後に--resumeで再開するときに使い、入れ替え前に削除する。
+const JournalFileName = "journal.jsonl"
+
+// ジャーナルに記録する処理の種類。
+const (
+	JournalStart = "start" // 変換の開始。オプションのハッシュを記録する。
+	JournalFile  = "file"  // 1ファイルの出力の完了。
+)
+
+//! ジャーナルの1行。
+type JournalRecord struct {
+	Step        string            `json:"step"`
+	OptionsHash string            `json:"options_hash,omitempty"` // startのみ。
+	Source      string            `json:"source,omitempty"`       // fileのみ。入力ディレクトリからの相対パス。
+	Hash        string            `json:"sha256,omitempty"`       // fileのみ。出力時の入力ファイルの内容のSHA-256。
+	RulesHash   string            `json:"rules_hash,omitempty"`   // fileのみ。ページに適用した設定ファイルの規則のハッシュ。
+	Output      string            `json:"output,omitempty"`       // fileのみ。出力ディレクトリからの相対パス。
+	Links       map[string]string `json:"links,omitempty"`        // fileのみ。ページ内のリンク先の入力の相対パス → 出力の相対パス。
+	Warnings    []string          `json:"warnings,omitempty"`     // fileのみ。ページの変換時の警告。
+	Rewrites    map[string]int    `json:"rewrites,omitempty"`     // fileのみ。書き換え規則の名前 → 書き換えた要素の数。
+	Replaces    map[string]int    `json:"replaces,omitempty"`     // fileのみ。置換規則の名前 → 置換した箇所の数。
+}
+
+//! 作業用ディレクトリへの変換の進み具合を1行ずつ追記する記録。並行して書き込める。
+type Journal struct {
+	mu   sync.Mutex
+	file *os.File
+	done map[string]JournalRecord // 再開時に、前回の実行で出力済みのファイル。入力の相対パス → 記録。
+}
+
+//! ジャーナルのパスを返す。
+func journalPath(staging string) string {
+	return filepath.Join(staging, CacheDirName, JournalFileName)
+}
+
+//! 作業用ディレクトリのジャーナルを読み込む。ジャーナルがない場合やオプションが異なる場合はnilを返す。
+func ReadJournal(staging, optionsHash string) map[string]JournalRecord {
+	f, err := os.Open(journalPath(staging))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	done := map[string]JournalRecord{}
+	started := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record JournalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// 中断時に書きかけだった最後の行は無視する。
+			continue
+		}
+		switch record.Step {
+		case JournalStart:
+			if record.OptionsHash != optionsHash {
+				return nil
+			}
+			started = true
+		case JournalFile:
+			done[record.Source] = record
+		}
+	}
+	if !started {
+		return nil
+	}
+	return done
+}
+
+//! ジャーナルを開く。doneが前回の実行の記録の場合は追記し、nilの場合は新しく作る。
+func OpenJournal(staging, optionsHash string, done map[string]JournalRecord) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(journalPath(staging)), 0755); err != nil {
+		return nil, err
+	}
+	flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if done == nil {
+		flag |= os.O_TRUNC
+		done = map[string]JournalRecord{}
+	}
+	f, err := os.OpenFile(journalPath(staging), flag, 0644)
+	if err != nil {
+		return nil, errors.Errorf("ジャーナルの作成に失敗: %v", err)
+	}
+	j := &Journal{file: f, done: done}
+	if err := j.Record(JournalRecord{Step: JournalStart, OptionsHash: optionsHash}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+//! 1件の記録を追記する。
+func (j *Journal) Record(record JournalRecord) error {
+	if j == nil {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return errors.Errorf("ジャーナルの書き込みに失敗: %v", err)
+	}
+	return nil
+}
+
+//! エントリの出力を完了として記録する。entry.Hashは計算済みであること。
+func (j *Journal) RecordFile(entry *ManifestEntry) error {
+	return j.Record(JournalRecord{Step: JournalFile, Source: entry.Source, Hash: entry.Hash, RulesHash: entry.RulesHash, Output: entry.Output, Links: entry.Links, Warnings: entry.Warnings, Rewrites: entry.Rewrites, Replaces: entry.Replaces})
+}
+
+//! 前回の実行で同じ内容のエントリを同じ出力先に出力済みで、出力が残っているかどうかを返す。entry.Hashは計算済みであること。
+//! ページ内のリンク先の解決結果がpathsで変わる場合はfalseを返す。trueの場合は、記録したリンク先と警告、書き換え規則の適用数をentryに引き継ぐ。
+func (j *Journal) Done(entry *ManifestEntry, out fs.FS, paths *PathMap) bool {
+	if j == nil {
+		return false
+	}
+	record, ok := j.done[entry.Source]
+	if !ok || record.Hash != entry.Hash || record.RulesHash != entry.RulesHash || record.Output != entry.Output || !linksUpToDate(record.Links, paths) {
+		return false
+	}
+	if _, err := fs.Stat(out, entry.Output); err != nil {
+		return false
+	}
+	entry.Links, entry.Warnings, entry.Rewrites, entry.Replaces = record.Links, record.Warnings, record.Rewrites, record.Replaces
+	return true
+}
+
+//! ジャーナルを閉じる。
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+//! ジャーナルを閉じて削除する。作業用ディレクトリを出力ディレクトリと入れ替える前に呼ぶ。
+func (j *Journal) Remove(staging string) error {
+	if err := j.Close(); err != nil {
+		return err
+	}
+	return os.Remove(journalPath(staging))
+}
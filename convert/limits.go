@@ -0,0 +1,248 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// 制限に達したファイルの扱い。
+const (
+	LimitActionSkip = "skip" // 出力しない。
+	LimitActionRaw  = "raw"  // 元のHTMLをそのままコードブロックに入れて出力する。
+	LimitActionText = "text" // HTMLからテキストだけを取り出して出力する。
+)
+
+// 制限の種類。
+const (
+	LimitFileSize = "file-size" // 入力ファイルのサイズ。
+	LimitDepth    = "depth"     // DOMの入れ子の深さ。
+	LimitTimeout  = "timeout"   // 1ファイルの変換にかかる時間。
+)
+
+//! 制限に達したファイルの記録。
+type LimitHit struct {
+	Source string `json:"source"` // 入力ディレクトリからの相対パス。
+	Limit  string `json:"limit"`  // 達した制限の種類。
+	Detail string `json:"detail"` // 実際の値と制限値。
+	Action string `json:"action"` // 代わりに行った処理。
+}
+
+func (h *LimitHit) String() string {
+	return fmt.Sprintf("%s: %s (%s) → %s", h.Source, h.Limit, h.Detail, h.Action)
+}
+
+//! 制限に達したファイルの扱いを検証する。
+func ValidateLimitAction(action string) error {
+	switch action {
+	case LimitActionSkip, LimitActionRaw, LimitActionText:
+		return nil
+	}
+	return errors.Errorf("制限に達したファイルの扱いには skip, raw, text のいずれかを指定してください: %s", action)
+}
+
+//! DOMの深さが制限を超えたことを表すエラー。
+type DepthLimitError struct {
+	Depth int // 実際の深さ。
+}
+
+func (e *DepthLimitError) Error() string {
+	return fmt.Sprintf("DOMの深さが制限を超えています: %d", e.Depth)
+}
+
+//! バイト数を表す引数。数値のみ、またはKB, MB, GBの単位付き(1024倍)で指定する。
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	s := strings.ToUpper(strings.TrimSpace(string(text)))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return errors.Errorf("サイズの指定が不正です: %s", text)
+	}
+	*b = ByteSize(n * float64(multiplier))
+	return nil
+}
+
+func (b ByteSize) String() string {
+	for _, unit := range []struct {
+		suffix string
+		size   ByteSize
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if b >= unit.size {
+			if b%unit.size == 0 {
+				return fmt.Sprintf("%d%s", b/unit.size, unit.suffix)
+			}
+			return fmt.Sprintf("%.1f%s", float64(b)/float64(unit.size), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", int64(b))
+}
+
+//! DOMの要素の入れ子の最大の深さを返す。深く入れ子になった入力でスタックを使い切らないよう、再帰せずに数える。
+func DomDepth(root *html.Node) int {
+	type item struct {
+		node  *html.Node
+		depth int
+	}
+	maxDepth := 0
+	stack := []item{{root, 0}}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		depth := current.depth
+		if current.node.Type == html.ElementNode {
+			depth++
+			if depth > maxDepth {
+				maxDepth = depth
+			}
+		}
+		for child := current.node.FirstChild; child != nil; child = child.NextSibling {
+			stack = append(stack, item{child, depth})
+		}
+	}
+	return maxDepth
+}
+
+//! 入力のサイズが制限を超えていれば、その記録を返す。
+func sizeLimitHit(size int64, opts *Options) *LimitHit {
+	if opts.MaxFileSize <= 0 || size <= opts.MaxFileSize {
+		return nil
+	}
+	return &LimitHit{Limit: LimitFileSize, Detail: fmt.Sprintf("%s > %s", ByteSize(size), ByteSize(opts.MaxFileSize)), Action: opts.LimitAction}
+}
+
+//! 時間切れで結果を捨てたあとも、バックグラウンドで実行中の処理。同時に実行する数を制限し、すべて終わるまで待てる。
+type BackgroundRuns struct {
+	wg    sync.WaitGroup
+	slots chan struct{}
+}
+
+//! 同時に最大limit個までバックグラウンドで実行できるBackgroundRunsを作成する。limitが0以下の場合はCPU数を使う。
+func NewBackgroundRuns(limit int) *BackgroundRuns {
+	return &BackgroundRuns{slots: make(chan struct{}, ResolveJobs(limit))}
+}
+
+//! バックグラウンドで実行中の処理がすべて終わるまで待つ。
+func (b *BackgroundRuns) Wait() {
+	b.wg.Wait()
+}
+
+//! fnを別のゴルーチンで実行し、timeout以内に終わらなければtimedOutをtrueにして返す。timeoutが0以下の場合は制限しない。
+//! 時間切れになるとfnに渡したコンテキストを取り消すため、fnは処理の区切りごとにコンテキストを確認して終えること。
+//! 区切りの途中では止められないため、時間切れになったfnは区切りまでbackgroundで実行され、結果は捨てられる。
+//! backgroundが上限に達している場合は、fnが終わるまで待ってから返す。
+//! fn内で発生したパニックはエラーとして返し、スタックトレースをloggerに出力する。
+func RunWithTimeout(ctx context.Context, timeout time.Duration, logger *log.Logger, background *BackgroundRuns, fn func(ctx context.Context) (string, error)) (result string, timedOut bool, err error) {
+	if timeout <= 0 {
+		err = RecoverPanic(logger, func() error {
+			result, err = fn(ctx)
+			return err
+		})
+		return result, false, err
+	}
+
+	type outcome struct {
+		result string
+		err    error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan outcome, 1)
+	background.wg.Add(1)
+	go func() {
+		defer background.wg.Done()
+		var o outcome
+		o.err = RecoverPanic(logger, func() error {
+			o.result, o.err = fn(ctx)
+			return o.err
+		})
+		done <- o
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		return o.result, false, o.err
+	case <-timer.C:
+	}
+	cancel()
+	select {
+	case background.slots <- struct{}{}:
+		// fnが終わったら枠を空ける。
+		go func() {
+			<-done
+			<-background.slots
+		}()
+	default:
+		<-done
+	}
+	return "", true, nil
+}
+
+//! 制限に達したHTMLを、actionに従って代わりのMarkdownにする。skipの場合は出力しないためfalseを返す。
+func LimitFallback(action string, htmlContent []byte) (string, bool, error) {
+	switch action {
+	case LimitActionRaw:
+		return RawHtmlBlock(string(htmlContent)), true, nil
+	case LimitActionText:
+		text, err := PlainText(htmlContent)
+		return text, true, err
+	}
+	return "", false, nil
+}
+
+//! HTMLをそのままコードブロックに入れる。内容にバッククォートが連続していても閉じないよう、それより長いフェンスを使う。
+func RawHtmlBlock(content string) string {
+	longest, run := 0, 0
+	for _, c := range content {
+		if c == '`' {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+	return fence + "html\n" + strings.TrimRight(content, "\n") + "\n" + fence + "\n"
+}
+
+//! HTMLから表示されるテキストだけを取り出す。空でない行をそれぞれ1段落にする。
+func PlainText(htmlContent []byte) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(htmlContent)))
+	if err != nil {
+		return "", errors.Errorf("HTML解析エラー: %v", err)
+	}
+	doc.Find("script, style, noscript, template").Remove()
+	// ブロック要素の境目で行を分ける。
+	doc.Find("address, article, aside, blockquote, br, dd, div, dl, dt, fieldset, figcaption, figure, footer, form, h1, h2, h3, h4, h5, h6, header, hr, li, main, nav, ol, p, pre, section, table, td, th, tr, ul").AfterHtml("\n")
+
+	var paragraphs []string
+	for _, line := range strings.Split(doc.Text(), "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			paragraphs = append(paragraphs, line)
+		}
+	}
+	return strings.Join(paragraphs, "\n\n") + "\n", nil
+}
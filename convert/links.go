@@ -0,0 +1,187 @@
+package convert
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+//! 変換前の相対パスから出力後の相対パスを引く対応表。リンク先の解決に使う。
+type PathMap struct {
+	outputs map[string]string // 変換前の相対パス → 出力後の相対パス。
+	folded  map[string]string // 小文字にした変換前の相対パス → 変換前の相対パス。
+	policy  *NamingPolicy
+	checked bool // 入力ディレクトリの全ファイルを登録済みで、リンク先の実在を確認できるかどうか。
+}
+
+//! 入力ファイルの相対パスの一覧から対応表を作る。衝突解決でリネーム・破棄されたパスは解決後のファイルに対応付ける。
+func BuildPathMap(files []string, plan *CollisionPlan, policy *NamingPolicy) *PathMap {
+	paths := &PathMap{outputs: map[string]string{}, folded: map[string]string{}, policy: policy, checked: true}
+	for _, relPath := range files {
+		paths.add(relPath, OutputPath(plan.Resolve(relPath), policy))
+	}
+	return paths
+}
+
+//! ファイルを登録していない対応表を作る。単独のページを変換する場合に、リンク先に命名ポリシーだけを適用するために使う。
+func NewPathMap(policy *NamingPolicy) *PathMap {
+	return &PathMap{outputs: map[string]string{}, folded: map[string]string{}, policy: policy}
+}
+
+//! 対応表に1件追加する。
+func (m *PathMap) add(srcRel, outRel string) {
+	m.outputs[srcRel] = outRel
+	if _, ok := m.folded[strings.ToLower(srcRel)]; !ok {
+		m.folded[strings.ToLower(srcRel)] = srcRel
+	}
+}
+
+//! 変換前の相対パスに対応する出力後の相対パスを返す。
+//! Windowsで作られたHTMLのリンクは大文字小文字が実ファイルと異なることがあるため、完全一致しない場合は大文字小文字を無視して探す。
+func (m *PathMap) Lookup(srcRel string) (string, bool) {
+	if out, ok := m.outputs[srcRel]; ok {
+		return out, true
+	}
+	if actual, ok := m.folded[strings.ToLower(srcRel)]; ok {
+		return m.outputs[actual], true
+	}
+	return "", false
+}
+
+//! 変換前の相対パスから出力後の相対パスを生成する。HTMLファイルは変換後の.mdファイルのパスになる。
+func OutputPath(relPath string, policy *NamingPolicy) string {
+	dir, name := path.Split(relPath)
+	if strings.HasSuffix(strings.ToLower(name), ".html") {
+		name = MarkdownFileName(name)
+	}
+	return policy.Path(path.Join(dir, name), false)
+}
+
+//! HTML内のリンク(a[href])と画像(img[src])を出力後のファイルへの相対リンクに書き換える。
+//! リンク先はパーセントデコードしてから実在ファイルと照合し、出力時に改めてパーセントエンコードする。
+//! pageRelは変換中のページの変換前の相対パス。書き換えたリンクを文書順に返す。
+func ConvertHtmlLinksToMd(doc *goquery.Document, pageRel string, paths *PathMap) []*Link {
+	pageOut, ok := paths.Lookup(pageRel)
+	if !ok {
+		pageOut = OutputPath(pageRel, paths.policy)
+	}
+
+	var links []*Link
+	doc.Find("a[href], img[src]").Each(func(_ int, s *goquery.Selection) {
+		attr := "href"
+		if goquery.NodeName(s) == "img" {
+			attr = "src"
+		}
+		value, _ := s.Attr(attr)
+		target, kind, srcRel := rewriteLinkTarget(value, pageRel, pageOut, paths)
+		s.SetAttr(attr, target)
+		links = append(links, &Link{Attr: attr, Original: value, Target: target, Kind: kind, Source: srcRel})
+	})
+	return links
+}
+
+//! 1つのリンク先を書き換え、書き換え後のリンク先、リンクの種類、リンク先の変換前の相対パスを返す。
+//! URLやページ内アンカーはそのまま返し、変換前の相対パスは空にする。
+func rewriteLinkTarget(raw, pageRel, pageOut string, paths *PathMap) (string, string, string) {
+	target := strings.TrimSpace(raw)
+	if target == "" || strings.HasPrefix(target, "#") {
+		return raw, LinkAnchor, ""
+	}
+	if strings.HasPrefix(target, "//") {
+		return raw, LinkExternal, ""
+	}
+	if u, err := url.Parse(target); err == nil && u.Scheme != "" {
+		return raw, LinkExternal, "" // スキーム付きのURLは外部サイトへのリンクのため変換しない。
+	}
+
+	// アンカーとクエリを分離する。
+	target, fragment, hasFragment := strings.Cut(target, "#")
+	target, query, hasQuery := strings.Cut(target, "?")
+	if target == "" {
+		return raw, LinkAnchor, ""
+	}
+
+	// パーセントエンコードされたリンク先(My%20Page.html等)をデコードし、パス区切り文字を統一 (Windows環境での%5C問題を回避)。
+	if decoded, err := url.PathUnescape(target); err == nil {
+		target = decoded
+	}
+	target = strings.ReplaceAll(target, "\\", "/")
+
+	// ページからの相対パス、またはルートからのパスとして変換前の相対パスを求め、実在ファイルと照合する。
+	var srcRel string
+	if strings.HasPrefix(target, "/") {
+		srcRel = path.Clean(strings.TrimPrefix(target, "/"))
+	} else {
+		srcRel = path.Join(path.Dir(pageRel), target)
+	}
+
+	var link string
+	kind := LinkInternal
+	if out, ok := paths.Lookup(srcRel); ok {
+		link = relativeLink(path.Dir(pageOut), out)
+	} else {
+		// 実在しないリンク先は、リンクの形を保ったまま命名ポリシーだけを適用する。
+		link = OutputPath(target, paths.policy)
+		kind = LinkLocal
+		if paths.checked {
+			kind = LinkMissing
+		}
+	}
+
+	link = EncodeLinkTarget(link)
+	if hasQuery {
+		link += "?" + query
+	}
+	if hasFragment {
+		link += "#" + fragment
+	}
+	return link, kind, srcRel
+}
+
+//! fromDirからtoへの相対パスを生成する。どちらも出力ディレクトリからのスラッシュ区切りの相対パス。
+func relativeLink(fromDir, to string) string {
+	if fromDir == "." || fromDir == "" {
+		return to
+	}
+	from := strings.Split(fromDir, "/")
+	dest := strings.Split(to, "/")
+
+	common := 0
+	for common < len(from) && common < len(dest)-1 && from[common] == dest[common] {
+		common++
+	}
+	parts := make([]string, 0, len(from)-common+len(dest)-common)
+	for range from[common:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, dest[common:]...)
+	return strings.Join(parts, "/")
+}
+
+//! Markdownページ内のリンク先として、パスの各階層をパーセントエンコードする。
+//! 空白や括弧、#、%、非ASCII文字を含むパスもmdbookで解決できるようにする。
+func EncodeLinkTarget(linkPath string) string {
+	parts := strings.Split(linkPath, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	encoded := strings.Join(parts, "/")
+
+	// 先頭の階層に:が含まれるとスキームと解釈されるため、./を付ける。
+	if first, _, _ := strings.Cut(encoded, "/"); strings.Contains(first, ":") {
+		encoded = "./" + encoded
+	}
+	return encoded
+}
+
+//! SUMMARY.md用のリンク先を生成する。mdbookはSUMMARY.mdのリンク先をファイルパスとして扱うため、
+//! パーセントエンコードはせず、必要な場合は<>で囲む。
+func SummaryLinkTarget(linkPath string) string {
+	if !strings.ContainsAny(linkPath, " ()<>#%?\t") {
+		return linkPath
+	}
+	escaped := strings.NewReplacer("<", `\<`, ">", `\>`).Replace(linkPath)
+	return "<" + escaped + ">"
+}
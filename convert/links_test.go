@@ -0,0 +1,101 @@
+package convert
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func TestConvertHtmlLinksToMd(t *testing.T) {
+	files := []string{"index.html", "guide/My Page.html", "guide/Setup.html", "img/Logo.png", "Old.html", "old.html"}
+	policy, _ := ParseNamingPolicy("lower")
+	plan := AnalyzeCollisions(files, policy, "_", true)
+	if err := ResolveCollisions(plan, CollisionSuffix, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	paths := BuildPathMap(files, plan, policy)
+
+	tests := []struct {
+		page       string
+		href       string
+		wantTarget string
+		wantKind   string
+		wantSource string
+	}{
+		{"index.html", "guide/My%20Page.html", "guide/my%20page.md", LinkInternal, "guide/My Page.html"},
+		{"index.html", "guide/setup.html#install", "guide/setup.md#install", LinkInternal, "guide/setup.html"},
+		{"index.html", "guide\\Setup.html?x=1", "guide/setup.md?x=1", LinkInternal, "guide/Setup.html"},
+		{"guide/Setup.html", "../index.html", "../index.md", LinkInternal, "index.html"},
+		{"guide/Setup.html", "/img/Logo.png", "../img/logo.png", LinkInternal, "img/Logo.png"},
+		{"guide/Setup.html", "My Page.html", "my%20page.md", LinkInternal, "guide/My Page.html"},
+		{"index.html", "old.html", "old-2.md", LinkInternal, "old.html"},
+		{"index.html", "Missing.html", "missing.md", LinkMissing, "Missing.html"},
+		{"index.html", "#top", "#top", LinkAnchor, ""},
+		{"index.html", "https://example.com/a.html", "https://example.com/a.html", LinkExternal, ""},
+		{"index.html", "//example.com/a.html", "//example.com/a.html", LinkExternal, ""},
+		{"index.html", "mailto:a@example.com", "mailto:a@example.com", LinkExternal, ""},
+	}
+	for _, tt := range tests {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<a href="` + tt.href + `">x</a>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		links := ConvertHtmlLinksToMd(doc, tt.page, paths)
+		if len(links) != 1 {
+			t.Fatalf("%s: %q: %d links", tt.page, tt.href, len(links))
+		}
+		link := links[0]
+		if link.Target != tt.wantTarget || link.Kind != tt.wantKind || link.Source != tt.wantSource {
+			t.Errorf("%s: %q → (%q, %s, %q), want (%q, %s, %q)", tt.page, tt.href,
+				link.Target, link.Kind, link.Source, tt.wantTarget, tt.wantKind, tt.wantSource)
+		}
+		if href, _ := doc.Find("a").Attr("href"); href != tt.wantTarget {
+			t.Errorf("%s: %q: href = %q, want %q", tt.page, tt.href, href, tt.wantTarget)
+		}
+	}
+}
+
+//! ファイルを登録していない対応表では、リンク先の実在を確認できないためmissingにしない。
+func TestConvertHtmlLinksToMdUnchecked(t *testing.T) {
+	policy, _ := ParseNamingPolicy("lower")
+	doc, _ := goquery.NewDocumentFromReader(strings.NewReader(`<img src="Images/A.PNG"><a href="Next.html">x</a>`))
+	links := ConvertHtmlLinksToMd(doc, "docs/page.html", NewPathMap(policy))
+	for i, want := range []string{"images/a.png", "next.md"} {
+		if links[i].Target != want || links[i].Kind != LinkLocal {
+			t.Errorf("link %d = (%q, %s), want (%q, %s)", i, links[i].Target, links[i].Kind, want, LinkLocal)
+		}
+	}
+}
+
+func TestRelativeLink(t *testing.T) {
+	tests := []struct {
+		from, to, want string
+	}{
+		{".", "a.md", "a.md"},
+		{"a", "a/b.md", "b.md"},
+		{"a/b", "c/d.md", "../../c/d.md"},
+		{"a/b", "a/c.md", "../c.md"},
+		{"a", "a.md", "../a.md"},
+	}
+	for _, tt := range tests {
+		if got := relativeLink(tt.from, tt.to); got != tt.want {
+			t.Errorf("relativeLink(%q, %q) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestSummaryLinkTarget(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"guide/intro.md", "guide/intro.md"},
+		{"guide/my page.md", "<guide/my page.md>"},
+		{"a<b>.md", `<a\<b\>.md>`},
+	}
+	for _, tt := range tests {
+		if got := SummaryLinkTarget(tt.path); got != tt.want {
+			t.Errorf("SummaryLinkTarget(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package convert
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// 出力エントリの種類。
+const (
+	EntryDir     = "dir"     // ディレクトリ。
+	EntryCopy    = "copy"    // そのままコピーするファイル。
+	EntryConvert = "convert" // Markdownに変換するHTMLファイル。
+)
+
+//! 入力ディレクトリ内の1エントリと、その出力先を表す構造体。
+type ManifestEntry struct {
+	Kind      string            `json:"kind"`                 // EntryDir, EntryCopy, EntryConvertのいずれか。
+	Source    string            `json:"source"`               // 入力ディレクトリからの相対パス(スラッシュ区切り)。
+	Output    string            `json:"output"`               // 出力ディレクトリからの相対パス(スラッシュ区切り)。
+	Original  string            `json:"original,omitempty"`   // 元のHTMLファイルの保存先。通常は出力ディレクトリから、--direct時は--originals-dirからの相対パス。空の場合は保存しない。
+	Title     string            `json:"title,omitempty"`      // SUMMARY.mdに載せるタイトル。.mdファイル以外は空。
+	Hash      string            `json:"sha256,omitempty"`     // 入力ファイルの内容のSHA-256。出力時に計算する。
+	RulesHash string            `json:"rules_hash,omitempty"` // ページに適用する設定ファイルの規則のハッシュ。変換するページだけ、出力時に計算する。
+	Links     map[string]string `json:"links,omitempty"`      // ページ内のリンク先の変換前の相対パス → 解決した出力の相対パス(実在しない場合は空)。変換時に記録する。
+	Warnings  []string          `json:"warnings,omitempty"`   // 変換時の警告。変換を省略した場合も報告するために記録する。
+	Rewrites  map[string]int    `json:"rewrites,omitempty"`   // 書き換え規則の名前 → 書き換えた要素の数。変換を省略した場合も集計するために記録する。
+	Replaces  map[string]int    `json:"replaces,omitempty"`   // 置換規則の名前 → 置換した箇所の数。変換を省略した場合も集計するために記録する。
+	ModTime   time.Time         `json:"-"`                    // 入力ファイルの更新日時。
+}
+
+//! 入力ディレクトリを1回だけ走査して作る、入力と出力のパスの対応表。
+//! コピー・変換・目次生成はすべてこの対応表をもとに行い、出力後のリネームは行わない。
+type Manifest struct {
+	Entries []*ManifestEntry // 走査順(ディレクトリは配下のエントリより先)。衝突解決で破棄したファイルは含まない。
+	Plan    *CollisionPlan   // 衝突の解決内容。
+	Paths   *PathMap         // リンク先の解決に使う対応表。
+}
+
+//! 入力を走査し、命名ポリシーと衝突解決を反映したManifestを作る。ディスクには書き込まない。
+//! ctxがキャンセルされた場合は走査を中断する。
+func ScanInput(ctx context.Context, src fs.FS, policy *NamingPolicy, opts *Options) (*Manifest, error) {
+	type scanned struct {
+		rel  string
+		info fs.FileInfo
+	}
+	var walked []scanned
+	var files []string
+	modTimes := map[string]time.Time{}
+
+	err := fs.WalkDir(src, ".", func(relPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		walked = append(walked, scanned{relPath, info})
+		if !info.IsDir() {
+			files = append(files, relPath)
+			modTimes[relPath] = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Errorf("入力ディレクトリの走査に失敗: %v", err)
+	}
+
+	// 命名ポリシーの適用で衝突するパスを事前に解析し、指定された方式で解決する。
+	opts.logf("パス衝突の解析を開始します...")
+	plan := AnalyzeCollisions(files, policy, opts.RenamePrefix, !opts.Direct)
+	ReportCollisions(plan, opts.Logger)
+	if err := ResolveCollisions(plan, opts.Collision, modTimes, opts.Logger); err != nil {
+		return nil, errors.Errorf("パス衝突の解決に失敗: %v", err)
+	}
+
+	manifest := &Manifest{Plan: plan, Paths: BuildPathMap(files, plan, policy)}
+	for _, s := range walked {
+		if s.info.IsDir() {
+			manifest.Entries = append(manifest.Entries, &ManifestEntry{
+				Kind:    EntryDir,
+				Source:  s.rel,
+				Output:  policy.Path(s.rel, true),
+				ModTime: s.info.ModTime(),
+			})
+			continue
+		}
+		if plan.IsRemoved(s.rel) {
+			opts.logf("衝突解決により破棄: %s", s.rel)
+			continue
+		}
+
+		resolved := plan.Resolve(s.rel)
+		entry := &ManifestEntry{
+			Kind:    EntryCopy,
+			Source:  s.rel,
+			Output:  OutputPath(resolved, policy),
+			ModTime: s.info.ModTime(),
+		}
+		if strings.HasSuffix(strings.ToLower(entry.Output), ".md") {
+			entry.Title = PageTitle(entry.Output)
+		}
+		if strings.HasSuffix(strings.ToLower(s.rel), ".html") {
+			entry.Kind = EntryConvert
+			if !opts.Direct {
+				// 元のHTMLファイルはプレフィックスを付けて変換後のファイルと同じディレクトリに残す。
+				entry.Original = path.Join(policy.Path(path.Dir(resolved), true), opts.RenamePrefix+policy.Name(path.Base(resolved), false))
+			} else if opts.OriginalsDir != "" {
+				entry.Original = s.rel
+			}
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+	return manifest, nil
+}
+
+//! 指定した入力のファイルのうち、出力が存在しないものをエントリから除く。目次から存在しないページへリンクしないため。
+func (m *Manifest) DropMissingOutputs(sources []string, out fs.FS) {
+	dropped := map[string]bool{}
+	for _, source := range sources {
+		dropped[source] = true
+	}
+	entries := m.Entries[:0]
+	for _, entry := range m.Entries {
+		if dropped[entry.Source] {
+			if _, err := fs.Stat(out, entry.Output); err != nil {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	m.Entries = entries
+}
+
+//! 衝突解決による名前の変更と破棄を、入力の相対パス順の警告として返す。
+func (m *Manifest) Warnings() []*Warning {
+	sources := make([]string, 0, len(m.Plan.Renames))
+	for source := range m.Plan.Renames {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	warnings := []*Warning{}
+	for _, source := range sources {
+		if m.Plan.IsRemoved(source) {
+			warnings = append(warnings, &Warning{Source: source, Message: "衝突解決により破棄しました (残したファイル: " + m.Plan.Renames[source] + ")"})
+		} else {
+			warnings = append(warnings, &Warning{Source: source, Message: "衝突解決により名前を変更しました: " + m.Plan.Renames[source]})
+		}
+	}
+	return warnings
+}
+
+//! ディレクトリ以外のエントリを返す。
+func (m *Manifest) Files() []*ManifestEntry {
+	var files []*ManifestEntry
+	for _, entry := range m.Entries {
+		if entry.Kind != EntryDir {
+			files = append(files, entry)
+		}
+	}
+	return files
+}
+
+//! 出力先の相対パスが指定した名前のエントリがあるかどうかを返す。
+func (m *Manifest) HasOutput(outRel string) bool {
+	for _, entry := range m.Entries {
+		if entry.Output == outRel {
+			return true
+		}
+	}
+	return false
+}
+
+//! 変換したページのリンク先と警告をエントリに記録する。次回のsyncで、リンク先の変化の検出と警告の報告に使う。
+//! 警告には、実在しないリンク先と、プラグインとスクリプトが返した警告を含める。
+func (e *ManifestEntry) RecordPage(page *Page, paths *PathMap) {
+	e.Links, e.Warnings, e.Rewrites, e.Replaces = nil, nil, page.Rewrites, page.Replaces
+	for _, link := range page.Links {
+		if link.Kind == LinkMissing {
+			e.Warnings = append(e.Warnings, "リンク先が見つかりません: "+link.Original)
+		}
+		if link.Source == "" {
+			continue
+		}
+		if e.Links == nil {
+			e.Links = map[string]string{}
+		}
+		e.Links[link.Source], _ = paths.Lookup(link.Source)
+	}
+	e.Warnings = append(e.Warnings, page.Warnings...)
+}
+
+//! 記録したリンク先が、今回の対応表でも同じ出力に解決されるかどうかを返す。リンク先のページの追加・削除・名前の変更を検出する。
+func linksUpToDate(links map[string]string, paths *PathMap) bool {
+	for srcRel, outRel := range links {
+		if current, _ := paths.Lookup(srcRel); current != outRel {
+			return false
+		}
+	}
+	return true
+}
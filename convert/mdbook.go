@@ -0,0 +1,221 @@
+package convert
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//! ディレクトリエントリを表す構造体。
+type DirEntry struct {
+	Name     string      // ファイル名またはディレクトリ名。
+	Path     string      // 相対パス。
+	IsDir    bool        // ディレクトリかどうか。
+	Children []*DirEntry // 子要素(ディレクトリの場合)。
+}
+
+//! mdbook用のbook.tomlとSUMMARY.mdを生成する。bookNameはタイトルに使う出力ディレクトリ名。
+func GenerateMdBookFiles(out OutputFS, bookName string, manifest *Manifest) error {
+	// book.tomlを生成。
+	if err := GenerateBookToml(out, bookName); err != nil {
+		return errors.Errorf("book.toml生成に失敗: %v", err)
+	}
+
+	// SUMMARY.mdを生成。
+	if err := GenerateSummaryMd(out, manifest); err != nil {
+		return errors.Errorf("SUMMARY.md生成に失敗: %v", err)
+	}
+
+	return nil
+}
+
+//! book.tomlファイルを生成する。
+func GenerateBookToml(out OutputFS, bookName string) error {
+	return WriteFile(out, "book.toml", []byte(RenderBookToml(bookName)))
+}
+
+//! book.tomlの内容を生成する。
+func RenderBookToml(bookName string) string {
+	// 出力ディレクトリ名からタイトルを生成。
+	baseDirName := bookName
+	// アンダースコアをスペースに置換してタイトル化。
+	title := strings.ReplaceAll(baseDirName, "_", " ")
+	title = strings.ReplaceAll(title, "-", " ")
+	
+	// book.tomlの内容を動的生成。
+	bookTomlContent := fmt.Sprintf(`[book]
+title = "%s"
+description = "%s"
+authors = ["Generated by html2md"]
+src = "%s"
+
+[build]
+build-dir = "book"
+create-missing = false
+
+[output.html]
+default-theme = "navy"
+preferred-dark-theme = "navy"
+`, title, title, baseDirName)
+	return bookTomlContent
+}
+
+//! SUMMARY.mdファイルを生成する。
+func GenerateSummaryMd(out OutputFS, manifest *Manifest) error {
+	return WriteFile(out, "SUMMARY.md", []byte(RenderSummaryMd(manifest)))
+}
+
+//! SUMMARY.mdの内容を生成する。目次はディスクを走査せずManifestの出力パスから作る。
+func RenderSummaryMd(manifest *Manifest) string {
+	// ディレクトリ構造を構築。
+	rootEntry := BuildDirectoryTree(manifest)
+
+	// SUMMARY.mdの内容を生成。
+	var summaryBuilder strings.Builder
+	summaryBuilder.WriteString("# Summary\n\n")
+	
+	// ルートレベルのindex.htmlまたはREADME.mdがあれば導入として追加。
+	if hasIntroFile(manifest) {
+		summaryBuilder.WriteString("- [Introduction](README.md)\n\n")
+	}
+
+	// 階層構造を再帰的に出力。
+	writeSummaryEntries(&summaryBuilder, rootEntry.Children, 0)
+	return summaryBuilder.String()
+}
+
+//! Manifestの出力パスからディレクトリツリーを構築する。対象はディレクトリと.mdファイル。
+func BuildDirectoryTree(manifest *Manifest) *DirEntry {
+	root := &DirEntry{
+		Name:     "",
+		Path:     "",
+		IsDir:    true,
+		Children: []*DirEntry{},
+	}
+	dirs := map[string]*DirEntry{".": root}
+
+	// 出力パスに対応するディレクトリエントリを、親ディレクトリから順に作成して返す。
+	var ensureDir func(outRel string) *DirEntry
+	ensureDir = func(outRel string) *DirEntry {
+		if dir, ok := dirs[outRel]; ok {
+			return dir
+		}
+		parent := ensureDir(path.Dir(outRel))
+		dir := &DirEntry{
+			Name:     path.Base(outRel),
+			Path:     outRel,
+			IsDir:    true,
+			Children: []*DirEntry{},
+		}
+		parent.Children = append(parent.Children, dir)
+		dirs[outRel] = dir
+		return dir
+	}
+
+	for _, entry := range manifest.Entries {
+		// 隠しファイルと隠しディレクトリ配下、生成物のbook.toml、SUMMARY.mdはスキップ。
+		if isHiddenPath(entry.Output) || entry.Output == "book.toml" || entry.Output == "SUMMARY.md" {
+			continue
+		}
+		if entry.Kind == EntryDir {
+			ensureDir(entry.Output)
+			continue
+		}
+		// .mdファイルのみを対象とする。
+		if !strings.HasSuffix(strings.ToLower(entry.Output), ".md") {
+			continue
+		}
+		parent := ensureDir(path.Dir(entry.Output))
+		parent.Children = append(parent.Children, &DirEntry{
+			Name:     path.Base(entry.Output),
+			Path:     entry.Output,
+			IsDir:    false,
+			Children: []*DirEntry{},
+		})
+	}
+
+	// 各ディレクトリの子要素をソート。
+	sortDirectoryTree(root)
+	return root
+}
+
+//! スラッシュ区切りの相対パスのいずれかの階層が隠しファイル・隠しディレクトリかどうかを返す。
+func isHiddenPath(relPath string) bool {
+	for _, part := range strings.Split(relPath, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+//! ディレクトリツリーをソートする。
+func sortDirectoryTree(entry *DirEntry) {
+	if !entry.IsDir {
+		return
+	}
+
+	// 子要素をソート(ディレクトリ優先、その後アルファベット順)。
+	for i := 0; i < len(entry.Children); i++ {
+		for j := i + 1; j < len(entry.Children); j++ {
+			a, b := entry.Children[i], entry.Children[j]
+			
+			// ディレクトリを優先。
+			if a.IsDir && !b.IsDir {
+				continue
+			}
+			if !a.IsDir && b.IsDir {
+				entry.Children[i], entry.Children[j] = b, a
+				continue
+			}
+			
+			// 同じ種類の場合はアルファベット順。
+			if a.Name > b.Name {
+				entry.Children[i], entry.Children[j] = b, a
+			}
+		}
+	}
+
+	// 再帰的にソート。
+	for _, child := range entry.Children {
+		sortDirectoryTree(child)
+	}
+}
+
+//! SUMMARY.mdのエントリを書き出す。
+func writeSummaryEntries(builder *strings.Builder, entries []*DirEntry, depth int) {
+	indent := strings.Repeat("  ", depth)
+
+	for _, entry := range entries {
+		if entry.IsDir {
+			// ディレクトリの場合（リンクなし）。
+			builder.WriteString(fmt.Sprintf("%s  %s\n", indent, entry.Name))
+			writeSummaryEntries(builder, entry.Children, depth+1)
+		} else {
+			// ファイルの場合(.mdファイルのみを対象)。
+			if strings.HasSuffix(strings.ToLower(entry.Name), ".md") {
+				// リンクテキストの[]をエスケープ。
+				displayName := strings.NewReplacer("[", `\[`, "]", `\]`).Replace(PageTitle(entry.Path))
+				builder.WriteString(fmt.Sprintf("%s- [%s](%s)\n", indent, displayName, SummaryLinkTarget(entry.Path)))
+			}
+		}
+	}
+}
+
+//! 出力先の.mdファイルのパスからSUMMARY.mdに載せるタイトルを返す。
+func PageTitle(outRel string) string {
+	return strings.TrimSuffix(path.Base(outRel), ".md")
+}
+
+//! 導入ファイルの存在確認。
+func hasIntroFile(manifest *Manifest) bool {
+	introFiles := []string{"index.html", "README.md", "readme.md"}
+	for _, file := range introFiles {
+		if manifest.HasOutput(file) {
+			return true
+		}
+	}
+	return false
+}
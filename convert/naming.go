@@ -0,0 +1,151 @@
+package convert
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/rainycape/unidecode"
+	"golang.org/x/text/unicode/norm"
+)
+
+// 命名ポリシーの手順。
+const (
+	NamingKeep     = "keep"     // 名前を変更しない。
+	NamingLower    = "lower"    // 小文字に変換する。
+	NamingSlug     = "slug"     // 小文字のケバブケースに変換する。
+	NamingTranslit = "translit" // 日本語やアクセント付き文字をASCIIに音訳する。
+	NamingNFC      = "nfc"      // Unicode正規化形式NFCに変換する。
+)
+
+// Windowsで予約されているデバイス名。
+var windowsReservedNames = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9]|lpt[0-9])$`)
+
+//! ファイル名・ディレクトリ名の命名ポリシー。Stepsを順に適用した後、Windowsで使えない名前をエスケープする。
+type NamingPolicy struct {
+	Steps []string
+}
+
+//! カンマ区切りの手順指定(例: "nfc,translit,slug")から命名ポリシーを生成する。
+func ParseNamingPolicy(spec string) (*NamingPolicy, error) {
+	policy := &NamingPolicy{}
+	for _, step := range strings.Split(spec, ",") {
+		step = strings.ToLower(strings.TrimSpace(step))
+		switch step {
+		case NamingKeep, "":
+			// 何もしない。
+		case NamingLower, NamingSlug, NamingTranslit, NamingNFC:
+			policy.Steps = append(policy.Steps, step)
+		default:
+			return nil, errors.Errorf("不明な命名ポリシーです: %s (keep, lower, slug, translit, nfcを組み合わせて指定してください)", step)
+		}
+	}
+	return policy, nil
+}
+
+//! 1階層分の名前にポリシーを適用する。ファイルの場合は拡張子を保ったまま本体部分を変換する。
+func (p *NamingPolicy) Name(name string, isDir bool) string {
+	if name == "" || name == "." || name == ".." {
+		return name
+	}
+
+	stem, ext := name, ""
+	if !isDir {
+		ext = path.Ext(name)
+		stem = strings.TrimSuffix(name, ext)
+		if stem == "" {
+			// .gitignoreのような名前は全体を本体として扱う。
+			stem, ext = name, ""
+		}
+	}
+
+	// 隠しファイルの先頭のドットは変換対象に含めない。
+	hidden := ""
+	if strings.HasPrefix(stem, ".") {
+		hidden, stem = ".", stem[1:]
+	}
+
+	for _, step := range p.Steps {
+		switch step {
+		case NamingLower:
+			stem = strings.ToLower(stem)
+			ext = strings.ToLower(ext)
+		case NamingSlug:
+			stem = slugify(stem)
+			ext = strings.ToLower(ext)
+		case NamingTranslit:
+			stem = transliterate(stem)
+			ext = transliterate(ext)
+		case NamingNFC:
+			stem = norm.NFC.String(stem)
+			ext = norm.NFC.String(ext)
+		}
+	}
+
+	return escapeWindowsName(hidden + stem + ext)
+}
+
+//! スラッシュ区切りの相対パスの各階層にポリシーを適用する。isDirは末尾の要素がディレクトリかどうか。
+func (p *NamingPolicy) Path(relPath string, isDir bool) string {
+	parts := strings.Split(strings.ReplaceAll(relPath, "\\", "/"), "/")
+	for i, part := range parts {
+		parts[i] = p.Name(part, isDir || i < len(parts)-1)
+	}
+	return strings.Join(parts, "/")
+}
+
+//! 小文字のケバブケースに変換する。文字と数字以外の連続は1つのハイフンにまとめる。
+func slugify(s string) string {
+	var b strings.Builder
+	pendingHyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) {
+			if pendingHyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			pendingHyphen = false
+			b.WriteRune(r)
+		} else {
+			pendingHyphen = true
+		}
+	}
+	if b.Len() == 0 {
+		return "untitled"
+	}
+	return b.String()
+}
+
+//! ASCII文字に音訳する。かなはローマ字、漢字は中国語読みのローマ字になる。
+func transliterate(s string) string {
+	s = unidecode.Unidecode(norm.NFC.String(s))
+	// 音訳で生じた前後の空白は除き、連続する空白は1つにまとめる。
+	return strings.Join(strings.Fields(s), " ")
+}
+
+//! Windowsで使えない文字や予約名、末尾のドットと空白をエスケープする。
+func escapeWindowsName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	// 末尾のドットと空白はWindowsで削除されるため置き換える。
+	trimmed := strings.TrimRight(name, ". ")
+	if trimmed != name {
+		name = trimmed + strings.Repeat("_", len(name)-len(trimmed))
+	}
+
+	// 予約名は拡張子の有無にかかわらず使えないため、最初のドットより前に_を付ける。
+	base, rest := name, ""
+	if i := strings.Index(name, "."); i >= 0 {
+		base, rest = name[:i], name[i:]
+	}
+	if windowsReservedNames.MatchString(base) {
+		name = base + "_" + rest
+	}
+	return name
+}
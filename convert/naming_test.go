@@ -0,0 +1,57 @@
+package convert
+
+import "testing"
+
+func TestNamingPolicyPath(t *testing.T) {
+	tests := []struct {
+		spec  string
+		path  string
+		isDir bool
+		want  string
+	}{
+		{"keep", "Docs/My Page.HTML", false, "Docs/My Page.HTML"},
+		{"lower", "Docs/My Page.HTML", false, "docs/my page.html"},
+		{"slug", "Docs/My Page (v2).html", false, "docs/my-page-v2.html"},
+		{"slug", "Release Notes", true, "release-notes"},
+		{"slug", "!!!.html", false, "untitled.html"},
+		{"translit,slug", "ガイド/Café.html", false, "gaido/cafe.html"},
+		{"lower", ".GitIgnore", false, ".gitignore"},
+		{"slug", ".Hidden File.md", false, ".hidden-file.md"},
+		{"keep", "a/con.html", false, "a/con_.html"},
+		{"keep", "a/what?.html", false, "a/what_.html"},
+		{"keep", "trailing. ", true, "trailing__"},
+	}
+	for _, tt := range tests {
+		policy, err := ParseNamingPolicy(tt.spec)
+		if err != nil {
+			t.Fatalf("ParseNamingPolicy(%q): %v", tt.spec, err)
+		}
+		if got := policy.Path(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("%s: Path(%q, %t) = %q, want %q", tt.spec, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestParseNamingPolicyUnknown(t *testing.T) {
+	if _, err := ParseNamingPolicy("lower,upper"); err == nil {
+		t.Error("ParseNamingPolicy(\"lower,upper\") returned no error")
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	policy, _ := ParseNamingPolicy("lower")
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"Guide/Intro.html", "guide/intro.md"},
+		{"README.md.html", "readme.md"},
+		{"img/Logo.PNG", "img/logo.png"},
+		{"notes.md", "notes.md"},
+	}
+	for _, tt := range tests {
+		if got := OutputPath(tt.path, policy); got != tt.want {
+			t.Errorf("OutputPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
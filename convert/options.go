@@ -0,0 +1,132 @@
+//! Package convert はHTMLのディレクトリをmdbook用のMarkdownに変換する。
+//! html2mdコマンドはこのパッケージの薄いラッパーで、他のGoプログラムからも同じ変換を呼び出せる。
+//! グローバルな状態は持たず、設定はすべてOptionsで渡す。
+package convert
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//! 変換のオプション。DefaultOptionsの値から必要な項目だけを変更して使う。
+type Options struct {
+	Mode         string        // 出力ディレクトリが既に存在する場合の動作 (ModeFailIfExists, ModeClean, ModeSync)。
+	RenamePrefix string        // 元のHTMLファイル名に付与するプレフィックス。
+	Direct       bool          // 入力ディレクトリをコピーせず、Markdownとアセットだけを出力する。
+	OriginalsDir string        // Direct時に元のHTMLファイルを保存するディレクトリ。空の場合は保存しない。
+	Jobs         int           // 並列に変換するファイル数。0以下の場合はCPU数。
+	Collision    string        // 命名ポリシーの適用で衝突するファイルの解決方法 (CollisionSuffix, CollisionNewest, CollisionFail)。
+	Naming       string        // 命名ポリシー。keep, lower, slug, translit, nfcをカンマ区切りで組み合わせる。
+	MaxFileSize  int64         // 変換するHTMLの最大バイト数。0の場合は制限しない。
+	MaxDepth     int           // 変換するHTMLのDOMの入れ子の最大の深さ。0の場合は制限しない。
+	Timeout      time.Duration // 1ファイルの変換にかける最大の時間。0の場合は制限しない。
+	LimitAction  string        // 制限に達したHTMLの扱い (LimitActionSkip, LimitActionRaw, LimitActionText)。
+	FailFast     bool          // いずれかのファイルの処理に失敗した時点で変換を中止する。
+	Resume       bool          // 中断された変換を、出力済みのファイルを省略して続きから再開する。
+	Version      string        // 変換処理のバージョン。変わった場合は前回の変換内容を使わずに全ファイルを変換する。
+	BookName     string        // book.tomlのタイトル。空の場合は出力ディレクトリ名。
+	Rules        []Rule        // 変換規則。BuiltinRulesの後に適用し、同じ名前の組み込みの規則は置き換える。
+	Rewrites     []Rewrite     // 変換前のDOMの書き換え規則。指定した順に適用する。
+	Plugins      []Plugin      // 外部コマンドによる変換のプラグイン。段階ごとに指定した順に呼び出す。
+	Scripts      []Script      // JavaScriptによる変換のフック。指定した順に呼び出す。
+	Replaces     []Replace     // 変換後のMarkdownの置換規則。変換の最後に指定した順に適用する。
+	ChangedPaths []string      // sync時に、前回の変換から変わった入力の相対パス(ディレクトリの場合は配下のすべて)。それ以外のファイルは読み込まずに前回の記録を使う。nilの場合は全ファイルのハッシュを計算する。
+	Logger       *log.Logger   // 進行状況の出力先。nilの場合は出力しない。
+}
+
+//! html2mdコマンドのデフォルトと同じオプションを返す。
+func DefaultOptions() Options {
+	return Options{
+		Mode:         ModeFailIfExists,
+		RenamePrefix: "_",
+		Collision:    CollisionSuffix,
+		Naming:       NamingLower,
+		LimitAction:  LimitActionRaw,
+	}
+}
+
+//! オプションの値を検証する。
+func (o *Options) Validate() error {
+	if err := ValidateOutputMode(o.Mode); err != nil {
+		return err
+	}
+	if err := ValidateCollisionStrategy(o.Collision); err != nil {
+		return err
+	}
+	if err := ValidateLimitAction(o.LimitAction); err != nil {
+		return err
+	}
+	if _, err := ParseNamingPolicy(o.Naming); err != nil {
+		return err
+	}
+	if o.OriginalsDir != "" && !o.Direct {
+		return errors.Errorf("OriginalsDir は Direct と組み合わせて指定してください")
+	}
+	for _, rule := range o.Rules {
+		if err := validateRule(rule); err != nil {
+			return err
+		}
+	}
+	for _, rw := range o.Rewrites {
+		if err := validateRewrite(rw); err != nil {
+			return err
+		}
+	}
+	for _, p := range o.Plugins {
+		if err := validatePlugin(p); err != nil {
+			return err
+		}
+	}
+	for _, s := range o.Scripts {
+		if err := validateScript(s); err != nil {
+			return err
+		}
+	}
+	for _, r := range o.Replaces {
+		if err := validateReplace(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//! 入力・出力・元のHTMLファイルの保存先が入れ子になっていないことを確認する。
+func (o *Options) validateDirs(inputDir, outputDir string) error {
+	if err := ValidateOutputDir(inputDir, outputDir); err != nil {
+		return err
+	}
+	if o.OriginalsDir != "" {
+		if err := ValidateOutputDir(inputDir, o.OriginalsDir); err != nil {
+			return err
+		}
+		if err := ValidateOutputDir(outputDir, o.OriginalsDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//! 元のHTMLファイルの保存先の基準ディレクトリを返す。通常は変換後のファイルと同じ出力ディレクトリに残す。
+func (o *Options) originalsDir(buildDir string) string {
+	if o.Direct {
+		return o.OriginalsDir
+	}
+	return buildDir
+}
+
+//! Loggerがあれば進行状況を出力する。ログの呼び出し元には、このメソッドの呼び出し元を記録する。
+func (o *Options) logf(format string, v ...any) {
+	if o.Logger != nil {
+		o.Logger.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+//! loggerがnilでなければ出力する。
+func logf(logger *log.Logger, format string, v ...any) {
+	if logger != nil {
+		logger.Output(2, fmt.Sprintf(format, v...))
+	}
+}
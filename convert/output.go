@@ -0,0 +1,327 @@
+package convert
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 出力ディレクトリが既に存在する場合の動作。
+const (
+	ModeFailIfExists = "fail-if-exists" // エラーとして終了する。
+	ModeClean        = "clean"          // 既存の出力を削除してから作り直す。
+	ModeSync         = "sync"           // 入力と同じ内容になるよう差分だけを反映し、入力から消えたページの出力を削除する。
+)
+
+// sync時に今回の出力になくても残す、出力ディレクトリ直下のエントリ。
+// bookはbook.tomlのbuild-dirで、mdbook buildの生成物。
+var syncPreservedEntries = []string{"book"}
+
+//! 出力ディレクトリの扱いの値を検証する。
+func ValidateOutputMode(mode string) error {
+	switch mode {
+	case ModeFailIfExists, ModeClean, ModeSync:
+		return nil
+	}
+	return errors.Errorf("不明な出力モードです: %s (fail-if-exists, clean, syncのいずれかを指定してください)", mode)
+}
+
+//! 出力ディレクトリを決定する。指定がなければ入力ディレクトリの親ディレクトリ直下に「入力ディレクトリ名+サフィックス」で作る。
+func ResolveOutputDir(inputDir, output, suffix string) string {
+	if output != "" {
+		return filepath.Clean(output)
+	}
+	// 入力パスの親ディレクトリと基底名を分離。
+	inputDir = filepath.Clean(inputDir)
+	return filepath.Join(filepath.Dir(inputDir), filepath.Base(inputDir)+suffix)
+}
+
+//! 入力と出力が入れ子になっていないことを確認する。
+//! 入れ子になっているとコピーが自身を再帰的に含んだり、出力の削除で入力が消えたりするため。
+func ValidateOutputDir(inputDir, outputDir string) error {
+	absInput, err := filepath.Abs(inputDir)
+	if err != nil {
+		return err
+	}
+	absOutput, err := filepath.Abs(outputDir)
+	if err != nil {
+		return err
+	}
+	if isSubPath(absInput, absOutput) || isSubPath(absOutput, absInput) {
+		return errors.Errorf("入力ディレクトリと出力ディレクトリを入れ子にすることはできません: %s, %s", inputDir, outputDir)
+	}
+	return nil
+}
+
+//! childがparent自身またはその配下かどうかを返す。
+func isSubPath(parent, child string) bool {
+	rel, err := filepath.Rel(parent, child)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// 変換結果は出力ディレクトリの隣の作業用ディレクトリに書き込み、成功した場合だけ出力ディレクトリと入れ替える。
+// 名前は固定のため、中断された実行の残骸を次回の実行で検出できる。
+const (
+	stagingSuffix    = ".html2md-staging" // 変換結果を書き込む作業用ディレクトリ。
+	backupSuffix     = ".html2md-old"     // 入れ替え中に前回の出力を退避するディレクトリ。
+	tempRenameSuffix = "_temp_rename"     // 以前のバージョンがディレクトリ名の変更に使っていた一時的な名前。
+)
+
+//! 出力ディレクトリに対応する作業用ディレクトリのパスを返す。
+func StagingDir(outputDir string) string {
+	return filepath.Join(filepath.Dir(outputDir), "."+filepath.Base(outputDir)+stagingSuffix)
+}
+
+//! 出力ディレクトリに対応する退避用ディレクトリのパスを返す。
+func backupDir(outputDir string) string {
+	return filepath.Join(filepath.Dir(outputDir), "."+filepath.Base(outputDir)+backupSuffix)
+}
+
+//! 中断された実行の残骸を検出して後始末する。
+//! 入れ替えの途中で中断された場合は前回の出力を元に戻し、作業用ディレクトリと、以前のバージョンが残した一時ディレクトリを削除する。
+//! keepStagingがtrueの場合は、続きから再開するため作業用ディレクトリを残す。
+func RecoverInterruptedRun(outputDir string, keepStaging bool, logger *log.Logger) error {
+	backup := backupDir(outputDir)
+	if _, err := os.Stat(backup); err == nil {
+		if _, err := os.Stat(outputDir); os.IsNotExist(err) {
+			// 前回の出力を退避した後、作業用ディレクトリを出力ディレクトリにする前に中断された。
+			logf(logger, "中断された実行を検出したため、前回の出力を元に戻します: %s", outputDir)
+			if err := os.Rename(backup, outputDir); err != nil {
+				return errors.Errorf("前回の出力の復元に失敗: %v", err)
+			}
+		} else {
+			// 入れ替えは完了しており、退避した前回の出力の削除前に中断された。
+			logf(logger, "中断された実行の退避ディレクトリを削除します: %s", backup)
+			if err := os.RemoveAll(backup); err != nil {
+				return errors.Errorf("退避ディレクトリの削除に失敗: %v", err)
+			}
+		}
+	}
+
+	staging := StagingDir(outputDir)
+	if _, err := os.Stat(staging); err == nil && !keepStaging {
+		logf(logger, "中断された実行の作業用ディレクトリを削除します: %s", staging)
+		if err := os.RemoveAll(staging); err != nil {
+			return errors.Errorf("作業用ディレクトリの削除に失敗: %v", err)
+		}
+	}
+
+	// 以前のバージョンのsyncが使っていた一時ディレクトリ。
+	stale, _ := filepath.Glob(filepath.Join(filepath.Dir(outputDir), "."+filepath.Base(outputDir)+".sync-*"))
+	for _, dir := range stale {
+		logf(logger, "中断された実行の一時ディレクトリを削除します: %s", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.Errorf("一時ディレクトリの削除に失敗: %v", err)
+		}
+	}
+
+	return recoverTempRenames(outputDir, logger)
+}
+
+//! 以前のバージョンがディレクトリ名の変更中に中断され、出力ディレクトリ内に残った「名前_temp_rename」ディレクトリを元の名前に戻す。
+//! 元の名前のディレクトリが既にある場合は内容を失わないよう、そのまま残して警告する。
+func recoverTempRenames(outputDir string, logger *log.Logger) error {
+	if _, err := os.Stat(outputDir); err != nil {
+		return nil
+	}
+	var stranded []string
+	err := filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != outputDir && strings.HasSuffix(info.Name(), tempRenameSuffix) {
+			stranded = append(stranded, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 深い階層から戻す。
+	sort.Sort(sort.Reverse(sort.StringSlice(stranded)))
+	for _, path := range stranded {
+		original := strings.TrimSuffix(path, tempRenameSuffix)
+		if _, err := os.Stat(original); err == nil {
+			logf(logger, "警告: 中断されたリネームの一時ディレクトリが残っていますが、元の名前のディレクトリが既にあるため残します: %s", path)
+			continue
+		}
+		logf(logger, "中断されたリネームの一時ディレクトリを元に戻します: %s → %s", path, original)
+		if err := os.Rename(path, original); err != nil {
+			return errors.Errorf("一時ディレクトリの復元に失敗: %v", err)
+		}
+	}
+	return nil
+}
+
+//! 出力ディレクトリの存在とモードに応じて、変換結果を書き込む作業用ディレクトリを用意する。
+//! seedがtrueの場合は、既存の出力ディレクトリの内容をハードリンクで作業用ディレクトリに複製する。
+//! resumeがtrueの場合は、中断された実行の作業用ディレクトリをそのまま使う。
+func PrepareStaging(outputDir, mode string, seed, resume bool) (string, error) {
+	_, statErr := os.Stat(outputDir)
+	exists := statErr == nil
+
+	switch mode {
+	case ModeFailIfExists:
+		if exists {
+			return "", errors.Errorf("出力ディレクトリが既に存在します: %s (--mode clean または --mode sync を指定してください)", outputDir)
+		}
+	case ModeClean, ModeSync:
+	default:
+		return "", ValidateOutputMode(mode)
+	}
+
+	// 同じファイルシステム上で入れ替えられるよう、出力ディレクトリの隣に作る。
+	staging := StagingDir(outputDir)
+	if resume {
+		return staging, nil
+	}
+	if err := os.RemoveAll(staging); err != nil {
+		return "", errors.Errorf("作業用ディレクトリの削除に失敗: %v", err)
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return "", errors.Errorf("作業用ディレクトリの作成に失敗: %v", err)
+	}
+	if seed && exists {
+		if err := LinkTree(outputDir, staging, nil); err != nil {
+			os.RemoveAll(staging)
+			return "", errors.Errorf("作業用ディレクトリへの複製に失敗: %v", err)
+		}
+	}
+	return staging, nil
+}
+
+//! srcDirの内容をdstDirにハードリンクで複製する。ハードリンクを作れない場合はコピーする。
+//! filterがnilでない場合は、filterがtrueを返すsrcDirからの相対パスだけを複製する。
+//! filterがfalseを返すディレクトリも、配下にtrueを返すエントリがあれば必要な親ディレクトリだけを作る。
+func LinkTree(srcDir, dstDir string, filter func(relPath string) bool) error {
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if relPath != "." && filter != nil && !filter(relPath) {
+			return nil
+		}
+		dstPath := filepath.Join(dstDir, relPath)
+		if info.IsDir() {
+			return os.MkdirAll(dstPath, 0755)
+		}
+		if _, err := os.Lstat(dstPath); err == nil {
+			return nil // 作業用ディレクトリに既にあるファイルは今回の出力のため残す。
+		}
+		if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+			return err
+		}
+		if err := os.Link(path, dstPath); err != nil {
+			return CopyFile(path, dstPath)
+		}
+		return nil
+	})
+}
+
+//! sync時に、今回の出力にない前回の出力のうち残すもの(隠しファイルとsyncPreservedEntries)を作業用ディレクトリに引き継ぐ。
+func CarryOverPreserved(outputDir, staging string) error {
+	if _, err := os.Stat(outputDir); err != nil {
+		return nil
+	}
+	return LinkTree(outputDir, staging, func(relPath string) bool {
+		parts := strings.Split(filepath.ToSlash(relPath), "/")
+		// 前回の変換内容の記録は今回の記録で置き換える。
+		if parts[0] == CacheDirName {
+			return false
+		}
+		for i := range parts {
+			if isPreservedEntry(strings.Join(parts[:i+1], "/")) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+//! 作業用ディレクトリを出力ディレクトリと入れ替える。前回の出力は入れ替えが終わるまで退避して残し、失敗した場合は元に戻す。
+func CommitStaging(staging, outputDir string, logger *log.Logger) error {
+	backup := backupDir(outputDir)
+	_, statErr := os.Stat(outputDir)
+	exists := statErr == nil
+
+	if exists {
+		if err := os.Rename(outputDir, backup); err != nil {
+			return errors.Errorf("前回の出力の退避に失敗: %v", err)
+		}
+	}
+	if err := os.Rename(staging, outputDir); err != nil {
+		if exists {
+			if restoreErr := os.Rename(backup, outputDir); restoreErr != nil {
+				return errors.Errorf("出力ディレクトリの入れ替えに失敗: %v (前回の出力は %s に残っています: %v)", err, backup, restoreErr)
+			}
+		}
+		return errors.Errorf("出力ディレクトリの入れ替えに失敗: %v", err)
+	}
+	if exists {
+		if err := os.RemoveAll(backup); err != nil {
+			logf(logger, "退避した前回の出力を削除できません。次回の実行時に削除します: %v", err)
+		}
+	}
+	return nil
+}
+
+//! 単一ファイルをコピーする。
+func CopyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	// 出力ファイルのディレクトリを作成。
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	// 作業用ディレクトリでは前回の出力とハードリンクで共有しているファイルがあるため、削除してから作る。
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+
+	// 衝突解決のnewest方式や同期で使うため、更新日時を引き継ぐ。
+	if info, err := srcFile.Stat(); err == nil {
+		dstFile.Close()
+		return os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+//! sync時に削除しないエントリかどうかを返す。
+func isPreservedEntry(relPath string) bool {
+	if strings.HasPrefix(filepath.Base(relPath), ".") {
+		return true
+	}
+	for _, name := range syncPreservedEntries {
+		if relPath == name {
+			return true
+		}
+	}
+	return false
+}
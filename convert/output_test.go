@@ -0,0 +1,115 @@
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrepareStagingModes(t *testing.T) {
+	tests := []struct {
+		mode    string
+		exists  bool
+		wantErr bool
+	}{
+		{ModeFailIfExists, false, false},
+		{ModeFailIfExists, true, true},
+		{ModeClean, true, false},
+		{ModeSync, true, false},
+		{ModeSync, false, false},
+		{"unknown", false, true},
+	}
+	for _, tt := range tests {
+		outputDir := filepath.Join(t.TempDir(), "out")
+		if tt.exists {
+			writeTestFile(t, filepath.Join(outputDir, "a.md"), "a")
+		}
+		staging, err := PrepareStaging(outputDir, tt.mode, false, false)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s (exists=%t): err = %v, wantErr %t", tt.mode, tt.exists, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if staging != StagingDir(outputDir) {
+			t.Errorf("%s: staging = %s, want %s", tt.mode, staging, StagingDir(outputDir))
+		}
+		// seedしない場合、作業用ディレクトリは空で作る。
+		if entries, err := os.ReadDir(staging); err != nil || len(entries) != 0 {
+			t.Errorf("%s: staging entries = %v, %v", tt.mode, entries, err)
+		}
+	}
+}
+
+//! 作業用ディレクトリで書き換えたファイルは、入れ替えるまで前回の出力に影響しない。
+func TestStagingCommit(t *testing.T) {
+	outputDir := filepath.Join(t.TempDir(), "out")
+	writeTestFile(t, filepath.Join(outputDir, "keep.md"), "keep")
+	writeTestFile(t, filepath.Join(outputDir, "sub", "page.md"), "old")
+
+	staging, err := PrepareStaging(outputDir, ModeSync, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, filepath.Join(staging, "sub", "page.md")); got != "old" {
+		t.Fatalf("seeded page.md = %q, want old", got)
+	}
+	if err := WriteFile(NewDiskFS(staging), "sub/page.md", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, filepath.Join(outputDir, "sub", "page.md")); got != "old" {
+		t.Errorf("output page.md before commit = %q, want old", got)
+	}
+
+	if err := CommitStaging(staging, outputDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, filepath.Join(outputDir, "sub", "page.md")); got != "new" {
+		t.Errorf("output page.md after commit = %q, want new", got)
+	}
+	if got := readTestFile(t, filepath.Join(outputDir, "keep.md")); got != "keep" {
+		t.Errorf("output keep.md after commit = %q, want keep", got)
+	}
+	for _, dir := range []string{staging, backupDir(outputDir)} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s remains after commit: %v", dir, err)
+		}
+	}
+}
+
+func TestRecoverInterruptedRun(t *testing.T) {
+	t.Run("restore backup", func(t *testing.T) {
+		// 前回の出力を退避した後、入れ替える前に中断された。
+		outputDir := filepath.Join(t.TempDir(), "out")
+		writeTestFile(t, filepath.Join(backupDir(outputDir), "a.md"), "previous")
+		writeTestFile(t, filepath.Join(StagingDir(outputDir), "a.md"), "partial")
+		if err := RecoverInterruptedRun(outputDir, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestFile(t, filepath.Join(outputDir, "a.md")); got != "previous" {
+			t.Errorf("a.md = %q, want previous", got)
+		}
+		if _, err := os.Stat(StagingDir(outputDir)); !os.IsNotExist(err) {
+			t.Errorf("staging remains: %v", err)
+		}
+	})
+	t.Run("keep staging for resume", func(t *testing.T) {
+		outputDir := filepath.Join(t.TempDir(), "out")
+		writeTestFile(t, filepath.Join(outputDir, "a.md"), "current")
+		writeTestFile(t, filepath.Join(backupDir(outputDir), "a.md"), "previous")
+		writeTestFile(t, filepath.Join(StagingDir(outputDir), "a.md"), "partial")
+		if err := RecoverInterruptedRun(outputDir, true, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestFile(t, filepath.Join(outputDir, "a.md")); got != "current" {
+			t.Errorf("a.md = %q, want current", got)
+		}
+		if _, err := os.Stat(backupDir(outputDir)); !os.IsNotExist(err) {
+			t.Errorf("backup remains: %v", err)
+		}
+		if got := readTestFile(t, filepath.Join(StagingDir(outputDir), "a.md")); got != "partial" {
+			t.Errorf("staging a.md = %q, want partial", got)
+		}
+	})
+}
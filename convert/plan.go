@@ -0,0 +1,320 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 実行予定の操作の種類。
+const (
+	OpMkdir        = "mkdir"         // ディレクトリを作成する。
+	OpRenameDir    = "rename-dir"    // 命名ポリシーにより名前の変わるディレクトリを作成する。
+	OpMergeDir     = "merge-dir"     // 命名ポリシーにより同じ名前になるディレクトリをまとめる。
+	OpCopy         = "copy"          // ファイルをコピーする。
+	OpConvert      = "convert"       // HTMLをMarkdownに変換する。
+	OpRenameHtml   = "rename-html"   // 元のHTMLファイルをプレフィックス付きの名前で残す。
+	OpSaveOriginal = "save-original" // 元のHTMLファイルを--originals-dirに保存する。
+	OpDiscard      = "discard"       // 衝突解決(newest)によりファイルを出力しない。
+	OpDelete       = "delete"        // sync時に、入力から消えたファイルの出力を削除する。
+	OpWrite        = "write"         // SUMMARY.mdやbook.tomlを生成する。
+)
+
+//! PlanTreeで作る実行予定の内容。
+type DryRunPlan struct {
+	InputDir     string           `json:"input_dir"`
+	OutputDir    string           `json:"output_dir"`
+	Mode         string           `json:"mode"`
+	OutputExists bool             `json:"output_exists"`       // 出力ディレクトリが既に存在するかどうか。
+	Warnings     []string         `json:"warnings,omitempty"`  // 実行時に問題になる点。
+	Operations   []*PlanOperation `json:"operations"`          // 実行予定の操作。
+	Collisions   []*PlanCollision `json:"collisions"`          // 命名ポリシーによるパスの衝突と解決内容。
+	Overwrites   int              `json:"overwrites"`          // 既存のファイルを上書きする操作の数。
+	Summary      string           `json:"summary"`             // 生成されるSUMMARY.mdの内容。
+	BookToml     string           `json:"book_toml,omitempty"` // 生成されるbook.tomlの内容。
+}
+
+//! 実行予定の1操作。
+type PlanOperation struct {
+	Op        string `json:"op"`                  // 操作の種類。
+	Source    string `json:"source,omitempty"`    // 入力ディレクトリからの相対パス。
+	Target    string `json:"target"`              // 出力先。出力ディレクトリからの相対パス(save-originalは保存先のパス)。
+	Overwrite bool   `json:"overwrite,omitempty"` // 既存のファイルを上書きするかどうか。
+	Unchanged bool   `json:"unchanged,omitempty"` // sync時に内容が変わらないため省略されるかどうか。
+}
+
+//! 1件の衝突と、その解決内容。
+type PlanCollision struct {
+	Key        string            `json:"key"`        // ポリシー適用後の出力パスを小文字にしたもの。
+	Paths      []string          `json:"paths"`      // 衝突している相対パス。
+	Resolution map[string]string `json:"resolution"` // 相対パスごとの解決結果(解決後のパス、または破棄)。
+}
+
+//! srcの入力ディレクトリとdstの既存の出力ディレクトリを読み取り、Treeを実行した場合の操作を作る。ディスクには書き込まない。
+func PlanTree(ctx context.Context, src, dst string, opts Options) (*DryRunPlan, error) {
+	inputDir := filepath.Clean(src)
+	outputDir := filepath.Clean(dst)
+	if err := opts.validateDirs(inputDir, outputDir); err != nil {
+		return nil, err
+	}
+	plan, err := PlanTreeFrom(ctx, os.DirFS(inputDir), outputDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	plan.InputDir = inputDir
+	return plan, nil
+}
+
+//! PlanTreeと同じく、任意のfs.FSの入力についてTreeFromを実行した場合の操作を作る。
+func PlanTreeFrom(ctx context.Context, src fs.FS, dst string, opts Options) (*DryRunPlan, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	policy, err := ParseNamingPolicy(opts.Naming)
+	if err != nil {
+		return nil, err
+	}
+	outputDir := filepath.Clean(dst)
+	manifest, err := ScanInput(ctx, src, policy, &opts)
+	if err != nil {
+		return nil, err
+	}
+	bookName := opts.BookName
+	if bookName == "" {
+		bookName = filepath.Base(outputDir)
+	}
+
+	plan := &DryRunPlan{
+		OutputDir:  outputDir,
+		Mode:       opts.Mode,
+		Operations: []*PlanOperation{},
+		Collisions: []*PlanCollision{},
+	}
+	if _, err := os.Stat(outputDir); err == nil {
+		plan.OutputExists = true
+		switch opts.Mode {
+		case ModeFailIfExists:
+			plan.Warnings = append(plan.Warnings, "出力ディレクトリが既に存在するため、実行するとエラーになります (--mode clean または --mode sync を指定してください)")
+		case ModeClean:
+			plan.Warnings = append(plan.Warnings, "既存の出力ディレクトリは削除してから作り直されます")
+		}
+	}
+
+	// 既存の出力を上書きするのはsync時だけ。clean時は削除後に作るため上書きにはならない。
+	// sync時に前回の変換内容があれば、BuildOutputと同じく変更のないファイルを省略し、前回の出力のうち不要なものを削除する。
+	syncing := plan.OutputExists && opts.Mode == ModeSync
+	var cache, previous *BuildCache
+	if syncing {
+		cache = LoadBuildCache(outputDir, OptionsHash(&opts), opts.Logger)
+		if cache.SameRenames(manifest.Plan.Renames) {
+			previous = cache
+		}
+	}
+	originalsDir := opts.originalsDir(outputDir)
+	exists := func(target string) bool {
+		if !syncing {
+			return false
+		}
+		_, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(target)))
+		return err == nil
+	}
+	addFile := func(op *PlanOperation) {
+		op.Overwrite = exists(op.Target) && !op.Unchanged
+		if op.Overwrite {
+			plan.Overwrites++
+		}
+		plan.Operations = append(plan.Operations, op)
+	}
+
+	// ディレクトリ。命名ポリシーで同じ名前になるディレクトリは2つ目以降をマージとして扱う。
+	dirSources := map[string]bool{}
+	for _, entry := range manifest.Entries {
+		if entry.Kind != EntryDir {
+			continue
+		}
+		op := &PlanOperation{Op: OpMkdir, Source: entry.Source, Target: entry.Output}
+		if dirSources[entry.Output] {
+			op.Op = OpMergeDir
+		} else if entry.Output != entry.Source {
+			op.Op = OpRenameDir
+		}
+		dirSources[entry.Output] = true
+		plan.Operations = append(plan.Operations, op)
+	}
+
+	// ファイル。
+	digests := newRuleDigests(&opts)
+	for _, entry := range manifest.Files() {
+		op := &PlanOperation{Op: OpCopy, Source: entry.Source, Target: entry.Output}
+		if entry.Kind == EntryConvert {
+			op.Op = OpConvert
+		}
+		if previous != nil {
+			if hash, err := HashEntry(src, entry, &opts); err == nil {
+				entry.Hash = hash
+				if entry.Kind == EntryConvert {
+					entry.RulesHash = digests.PageHash(entry.Source)
+				}
+				op.Unchanged = previous.IsUpToDate(entry, os.DirFS(outputDir), os.DirFS(originalsDir), manifest.Paths)
+			}
+		}
+		addFile(op)
+
+		if entry.Original == "" {
+			continue
+		}
+		if opts.Direct {
+			plan.Operations = append(plan.Operations, &PlanOperation{Op: OpSaveOriginal, Source: entry.Source, Target: filepath.ToSlash(filepath.Join(opts.OriginalsDir, filepath.FromSlash(entry.Original)))})
+		} else {
+			addFile(&PlanOperation{Op: OpRenameHtml, Source: entry.Source, Target: entry.Original, Unchanged: op.Unchanged})
+		}
+	}
+	for _, removed := range manifest.Plan.Removed {
+		plan.Operations = append(plan.Operations, &PlanOperation{Op: OpDiscard, Source: removed, Target: OutputPath(manifest.Plan.Resolve(removed), policy)})
+	}
+
+	// 衝突。
+	removed := map[string]bool{}
+	for _, p := range manifest.Plan.Removed {
+		removed[p] = true
+	}
+	for _, c := range manifest.Plan.Collisions {
+		pc := &PlanCollision{Key: c.Key, Paths: c.Paths, Resolution: map[string]string{}}
+		for _, p := range c.Paths {
+			switch {
+			case removed[p]:
+				pc.Resolution[p] = OpDiscard
+			default:
+				pc.Resolution[p] = OutputPath(manifest.Plan.Resolve(p), policy)
+			}
+		}
+		plan.Collisions = append(plan.Collisions, pc)
+	}
+
+	// mdbook用ファイル。
+	plan.Summary = RenderSummaryMd(manifest)
+	plan.BookToml = RenderBookToml(bookName)
+	summaryUnchanged := cache != nil && !cache.SummaryChanged(manifest, bookName, os.DirFS(outputDir))
+	addFile(&PlanOperation{Op: OpWrite, Target: "SUMMARY.md", Unchanged: summaryUnchanged})
+	addFile(&PlanOperation{Op: OpWrite, Target: "book.toml", Unchanged: summaryUnchanged})
+
+	// sync時に削除される出力。
+	if cache != nil {
+		outputs, originals, dirs := cache.StaleEntries(manifest)
+		for _, target := range outputs {
+			plan.Operations = append(plan.Operations, &PlanOperation{Op: OpDelete, Target: target})
+		}
+		for _, target := range originals {
+			if opts.Direct {
+				target = filepath.ToSlash(filepath.Join(originalsDir, filepath.FromSlash(target)))
+			}
+			plan.Operations = append(plan.Operations, &PlanOperation{Op: OpDelete, Target: target})
+		}
+		for _, target := range dirs {
+			plan.Operations = append(plan.Operations, &PlanOperation{Op: OpDelete, Target: target})
+		}
+	} else if syncing {
+		stale, err := staleOutputs(outputDir, plan.Operations)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range stale {
+			plan.Operations = append(plan.Operations, &PlanOperation{Op: OpDelete, Target: target})
+		}
+	}
+	return plan, nil
+}
+
+//! 既存の出力ディレクトリのうち、実行予定の操作で出力されないエントリを返す。CarryOverPreservedで引き継ぐ隠しファイルとsyncPreservedEntriesは除く。
+func staleOutputs(outputDir string, operations []*PlanOperation) ([]string, error) {
+	targets := map[string]bool{}
+	for _, op := range operations {
+		if op.Op == OpSaveOriginal || op.Op == OpDiscard {
+			continue
+		}
+		// 出力先の親ディレクトリも出力されるものとして扱う。
+		for p := op.Target; p != "." && p != "/" && p != ""; p = filepath.ToSlash(filepath.Dir(p)) {
+			targets[p] = true
+		}
+	}
+
+	var stale []string
+	err := filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == outputDir {
+			return nil
+		}
+		relPath, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		if isPreservedEntry(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPath = filepath.ToSlash(relPath)
+		if !targets[relPath] {
+			stale = append(stale, relPath)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	sort.Strings(stale)
+	return stale, err
+}
+
+//! 実行予定の内容を人が読む形式で返す。
+func (plan *DryRunPlan) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "実行予定: %s → %s (mode: %s)\n", plan.InputDir, plan.OutputDir, plan.Mode)
+	for _, warning := range plan.Warnings {
+		fmt.Fprintf(&b, "警告: %s\n", warning)
+	}
+
+	b.WriteString("\n## 操作\n")
+	for _, op := range plan.Operations {
+		fmt.Fprintf(&b, "[%s] ", op.Op)
+		if op.Source != "" {
+			fmt.Fprintf(&b, "%s → ", op.Source)
+		}
+		b.WriteString(op.Target)
+		if op.Overwrite {
+			b.WriteString(" (上書き)")
+		}
+		if op.Unchanged {
+			b.WriteString(" (変更なし)")
+		}
+		b.WriteString("\n")
+	}
+
+	fmt.Fprintf(&b, "\n## 衝突 (%d件)\n", len(plan.Collisions))
+	for _, c := range plan.Collisions {
+		fmt.Fprintf(&b, "%s\n", c.Key)
+		for _, p := range c.Paths {
+			fmt.Fprintf(&b, "  %s → %s\n", p, c.Resolution[p])
+		}
+	}
+
+	counts := map[string]int{}
+	for _, op := range plan.Operations {
+		counts[op.Op]++
+	}
+	fmt.Fprintf(&b, "\n## 集計\n変換 %d, コピー %d, 元HTMLの保存 %d, ディレクトリ %d (名前変更 %d, マージ %d), 破棄 %d, 削除 %d, 上書き %d\n",
+		counts[OpConvert], counts[OpCopy], counts[OpRenameHtml]+counts[OpSaveOriginal],
+		counts[OpMkdir]+counts[OpRenameDir]+counts[OpMergeDir], counts[OpRenameDir], counts[OpMergeDir],
+		counts[OpDiscard], counts[OpDelete], plan.Overwrites)
+
+	b.WriteString("\n## SUMMARY.md\n")
+	b.WriteString(plan.Summary)
+	return b.String()
+}
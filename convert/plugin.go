@@ -0,0 +1,337 @@
+package convert
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// プラグインを呼び出す段階。
+const (
+	PluginStageHtml     = "html"     // HTMLを解析する前。HTMLを受け取り、書き換えたHTMLを返す。
+	PluginStageMarkdown = "markdown" // Markdownに変換した後。Markdownを受け取り、書き換えたMarkdownを返す。
+)
+
+// プラグインの1回の呼び出しの既定の制限時間。
+const DefaultPluginTimeout = 30 * time.Second
+
+//! 外部コマンドによる変換のプラグイン。ページごとに、指定した段階の内容をJSONで標準入力に渡し、標準出力から結果を受け取る。
+//! プロセスは変換の間起動したままにして、複数のページの処理に使う。並列に変換する場合は複数のプロセスを起動する。
+//! 設定ファイルの[[plugin]]にも同じ項目で記述できる。
+type Plugin struct {
+	Name    string        `toml:"name"`    // プラグインの名前。エラーメッセージに使う。省略時はコマンド名。
+	Command []string      `toml:"command"` // 実行するコマンドと引数。
+	Stages  []string      `toml:"stages"`  // 呼び出す段階 (PluginStageHtml, PluginStageMarkdown)。省略時はmarkdown。
+	Paths   []string      `toml:"paths"`   // 適用するページの、入力の相対パスのglob。空の場合はすべてのページ。
+	Timeout time.Duration `toml:"timeout"` // 1ページの処理の制限時間。0の場合はDefaultPluginTimeout。
+	Version string        `toml:"version"` // プラグインの処理の識別子。処理を変えた場合に変更すると、sync時に前回の変換内容を使わず変換し直す。
+}
+
+//! 報告とエラーメッセージに使うプラグインの名前を返す。
+func (p *Plugin) displayName() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	if len(p.Command) > 0 {
+		return p.Command[0]
+	}
+	return ""
+}
+
+//! プラグインを呼び出す段階を返す。
+func (p *Plugin) stages() []string {
+	if len(p.Stages) == 0 {
+		return []string{PluginStageMarkdown}
+	}
+	return p.Stages
+}
+
+//! プラグインの設定を検証する。
+func validatePlugin(p Plugin) error {
+	if len(p.Command) == 0 || p.Command[0] == "" {
+		return errors.Errorf("プラグイン %s の command を指定してください", p.displayName())
+	}
+	for _, stage := range p.Stages {
+		if stage != PluginStageHtml && stage != PluginStageMarkdown {
+			return errors.Errorf("プラグイン %s の段階が不正です: %s (%s, %sのいずれかを指定してください)", p.displayName(), stage, PluginStageHtml, PluginStageMarkdown)
+		}
+	}
+	if p.Timeout < 0 {
+		return errors.Errorf("プラグイン %s の timeout が負の値です: %v", p.displayName(), p.Timeout)
+	}
+	return validatePathPatterns(p.displayName(), p.Paths)
+}
+
+//! プラグインに渡す1ページ分の要求。1行のJSONとして標準入力に書き込む。
+type PluginRequest struct {
+	Stage       string         `json:"stage"`        // 呼び出した段階。
+	Source      string         `json:"source"`       // 入力の相対パス。
+	Output      string         `json:"output"`       // 出力の相対パス。
+	Title       string         `json:"title"`        // SUMMARY.mdに載せるタイトル。
+	Content     string         `json:"content"`      // 段階に応じてHTMLまたはMarkdown。
+	FrontMatter map[string]any `json:"front_matter"` // それまでのプラグインが設定したフロントマター。
+}
+
+//! プラグインが返す1ページ分の応答。1行のJSONとして標準出力に書き出す。
+type PluginResponse struct {
+	Content     *string        `json:"content,omitempty"`      // 書き換えた内容。省略した場合は変更しない。
+	FrontMatter map[string]any `json:"front_matter,omitempty"` // Markdownの先頭に付けるフロントマターに追加する項目。
+	Warnings    []string       `json:"warnings,omitempty"`     // 変換結果の警告に加えるメッセージ。
+	Error       string         `json:"error,omitempty"`        // 空でなければ、そのページの処理を失敗にする。
+}
+
+//! 起動済みのプラグインのプロセス。1度に1ページずつ処理する。
+type pluginProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+//! プラグインのプロセスを管理する。空いているプロセスがなければ新しく起動する。
+type pluginRunner struct {
+	Plugin
+
+	mu     sync.Mutex
+	idle   []*pluginProcess
+	all    []*pluginProcess
+	closed bool
+}
+
+//! ページに適用する場合にtrueを返す。
+func (r *pluginRunner) appliesTo(stage, pageRel string) bool {
+	for _, s := range r.stages() {
+		if s == stage {
+			return matchPaths(r.Paths, pageRel)
+		}
+	}
+	return false
+}
+
+//! プロセスを起動する。プラグインの標準エラー出力はそのまま表示する。
+func (r *pluginRunner) start() (*pluginProcess, error) {
+	cmd := exec.Command(r.Command[0], r.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Errorf("プラグイン %s の起動に失敗: %v", r.displayName(), err)
+	}
+	proc := &pluginProcess{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}
+	r.mu.Lock()
+	r.all = append(r.all, proc)
+	r.mu.Unlock()
+	return proc, nil
+}
+
+//! 空いているプロセスを取り出す。なければ起動する。
+func (r *pluginRunner) acquire() (*pluginProcess, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, errors.Errorf("プラグイン %s は終了しています", r.displayName())
+	}
+	if n := len(r.idle); n > 0 {
+		proc := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return proc, nil
+	}
+	r.mu.Unlock()
+	return r.start()
+}
+
+//! 処理を終えたプロセスを空きに戻す。
+func (r *pluginRunner) release(proc *pluginProcess) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.idle = append(r.idle, proc)
+}
+
+//! 応答がない、または異常終了したプロセスを停止して、以降は使わない。
+func (r *pluginRunner) discard(proc *pluginProcess) {
+	proc.stdin.Close()
+	proc.cmd.Process.Kill()
+	proc.cmd.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, p := range r.all {
+		if p == proc {
+			r.all = append(r.all[:i], r.all[i+1:]...)
+			break
+		}
+	}
+}
+
+//! 1ページ分の要求を送り、応答を受け取る。制限時間を過ぎた場合はプロセスを停止してエラーを返す。
+func (r *pluginRunner) call(req *PluginRequest) (*PluginResponse, error) {
+	proc, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	line, err := json.Marshal(req)
+	if err != nil {
+		r.release(proc)
+		return nil, err
+	}
+
+	type outcome struct {
+		resp *PluginResponse
+		err  error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		if _, err := proc.stdin.Write(append(line, '\n')); err != nil {
+			done <- outcome{err: errors.Errorf("プラグイン %s への書き込みに失敗: %v", r.displayName(), err)}
+			return
+		}
+		reply, err := proc.stdout.ReadBytes('\n')
+		if err != nil {
+			done <- outcome{err: errors.Errorf("プラグイン %s の応答の読み込みに失敗: %v", r.displayName(), err)}
+			return
+		}
+		resp := &PluginResponse{}
+		if err := json.Unmarshal(reply, resp); err != nil {
+			done <- outcome{err: errors.Errorf("プラグイン %s の応答が不正です: %v", r.displayName(), err)}
+			return
+		}
+		done <- outcome{resp: resp}
+	}()
+
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultPluginTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		if o.err != nil {
+			// 入出力が途中で止まったプロセスは、次の要求と応答の対応が崩れるため使わない。
+			r.discard(proc)
+			return nil, o.err
+		}
+		r.release(proc)
+		if o.resp.Error != "" {
+			return nil, errors.Errorf("プラグイン %s: %s", r.displayName(), o.resp.Error)
+		}
+		return o.resp, nil
+	case <-timer.C:
+		r.discard(proc)
+		return nil, errors.Errorf("プラグイン %s が制限時間 %v 以内に応答しませんでした", r.displayName(), timeout)
+	}
+}
+
+//! すべてのプロセスの標準入力を閉じて終了を待つ。終了しないプロセスは停止する。
+func (r *pluginRunner) close() {
+	r.mu.Lock()
+	r.closed = true
+	procs := r.all
+	r.all, r.idle = nil, nil
+	r.mu.Unlock()
+
+	for _, proc := range procs {
+		proc.stdin.Close()
+		exited := make(chan struct{})
+		go func() {
+			proc.cmd.Wait()
+			close(exited)
+		}()
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			proc.cmd.Process.Kill()
+			<-exited
+		}
+	}
+}
+
+//! ページに適用するプラグインを順に呼び出し、書き換えた内容を返す。
+//! プラグインが返したフロントマターと警告はpageに追加する。
+func (c *Converter) runPlugins(stage string, page *Page, content string) (string, error) {
+	for _, runner := range c.plugins {
+		if !runner.appliesTo(stage, page.Source) {
+			continue
+		}
+		resp, err := runner.call(&PluginRequest{
+			Stage: stage, Source: page.Source, Output: page.Output, Title: page.Title,
+			Content: content, FrontMatter: page.FrontMatter,
+		})
+		if err != nil {
+			return "", err
+		}
+		if resp.Content != nil {
+			content = *resp.Content
+		}
+		for key, value := range resp.FrontMatter {
+			if page.FrontMatter == nil {
+				page.FrontMatter = map[string]any{}
+			}
+			page.FrontMatter[key] = value
+		}
+		page.Warnings = append(page.Warnings, resp.Warnings...)
+	}
+	return content, nil
+}
+
+//! フロントマターをYAMLにしてMarkdownの先頭に付ける。値はJSONとして書き出す(JSONはYAMLとしても読める)。
+func withFrontMatter(frontMatter map[string]any, markdown string) (string, error) {
+	if len(frontMatter) == 0 {
+		return markdown, nil
+	}
+	keys := make([]string, 0, len(frontMatter))
+	for key := range frontMatter {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("---\n")
+	for _, key := range keys {
+		value, err := json.Marshal(frontMatter[key])
+		if err != nil {
+			return "", errors.Errorf("フロントマター %s を書き出せません: %v", key, err)
+		}
+		fmt.Fprintf(&b, "%s: %s\n", yamlKey(key), value)
+	}
+	b.WriteString("---\n\n")
+	return b.String() + markdown, nil
+}
+
+//! フロントマターの項目名を返す。英数字と_-以外を含む場合は引用符で囲む。
+func yamlKey(key string) string {
+	plain := key != ""
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return key
+	}
+	quoted, _ := json.Marshal(key)
+	return string(quoted)
+}
+
+//! プラグインの一覧を、前回の変換内容との比較に使う文字列にする。
+func pluginsHash(plugins []Plugin) string {
+	var b strings.Builder
+	for _, p := range plugins {
+		fmt.Fprintf(&b, "%q;", []string{strings.Join(p.Command, " "), strings.Join(p.stages(), ","), strings.Join(p.Paths, ","), p.Version})
+	}
+	return b.String()
+}
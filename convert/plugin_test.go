@@ -0,0 +1,136 @@
+package convert
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//! テストのバイナリをプラグインとして起動するための環境変数。
+const pluginHelperEnv = "HTML2MD_TEST_PLUGIN"
+
+//! テストのバイナリをmodeの動作のプラグインとして起動する設定を返す。
+func helperPlugin(t *testing.T, mode string) Plugin {
+	t.Setenv(pluginHelperEnv, "1")
+	return Plugin{Name: mode, Command: []string{os.Args[0], "-test.run=^TestPluginHelperProcess$", "--", mode}}
+}
+
+//! helperPluginから起動された場合に、プラグインとして動作する。
+//! modeはupper(内容を大文字にし、フロントマターと警告を返す)、fail(bad.htmlのページでエラーを返す)、sleep(応答しない)、exit(要求を読まずに終了する)。
+func TestPluginHelperProcess(t *testing.T) {
+	if os.Getenv(pluginHelperEnv) != "1" {
+		return
+	}
+	mode := os.Args[len(os.Args)-1]
+	if mode == "exit" {
+		os.Exit(1)
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		req := &PluginRequest{}
+		if err := json.Unmarshal(scanner.Bytes(), req); err != nil {
+			os.Exit(2)
+		}
+		resp := &PluginResponse{}
+		switch mode {
+		case "upper":
+			content := strings.ToUpper(req.Content)
+			resp.Content = &content
+			resp.FrontMatter = map[string]any{"stage": req.Stage}
+			resp.Warnings = []string{"checked " + req.Source}
+		case "fail":
+			if req.Source == "bad.html" {
+				resp.Error = "bad page"
+			}
+		case "sleep":
+			time.Sleep(10 * time.Second)
+		}
+		line, _ := json.Marshal(resp)
+		fmt.Println(string(line))
+	}
+	os.Exit(0)
+}
+
+func TestPluginStages(t *testing.T) {
+	tests := []struct {
+		stage string
+		want  string
+	}{
+		{PluginStageHtml, "---\nstage: \"html\"\n---\n\nA _B_"},
+		{PluginStageMarkdown, "---\nstage: \"markdown\"\n---\n\nA _B_"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		plugin := helperPlugin(t, "upper")
+		plugin.Stages = []string{tt.stage}
+		opts.Plugins = []Plugin{plugin}
+		page, err := Document(strings.NewReader(`<p>a <em>b</em></p>`), "a.html", opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.stage, err)
+			continue
+		}
+		if page.Markdown != tt.want {
+			t.Errorf("%s: markdown = %q, want %q", tt.stage, page.Markdown, tt.want)
+		}
+		if len(page.Warnings) != 1 || page.Warnings[0] != "checked a.html" {
+			t.Errorf("%s: warnings = %v, want [checked a.html]", tt.stage, page.Warnings)
+		}
+	}
+}
+
+func TestPluginErrors(t *testing.T) {
+	tests := []struct {
+		mode    string
+		timeout time.Duration
+		want    string
+	}{
+		{"fail", 0, "プラグイン fail: bad page"},
+		{"sleep", 200 * time.Millisecond, "プラグイン sleep が制限時間 200ms 以内に応答しませんでした"},
+		{"exit", 0, "プラグイン exit "},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		plugin := helperPlugin(t, tt.mode)
+		plugin.Timeout = tt.timeout
+		opts.Plugins = []Plugin{plugin}
+		_, err := Document(strings.NewReader(`<p>a</p>`), "bad.html", opts)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.mode, err, tt.want)
+		}
+	}
+}
+
+//! プラグインが失敗したページだけを失敗として記録し、他のページのプラグインの警告は結果に含める。
+func TestPluginTree(t *testing.T) {
+	dir := t.TempDir()
+	inputDir, outputDir := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	for _, name := range []string{"a.html", "bad.html", "c.html"} {
+		writeTestFile(t, filepath.Join(inputDir, name), "<p>"+name+"</p>")
+	}
+	opts := DefaultOptions()
+	opts.Jobs = 2
+	opts.Plugins = []Plugin{helperPlugin(t, "upper"), helperPlugin(t, "fail")}
+	result, err := Tree(t.Context(), inputDir, outputDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Converted != 2 || len(result.Failed) != 1 || result.Failed[0].Source != "bad.html" {
+		t.Errorf("converted %d, failed %v; want 2, [bad.html]", result.Converted, result.Failed)
+	}
+	var warnings []string
+	for _, w := range result.Warnings {
+		warnings = append(warnings, w.Source+": "+w.Message)
+	}
+	if want := "a.html: checked a.html,c.html: checked c.html"; strings.Join(warnings, ",") != want {
+		t.Errorf("warnings = %v, want %s", warnings, want)
+	}
+	if got := readTestFile(t, filepath.Join(outputDir, "c.md")); !strings.HasSuffix(got, "C.HTML") {
+		t.Errorf("c.md = %q, want the plugin output", got)
+	}
+}
@@ -0,0 +1,244 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// 置換規則の検索方法。
+const (
+	ReplaceLiteral   = "literal"   // Findをそのままの文字列として検索する。
+	ReplaceRegex     = "regex"     // Findを正規表現として1行ずつ検索する。置換後の文字列では$1や${name}で一致した部分を参照できる。
+	ReplaceMultiline = "multiline" // Findを正規表現として文書全体を検索する。^と$は各行の先頭と末尾に一致する。
+)
+
+//! 変換後のMarkdownの置換規則。変換の最後に、出力するファイルの内容に対して指定した順に適用する。
+//! 設定ファイルの[[replace]]にも同じ項目で記述できる。
+type Replace struct {
+	Name        string   `toml:"name"`    // 規則の名前。報告で使う。省略時はFind。
+	Find        string   `toml:"find"`    // 検索する文字列または正規表現。
+	Replacement string   `toml:"replace"` // 置換後の文字列。
+	Mode        string   `toml:"mode"`    // 検索方法 (ReplaceLiteral, ReplaceRegex, ReplaceMultiline)。省略時はliteral。
+	Paths       []string `toml:"paths"`   // 適用するページの、入力の相対パスのglob。空の場合はすべてのページ。
+}
+
+//! 報告とエラーメッセージに使う規則の名前を返す。
+func (r *Replace) displayName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Find
+}
+
+//! 置換規則をコンパイルする。検索方法が不明な場合や正規表現が不正な場合はエラーを返す。
+func compileReplace(r Replace) (*compiledReplace, error) {
+	if r.Find == "" {
+		return nil, errors.Errorf("置換規則 %s の find を指定してください", r.displayName())
+	}
+	if err := validatePathPatterns(r.displayName(), r.Paths); err != nil {
+		return nil, err
+	}
+	compiled := &compiledReplace{Replace: r}
+	switch r.Mode {
+	case "", ReplaceLiteral:
+	case ReplaceRegex, ReplaceMultiline:
+		pattern := r.Find
+		if r.Mode == ReplaceMultiline {
+			pattern = "(?m)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Errorf("置換規則 %s の正規表現が不正です: %v", r.displayName(), err)
+		}
+		compiled.re = re
+	default:
+		return nil, errors.Errorf("置換規則 %s の検索方法が不明です: %s (%s, %s, %sのいずれかを指定してください)", r.displayName(), r.Mode, ReplaceLiteral, ReplaceRegex, ReplaceMultiline)
+	}
+	return compiled, nil
+}
+
+//! 置換規則の設定を検証する。
+func validateReplace(r Replace) error {
+	_, err := compileReplace(r)
+	return err
+}
+
+//! コンパイルした置換規則。ページごとの置換した箇所の数を並行して集計する。
+type compiledReplace struct {
+	Replace
+	re    *regexp.Regexp // regexとmultilineの場合の正規表現。
+	hits  atomic.Int64
+	pages atomic.Int64
+}
+
+//! 置換して、置換した箇所の数とともに返す。
+func (r *compiledReplace) apply(content string) (string, int) {
+	switch {
+	case r.re == nil:
+		return strings.ReplaceAll(content, r.Find, r.Replacement), strings.Count(content, r.Find)
+	case r.Mode == ReplaceRegex:
+		// sedと同じく1行ずつ置換するため、一致が行をまたぐことはない。
+		lines := strings.Split(content, "\n")
+		count := 0
+		for i, line := range lines {
+			if n := len(r.re.FindAllStringIndex(line, -1)); n > 0 {
+				count += n
+				lines[i] = r.re.ReplaceAllString(line, r.Replacement)
+			}
+		}
+		return strings.Join(lines, "\n"), count
+	default:
+		return r.re.ReplaceAllString(content, r.Replacement), len(r.re.FindAllStringIndex(content, -1))
+	}
+}
+
+//! ページに適用する置換規則を順に適用し、規則の名前 → 置換した箇所の数とともに返す。
+//! 置換した箇所の数は集計しないため、ページの出力が決まった後にAddReplaceHitsで加える。
+func (c *Converter) applyReplaces(content, pageRel string) (string, map[string]int) {
+	var hits map[string]int
+	for _, r := range c.replaces {
+		if !matchPaths(r.Paths, pageRel) {
+			continue
+		}
+		var count int
+		if content, count = r.apply(content); count == 0 {
+			continue
+		}
+		if hits == nil {
+			hits = map[string]int{}
+		}
+		hits[r.displayName()] += count
+	}
+	return content, hits
+}
+
+//! 1ページ分の置換規則の置換した箇所の数を集計に加える。hitsは規則の名前 → 置換した箇所の数。
+//! 同じ名前の規則が複数ある場合は、最初の規則に加える。
+func (c *Converter) AddReplaceHits(hits map[string]int) {
+	for name, count := range hits {
+		for _, r := range c.replaces {
+			if r.displayName() == name {
+				r.hits.Add(int64(count))
+				r.pages.Add(1)
+				break
+			}
+		}
+	}
+}
+
+//! AddReplaceHitsで集計した置換規則の適用結果を、指定された順に返す。一致しなかった規則も含める。
+func (c *Converter) ReplaceHits() []*RewriteHit {
+	hits := make([]*RewriteHit, len(c.replaces))
+	for i, r := range c.replaces {
+		hits[i] = &RewriteHit{Name: r.displayName(), Hits: int(r.hits.Load()), Pages: int(r.pages.Load())}
+	}
+	return hits
+}
+
+//! 置換規則の一覧を、前回の変換内容との比較に使う文字列にする。
+func replacesHash(replaces []Replace) string {
+	var b strings.Builder
+	for _, r := range replaces {
+		fmt.Fprintf(&b, "%q;", []string{r.Name, r.Find, r.Replacement, r.Mode, strings.Join(r.Paths, ",")})
+	}
+	return b.String()
+}
+
+//! 置換規則の試験の1ファイル分の結果。
+type ReplaceTestCase struct {
+	Source string        // 試験用ファイルの相対パス。置換規則のパスの判定にも使う。
+	Before string        // 置換規則を適用する前の内容。
+	After  string        // 置換規則を適用した後の内容。
+	Hits   []*ReplaceHit // 置換した箇所があった規則。
+	Err    error         // 変換に失敗した場合のエラー。
+}
+
+//! 置換規則ごとの置換した箇所の数。
+type ReplaceHit struct {
+	Name  string
+	Count int
+}
+
+//! 試験用ファイルにopts.Replacesを適用した結果を、相対パス順に返す。
+//! .mdのファイルには置換規則だけを適用する。.htmlのファイルは置換規則を除いたoptsで変換した結果を置換前の内容とし、それに置換規則を適用する。
+//! 試験用ファイルの相対パスを入力の相対パスとみなして、規則のパスを判定する。
+func TestReplaces(src fs.FS, opts Options) ([]*ReplaceTestCase, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	policy, err := ParseNamingPolicy(opts.Naming)
+	if err != nil {
+		return nil, err
+	}
+	converter, err := NewConverter(&opts)
+	if err != nil {
+		return nil, err
+	}
+	defer converter.Close()
+	withoutReplaces := opts
+	withoutReplaces.Replaces = nil
+	htmlConverter, err := NewConverter(&withoutReplaces)
+	if err != nil {
+		return nil, err
+	}
+	defer htmlConverter.Close()
+
+	var names []string
+	err = fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(path.Ext(name)) {
+		case ".md", ".html":
+			if !d.IsDir() {
+				names = append(names, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Errorf("試験用ファイルの走査に失敗: %v", err)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return nil, errors.Errorf("試験用ファイル(.md, .html)がありません")
+	}
+
+	paths := NewPathMap(policy)
+	var cases []*ReplaceTestCase
+	for _, name := range names {
+		tc := &ReplaceTestCase{Source: name}
+		cases = append(cases, tc)
+		data, err := fs.ReadFile(src, name)
+		if err != nil {
+			tc.Err = err
+			continue
+		}
+		tc.Before = string(data)
+		if strings.EqualFold(path.Ext(name), ".html") {
+			page := &Page{Source: name, Output: OutputPath(name, policy)}
+			page.Title = PageTitle(page.Output)
+			if tc.Err = convertPage(context.Background(), htmlConverter, data, page, paths, &withoutReplaces); tc.Err != nil {
+				continue
+			}
+			tc.Before = page.Markdown
+		}
+		var hits map[string]int
+		tc.After, hits = converter.applyReplaces(tc.Before, name)
+		for _, r := range converter.replaces {
+			if count, ok := hits[r.displayName()]; ok {
+				tc.Hits = append(tc.Hits, &ReplaceHit{Name: r.displayName(), Count: count})
+				delete(hits, r.displayName())
+			}
+		}
+	}
+	return cases, nil
+}
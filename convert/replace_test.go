@@ -0,0 +1,129 @@
+package convert
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReplaceModes(t *testing.T) {
+	tests := []struct {
+		replace Replace
+		want    string
+		hits    map[string]int
+	}{
+		{Replace{Find: "a.b", Replacement: "x"}, "x axb\n\nc\n\nd", map[string]int{"a.b": 1}},
+		{Replace{Name: "dot", Find: "a.b", Replacement: "x", Mode: ReplaceRegex}, "x x\n\nc\n\nd", map[string]int{"dot": 2}},
+		{Replace{Find: `^(\w)$`, Replacement: "[$1]", Mode: ReplaceRegex}, "a.b axb\n\n[c]\n\n[d]", map[string]int{`^(\w)$`: 2}},
+		{Replace{Find: `c\n\nd`, Replacement: "cd", Mode: ReplaceRegex}, "a.b axb\n\nc\n\nd", nil},
+		{Replace{Find: `c\n\nd`, Replacement: "cd", Mode: ReplaceMultiline}, "a.b axb\n\ncd", map[string]int{`c\n\nd`: 1}},
+		{Replace{Find: "c", Replacement: "x", Paths: []string{"docs/**"}}, "a.b axb\n\nc\n\nd", nil},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Replaces = []Replace{tt.replace}
+		page, err := Document(strings.NewReader(`<p>a.b axb</p><p>c</p><p>d</p>`), "a.html", opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.replace.displayName(), err)
+			continue
+		}
+		if page.Markdown != tt.want {
+			t.Errorf("%s: markdown = %q, want %q", tt.replace.displayName(), page.Markdown, tt.want)
+		}
+		if !reflect.DeepEqual(page.Replaces, tt.hits) {
+			t.Errorf("%s: replaces = %v, want %v", tt.replace.displayName(), page.Replaces, tt.hits)
+		}
+	}
+}
+
+//! 置換規則は指定した順に適用し、後の規則は前の規則で置換した後の内容に適用する。
+func TestReplaceOrder(t *testing.T) {
+	tests := []struct {
+		replaces []Replace
+		want     string
+	}{
+		{[]Replace{{Find: "foo", Replacement: "bar"}, {Find: "bar", Replacement: "baz"}}, "baz baz"},
+		{[]Replace{{Find: "bar", Replacement: "baz"}, {Find: "foo", Replacement: "bar"}}, "bar baz"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Replaces = tt.replaces
+		page, err := Document(strings.NewReader(`<p>foo bar</p>`), "a.html", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Markdown != tt.want {
+			t.Errorf("%s, %s: markdown = %q, want %q", tt.replaces[0].Find, tt.replaces[1].Find, page.Markdown, tt.want)
+		}
+	}
+}
+
+func TestReplaceInvalid(t *testing.T) {
+	for _, r := range []Replace{
+		{Find: ""},
+		{Find: "(", Mode: ReplaceRegex},
+		{Find: "a", Mode: "glob"},
+		{Find: "a", Paths: []string{"["}},
+	} {
+		opts := DefaultOptions()
+		opts.Replaces = []Replace{r}
+		if err := opts.Validate(); err == nil {
+			t.Errorf("%+v: err = nil, want an error", r)
+		}
+	}
+}
+
+//! 置換数は変換を省略したページも前回の記録から数え、一致しなかった規則も報告する。
+func TestReplaceHits(t *testing.T) {
+	dir := t.TempDir()
+	inputDir, outputDir := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	writeTestFile(t, filepath.Join(inputDir, "a.html"), `<p>TODO TODO</p>`)
+	writeTestFile(t, filepath.Join(inputDir, "b.html"), `<p>TODO</p>`)
+	writeTestFile(t, filepath.Join(inputDir, "c.html"), `<p>c</p>`)
+	opts := DefaultOptions()
+	opts.Mode = ModeSync
+	opts.Replaces = []Replace{{Name: "todo", Find: "TODO", Replacement: "未定"}, {Name: "none", Find: "FIXME", Replacement: "要修正"}}
+	want := []*RewriteHit{{Name: "todo", Hits: 3, Pages: 2}, {Name: "none"}}
+
+	for _, converted := range []int{3, 0} {
+		result, err := Tree(t.Context(), inputDir, outputDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Converted != converted {
+			t.Errorf("converted %d, want %d", result.Converted, converted)
+		}
+		if !reflect.DeepEqual(result.Replaces, want) {
+			t.Errorf("replaces = %v, want %v", result.Replaces, want)
+		}
+	}
+	if got := readTestFile(t, filepath.Join(outputDir, "a.md")); got != "未定 未定" {
+		t.Errorf("a.md = %q, want %q", got, "未定 未定")
+	}
+}
+
+func TestTestReplaces(t *testing.T) {
+	src := fstest.MapFS{
+		"a.md":        {Data: []byte("foo foo\n")},
+		"docs/b.html": {Data: []byte(`<p>foo</p>`)},
+		"c.txt":       {Data: []byte("foo")},
+	}
+	opts := DefaultOptions()
+	opts.Replaces = []Replace{{Name: "foo", Find: "foo", Replacement: "bar"}, {Name: "docs", Find: "bar", Replacement: "baz", Paths: []string{"docs/**"}}}
+	cases, err := TestReplaces(src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*ReplaceTestCase{
+		{Source: "a.md", Before: "foo foo\n", After: "bar bar\n", Hits: []*ReplaceHit{{"foo", 2}}},
+		{Source: "docs/b.html", Before: "foo", After: "baz", Hits: []*ReplaceHit{{"foo", 1}, {"docs", 1}}},
+	}
+	if !reflect.DeepEqual(cases, want) {
+		for _, tc := range cases {
+			t.Logf("%+v", *tc)
+		}
+		t.Errorf("cases differ from %v", want)
+	}
+}
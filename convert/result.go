@@ -0,0 +1,117 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// リンクの種類。
+const (
+	LinkInternal = "internal" // 入力ディレクトリ内の実在するファイルへのリンク。出力後のファイルへの相対リンクに書き換える。
+	LinkMissing  = "missing"  // 入力ディレクトリ内に実在しないファイルへのリンク。命名ポリシーだけを適用する。
+	LinkLocal    = "local"    // 単独のページの変換で、実在を確認していない相対リンク。命名ポリシーだけを適用する。
+	LinkExternal = "external" // スキーム付きのURLなど、外部へのリンク。書き換えない。
+	LinkAnchor   = "anchor"   // ページ内のアンカーへのリンク。書き換えない。
+)
+
+//! ツリー全体の変換結果。
+type Result struct {
+	InputDir       string `json:"input_dir"`
+	OutputDir      string `json:"output_dir"`
+	Converted      int    `json:"converted"`       // 変換したページ数。
+	Copied         int    `json:"copied"`          // コピーしたファイル数。
+	Skipped        int    `json:"skipped"`         // 変更がないため出力を省略したファイル数。
+	Removed        int    `json:"removed"`         // 削除した不要な出力の数。
+	SummaryUpdated bool   `json:"summary_updated"` // SUMMARY.mdとbook.tomlを生成し直したかどうか。
+
+	Pages    []*Page       `json:"pages"`              // HTMLから変換するページ。入力の相対パス順。
+	Failed   []*FileError  `json:"failed,omitempty"`   // 処理に失敗したファイル。入力の相対パス順。
+	Limited  []*LimitHit   `json:"limited,omitempty"`  // 制限に達したため、変換の代わりにLimitActionの処理をしたファイル。入力の相対パス順。
+	Warnings []*Warning    `json:"warnings,omitempty"` // 変換は続けたが確認が必要な点。
+	Rewrites []*RewriteHit `json:"rewrites,omitempty"` // 書き換え規則ごとの、全ページでの適用数。変換を省略したページは前回の記録から数える。指定した順。
+	Replaces []*RewriteHit `json:"replaces,omitempty"` // 置換規則ごとの、全ページでの置換した箇所の数。変換を省略したページは前回の記録から数える。指定した順。
+}
+
+//! 1ページの変換結果。
+type Page struct {
+	Source      string         `json:"source"`                 // 入力の相対パス。
+	Output      string         `json:"output"`                 // 出力の相対パス。
+	Title       string         `json:"title"`                  // SUMMARY.mdに載せるタイトル。
+	Skipped     bool           `json:"skipped,omitempty"`      // 変更がないため変換を省略したかどうか。省略した場合、Linksは空。
+	Links       []*Link        `json:"links,omitempty"`        // ページ内のリンク。
+	Limit       *LimitHit      `json:"limit,omitempty"`        // 制限に達した場合の記録。
+	FrontMatter map[string]any `json:"front_matter,omitempty"` // プラグインが設定した、Markdownの先頭に付けるフロントマター。
+	Warnings    []string       `json:"warnings,omitempty"`     // プラグインが返した警告。
+	Rewrites    map[string]int `json:"rewrites,omitempty"`     // 書き換え規則の名前 → 書き換えた要素の数。
+	Replaces    map[string]int `json:"replaces,omitempty"`     // 置換規則の名前 → 置換した箇所の数。
+	Markdown    string         `json:"-"`                      // 変換後のMarkdown。Documentの場合だけ設定する。
+}
+
+//! ページ内の1つのリンク(a[href]またはimg[src])。
+type Link struct {
+	Attr     string `json:"attr"`             // リンクの属性名。hrefまたはsrc。
+	Original string `json:"original"`         // 変換前のリンク先。
+	Target   string `json:"target"`           // 書き換え後のリンク先。
+	Kind     string `json:"kind"`             // リンクの種類。
+	Source   string `json:"source,omitempty"` // リンク先の変換前の相対パス。internal, missing, localのみ。
+}
+
+//! 変換は続けたが確認が必要な点。
+type Warning struct {
+	Source  string `json:"source,omitempty"` // 関係する入力の相対パス。
+	Message string `json:"message"`
+}
+
+func (w *Warning) String() string {
+	if w.Source == "" {
+		return w.Message
+	}
+	return fmt.Sprintf("%s: %s", w.Source, w.Message)
+}
+
+//! 1ファイルの処理の失敗。
+type FileError struct {
+	Source string // 入力ディレクトリからの相対パス。
+	Err    error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Source, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+//! JSONではエラーの内容を文字列にする。
+func (e *FileError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Source string `json:"source"`
+		Error  string `json:"error"`
+	}{e.Source, e.Err.Error()})
+}
+
+//! fnを実行し、fn内で発生したパニックをエラーとして返す。壊れたHTMLで変換処理がパニックしても、他のファイルの処理を続けるため。
+func RecoverPanic(logger *log.Logger, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logf(logger, "パニックのスタックトレース:\n%s", debug.Stack())
+			err = errors.Errorf("処理中にパニックが発生しました: %v", r)
+		}
+	}()
+	return fn()
+}
+
+//! 変換結果の一覧を入力の相対パス順に並べる。並列に処理しても同じ順序で報告するため。
+func (r *Result) sort() {
+	sort.Slice(r.Pages, func(i, j int) bool { return r.Pages[i].Source < r.Pages[j].Source })
+	sort.Slice(r.Failed, func(i, j int) bool { return r.Failed[i].Source < r.Failed[j].Source })
+	sort.Slice(r.Limited, func(i, j int) bool { return r.Limited[i].Source < r.Limited[j].Source })
+	// 1ページの警告は同じワーカーが順に追加するため、安定ソートでページ内の順序を保つ。
+	sort.SliceStable(r.Warnings, func(i, j int) bool { return r.Warnings[i].Source < r.Warnings[j].Source })
+}
@@ -0,0 +1,240 @@
+package convert
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	md "github.com/JohannesKaufmann/html-to-markdown"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// 書き換え規則の処理。
+const (
+	RewriteRemove     = "remove"     // 要素を内容ごと除く。
+	RewriteUnwrap     = "unwrap"     // タグを除いて内容だけを残す。
+	RewriteRename     = "rename"     // タグ名をTagに変える。属性と内容はそのまま残す。
+	RewriteSetAttr    = "set-attr"   // 属性AttrにValueを設定する。
+	RewriteText       = "text"       // 要素をTextに置き換える。Textの{text}は要素のテキストに置き換える。
+	RewriteAdmonition = "admonition" // 内容を種類Kindの注記(> [!NOTE])にする。
+	RewriteCodeBlock  = "code-block" // 要素のテキストを言語Languageのコードブロックにする。
+)
+
+// 注記の種類。GitHubのアラートの記法に合わせる。
+var admonitionKinds = []string{"note", "tip", "important", "warning", "caution"}
+
+//! 変換前のDOMの書き換え規則。CSSセレクターに一致した要素をActionに従って書き換えてから、Markdownに変換する。
+//! 設定ファイルの[[rewrite]]にも同じ項目で記述できる。規則は指定した順に適用し、後の規則は前の規則で書き換えた後のDOMに適用する。
+type Rewrite struct {
+	Name     string   `toml:"name"`     // 規則の名前。報告で使う。省略時はセレクター。
+	Selector string   `toml:"selector"` // 対象の要素のCSSセレクター。
+	Paths    []string `toml:"paths"`    // 適用するページの、入力の相対パスのglob。空の場合はすべてのページ。
+	Action   string   `toml:"action"`   // 処理。
+	Tag      string   `toml:"tag"`      // RewriteRenameの新しいタグ名。
+	Attr     string   `toml:"attr"`     // RewriteSetAttrの属性名。
+	Value    string   `toml:"value"`    // RewriteSetAttrの属性の値。
+	Text     string   `toml:"text"`     // RewriteTextの置き換え後のテキスト。
+	Kind     string   `toml:"kind"`     // RewriteAdmonitionの注記の種類 (note, tip, important, warning, caution)。省略時はnote。
+	Language string   `toml:"language"` // RewriteCodeBlockのコードブロックの言語。省略時は指定しない。
+}
+
+//! 報告とエラーメッセージに使う規則の名前を返す。
+func (rw *Rewrite) displayName() string {
+	if rw.Name != "" {
+		return rw.Name
+	}
+	return rw.Selector
+}
+
+//! 書き換え規則の設定を検証する。
+func validateRewrite(rw Rewrite) error {
+	if rw.Selector == "" {
+		return errors.Errorf("書き換え規則 %s の selector を指定してください", rw.displayName())
+	}
+	if _, err := cascadia.Compile(rw.Selector); err != nil {
+		return errors.Errorf("書き換え規則 %s のセレクターが不正です: %s (%v)", rw.displayName(), rw.Selector, err)
+	}
+	if err := validatePathPatterns(rw.displayName(), rw.Paths); err != nil {
+		return err
+	}
+	switch rw.Action {
+	case RewriteRemove, RewriteUnwrap, RewriteText, RewriteCodeBlock:
+	case RewriteRename:
+		if rw.Tag == "" || strings.ContainsAny(rw.Tag, " \t\n<>/=\"'") {
+			return errors.Errorf("書き換え規則 %s の tag が不正です: %q", rw.displayName(), rw.Tag)
+		}
+	case RewriteSetAttr:
+		if rw.Attr == "" || strings.ContainsAny(rw.Attr, " \t\n<>/=\"'") {
+			return errors.Errorf("書き換え規則 %s の attr が不正です: %q", rw.displayName(), rw.Attr)
+		}
+	case RewriteAdmonition:
+		if rw.Kind != "" && !containsString(admonitionKinds, strings.ToLower(rw.Kind)) {
+			return errors.Errorf("書き換え規則 %s の注記の種類が不正です: %s (%sのいずれかを指定してください)", rw.displayName(), rw.Kind, strings.Join(admonitionKinds, ", "))
+		}
+	default:
+		return errors.Errorf("書き換え規則 %s の処理が不明です: %s (%s, %s, %s, %s, %s, %s, %sのいずれかを指定してください)", rw.displayName(), rw.Action,
+			RewriteRemove, RewriteUnwrap, RewriteRename, RewriteSetAttr, RewriteText, RewriteAdmonition, RewriteCodeBlock)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+//! 書き換え規則または置換規則の適用結果。
+type RewriteHit struct {
+	Name  string `json:"name"`  // 規則の名前。
+	Hits  int    `json:"hits"`  // 書き換えた要素または置換した箇所の数。
+	Pages int    `json:"pages"` // 書き換えた要素または置換した箇所があったページ数。
+}
+
+func (h *RewriteHit) String() string {
+	if h.Hits == 0 {
+		return fmt.Sprintf("%s: 一致なし", h.Name)
+	}
+	return fmt.Sprintf("%s: %d件 (%dページ)", h.Name, h.Hits, h.Pages)
+}
+
+//! 書き換え規則をコンパイルしたもの。ページごとの適用数を並行して集計する。
+type compiledRewrite struct {
+	Rewrite
+	matcher cascadia.Selector
+	hits    atomic.Int64
+	pages   atomic.Int64
+}
+
+//! ページに適用する場合にtrueを返す。
+func (rw *compiledRewrite) appliesTo(pageRel string) bool {
+	return matchPaths(rw.Paths, pageRel)
+}
+
+//! 書き換え規則を順に文書に適用し、規則の名前 → 書き換えた要素の数を返す。pageRelは規則のパスの判定に使う入力の相対パス。
+//! 適用数は集計しないため、ページの出力が決まった後にAddRewriteHitsで加える。
+func (c *Converter) Rewrite(doc *goquery.Document, pageRel string) map[string]int {
+	var hits map[string]int
+	for _, rw := range c.rewrites {
+		if !rw.appliesTo(pageRel) {
+			continue
+		}
+		matched := doc.FindMatcher(rw.matcher)
+		if matched.Length() == 0 {
+			continue
+		}
+		matched.Each(func(_ int, sel *goquery.Selection) {
+			rw.apply(sel)
+		})
+		if hits == nil {
+			hits = map[string]int{}
+		}
+		hits[rw.displayName()] += matched.Length()
+	}
+	return hits
+}
+
+//! 1ページ分の書き換え規則の適用数を集計に加える。hitsは規則の名前 → 書き換えた要素の数。
+//! 同じ名前の規則が複数ある場合は、最初の規則に加える。
+func (c *Converter) AddRewriteHits(hits map[string]int) {
+	for name, count := range hits {
+		for _, rw := range c.rewrites {
+			if rw.displayName() == name {
+				rw.hits.Add(int64(count))
+				rw.pages.Add(1)
+				break
+			}
+		}
+	}
+}
+
+//! 1つの要素を書き換える。
+func (rw *compiledRewrite) apply(sel *goquery.Selection) {
+	switch rw.Action {
+	case RewriteRemove:
+		sel.Remove()
+	case RewriteUnwrap:
+		unwrapElement(sel)
+	case RewriteRename:
+		renameElement(sel.Get(0), rw.Tag)
+	case RewriteSetAttr:
+		sel.SetAttr(rw.Attr, rw.Value)
+	case RewriteText:
+		text := strings.ReplaceAll(rw.Text, "{text}", strings.TrimSpace(sel.Text()))
+		sel.ReplaceWithNodes(&html.Node{Type: html.TextNode, Data: text})
+	case RewriteAdmonition:
+		kind := rw.Kind
+		if kind == "" {
+			kind = "note"
+		}
+		quote := &html.Node{Type: html.ElementNode, Data: "blockquote", DataAtom: atom.Blockquote,
+			Attr: []html.Attribute{{Key: admonitionAttr, Val: strings.ToUpper(kind)}}}
+		sel.BeforeNodes(quote)
+		goquery.NewDocumentFromNode(quote).AppendSelection(sel.Contents())
+		sel.Remove()
+	case RewriteCodeBlock:
+		code := &html.Node{Type: html.ElementNode, Data: "code", DataAtom: atom.Code}
+		if rw.Language != "" {
+			code.Attr = []html.Attribute{{Key: "class", Val: "language-" + rw.Language}}
+		}
+		code.AppendChild(&html.Node{Type: html.TextNode, Data: strings.TrimRight(sel.Text(), "\n")})
+		pre := &html.Node{Type: html.ElementNode, Data: "pre", DataAtom: atom.Pre}
+		pre.AppendChild(code)
+		sel.ReplaceWithNodes(pre)
+	}
+}
+
+//! 要素のタグを除いて、内容だけを元の位置に残す。
+func unwrapElement(sel *goquery.Selection) {
+	sel.ReplaceWithSelection(sel.Contents())
+}
+
+//! 要素のタグ名を変える。属性と内容はそのまま残す。
+func renameElement(node *html.Node, tag string) {
+	node.Data = tag
+	node.DataAtom = atom.Lookup([]byte(tag))
+}
+
+//! 注記にしたblockquoteに付ける属性。値は注記の種類。
+const admonitionAttr = "data-html2md-admonition"
+
+//! 注記にしたblockquoteを、GitHubのアラートの記法に変換するmd.Rule。
+//! 種類の行をテキストとして出力するとhtml-to-markdownが[]をエスケープするため、blockquote全体をここで変換する。
+func admonitionRule() md.Rule {
+	return md.Rule{
+		Filter: []string{"blockquote"},
+		Replacement: func(content string, sel *goquery.Selection, opt *md.Options) *string {
+			kind, ok := sel.Attr(admonitionAttr)
+			if !ok {
+				return nil
+			}
+			markdown := "\n\n> [!" + kind + "]\n" + quoteLines(content) + "\n\n"
+			return &markdown
+		},
+	}
+}
+
+//! AddRewriteHitsで集計した書き換え規則の適用結果を、指定された順に返す。一致しなかった規則も含める。
+func (c *Converter) RewriteHits() []*RewriteHit {
+	hits := make([]*RewriteHit, len(c.rewrites))
+	for i, rw := range c.rewrites {
+		hits[i] = &RewriteHit{Name: rw.displayName(), Hits: int(rw.hits.Load()), Pages: int(rw.pages.Load())}
+	}
+	return hits
+}
+
+//! 書き換え規則の一覧を、前回の変換内容との比較に使う文字列にする。
+func rewritesHash(rewrites []Rewrite) string {
+	var b strings.Builder
+	for _, rw := range rewrites {
+		fmt.Fprintf(&b, "%q;", []string{rw.Name, rw.Selector, strings.Join(rw.Paths, ","), rw.Action, rw.Tag, rw.Attr, rw.Value, rw.Text, rw.Kind, rw.Language})
+	}
+	return b.String()
+}
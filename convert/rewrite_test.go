@@ -0,0 +1,96 @@
+package convert
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRewriteActions(t *testing.T) {
+	tests := []struct {
+		rewrite Rewrite
+		html    string
+		want    string
+	}{
+		{Rewrite{Selector: ".ad", Action: RewriteRemove}, `<p>a</p><div class="ad">ad</div>`, "a"},
+		{Rewrite{Selector: "em", Action: RewriteUnwrap}, `<p>a <em>b</em> c</p>`, "a b c"},
+		{Rewrite{Selector: "span.k", Action: RewriteRename, Tag: "strong"}, `<p>a <span class="k">b</span></p>`, "a **b**"},
+		{Rewrite{Selector: "a", Action: RewriteSetAttr, Attr: "href", Value: "https://example.com/"}, `<p><a href="x.html">x</a></p>`, "[x](https://example.com/)"},
+		{Rewrite{Selector: "span.v", Action: RewriteText, Text: "v{text}"}, `<p>ver <span class="v"> 1.0 </span></p>`, "ver v1.0"},
+		{Rewrite{Selector: "div.note", Action: RewriteAdmonition, Kind: "warning"}, `<div class="note"><p>careful</p></div>`, "> [!WARNING]\n> careful"},
+		{Rewrite{Selector: "div.src", Action: RewriteCodeBlock, Language: "go"}, `<div class="src">x := 1</div>`, "```go\nx := 1\n```"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Rewrites = []Rewrite{tt.rewrite}
+		page, err := Document(strings.NewReader(tt.html), "a.html", opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.rewrite.Action, err)
+			continue
+		}
+		if page.Markdown != tt.want {
+			t.Errorf("%s: markdown = %q, want %q", tt.rewrite.Action, page.Markdown, tt.want)
+		}
+		if page.Rewrites[tt.rewrite.Selector] != 1 {
+			t.Errorf("%s: rewrites = %v, want 1 hit", tt.rewrite.Action, page.Rewrites)
+		}
+	}
+}
+
+//! 書き換え規則は指定した順に適用し、後の規則は前の規則で書き換えた後のDOMに適用する。
+func TestRewriteOrder(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Rewrites = []Rewrite{
+		{Name: "rename", Selector: "span.k", Action: RewriteRename, Tag: "em"},
+		{Name: "unwrap", Selector: "em", Action: RewriteUnwrap},
+	}
+	page, err := Document(strings.NewReader(`<p>x <span class="k">a</span> and <em>b</em></p>`), "a.html", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Markdown != "x a and b" {
+		t.Errorf("markdown = %q, want %q", page.Markdown, "x a and b")
+	}
+	if want := map[string]int{"rename": 1, "unwrap": 2}; !reflect.DeepEqual(page.Rewrites, want) {
+		t.Errorf("rewrites = %v, want %v", page.Rewrites, want)
+	}
+}
+
+//! 適用数はページの変換を省略した場合も前回の記録から数え、規則の名前を変えた場合は新しい名前で数え直す。
+func TestRewriteHits(t *testing.T) {
+	dir := t.TempDir()
+	inputDir, outputDir := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	writeTestFile(t, filepath.Join(inputDir, "a.html"), `<p><span class="k">1</span> <span class="k">2</span></p>`)
+	writeTestFile(t, filepath.Join(inputDir, "b.html"), `<p><span class="k">3</span></p>`)
+	writeTestFile(t, filepath.Join(inputDir, "c.html"), `<p>c</p>`)
+	opts := DefaultOptions()
+	opts.Mode = ModeSync
+
+	steps := []struct {
+		name      string
+		rewrites  []Rewrite
+		converted int
+		want      []*RewriteHit
+	}{
+		{"first", []Rewrite{{Name: "key", Selector: "span.k", Action: RewriteUnwrap}, {Name: "none", Selector: "table", Action: RewriteRemove}},
+			3, []*RewriteHit{{Name: "key", Hits: 3, Pages: 2}, {Name: "none"}}},
+		{"unchanged", []Rewrite{{Name: "key", Selector: "span.k", Action: RewriteUnwrap}, {Name: "none", Selector: "table", Action: RewriteRemove}},
+			0, []*RewriteHit{{Name: "key", Hits: 3, Pages: 2}, {Name: "none"}}},
+		{"renamed", []Rewrite{{Name: "kbd", Selector: "span.k", Action: RewriteUnwrap}, {Name: "none", Selector: "table", Action: RewriteRemove}},
+			3, []*RewriteHit{{Name: "kbd", Hits: 3, Pages: 2}, {Name: "none"}}},
+	}
+	for _, step := range steps {
+		opts.Rewrites = step.rewrites
+		result, err := Tree(t.Context(), inputDir, outputDir, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if result.Converted != step.converted {
+			t.Errorf("%s: converted %d, want %d", step.name, result.Converted, step.converted)
+		}
+		if !reflect.DeepEqual(result.Rewrites, step.want) {
+			t.Errorf("%s: rewrites = %v, want %v", step.name, result.Rewrites, step.want)
+		}
+	}
+}
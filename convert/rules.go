@@ -0,0 +1,314 @@
+package convert
+
+import (
+	"fmt"
+	"html"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	md "github.com/JohannesKaufmann/html-to-markdown"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/pkg/errors"
+)
+
+//! 規則に一致した要素をMarkdownに変換する関数。contentは子要素を変換したMarkdown、selは一致した要素。
+//! falseを返すと、この規則は適用せず、先に登録された規則またはhtml-to-markdownの組み込みの変換を行う。
+type RuleFunc func(content string, sel *goquery.Selection) (string, bool)
+
+//! HTML要素の変換規則。CSSセレクターに一致した要素を、html-to-markdownの変換の代わりにConvertで変換する。
+//! 1つの要素に複数の規則が一致した場合は、後に指定した規則を優先する。
+type Rule struct {
+	Name     string   // 規則の名前。同じ名前の規則は後から指定したものに置き換わる。
+	Selector string   // 対象の要素のCSSセレクター。
+	Paths    []string // 適用するページの、入力の相対パスのglob。**は任意の階層に一致する。空の場合はすべてのページ。
+	Version  string   // 変換内容の識別子。Convertの処理を変えた場合に変更すると、sync時に前回の変換内容を使わず変換し直す。
+	Convert  RuleFunc // 変換する関数。nilの場合は、同じ名前の規則を無効にする。
+}
+
+//! 組み込みの変換規則。Options.Rulesに同じ名前の規則を指定すると置き換えられ、Convertがnilの規則を指定すると無効になる。
+//! html-to-markdownの組み込みの変換も、そのタグを対象にした規則で置き換えられる。
+func BuiltinRules() []Rule {
+	return []Rule{
+		{
+			// html-to-markdownはkbdをインラインコードにするため、キー入力であることが分かるようタグのまま残す。
+			// テキストはエスケープし、<や&を含むキー名がHTMLとして解釈されないようにする。
+			Name:     "kbd",
+			Selector: "kbd",
+			Version:  "2",
+			Convert: func(content string, sel *goquery.Selection) (string, bool) {
+				text := strings.TrimSpace(sel.Text())
+				if text == "" {
+					return "", true
+				}
+				return "<kbd>" + html.EscapeString(text) + "</kbd>", true
+			},
+		},
+	}
+}
+
+//! 組み込みの規則にoptsの規則を反映した、適用する規則の一覧を返す。
+func (o *Options) effectiveRules() []Rule {
+	rules := BuiltinRules()
+	for _, rule := range o.Rules {
+		replaced := false
+		for i := range rules {
+			if rule.Name != "" && rules[i].Name == rule.Name {
+				rules[i] = rule
+				replaced = true
+			}
+		}
+		if !replaced {
+			rules = append(rules, rule)
+		}
+	}
+	effective := rules[:0]
+	for _, rule := range rules {
+		if rule.Convert != nil {
+			effective = append(effective, rule)
+		}
+	}
+	return effective
+}
+
+//! 規則の設定を検証する。
+func validateRule(rule Rule) error {
+	if rule.Convert == nil {
+		return nil
+	}
+	if _, err := cascadia.Compile(rule.Selector); err != nil {
+		return errors.Errorf("規則 %s のセレクターが不正です: %s (%v)", rule.Name, rule.Selector, err)
+	}
+	return validatePathPatterns(rule.Name, rule.Paths)
+}
+
+//! 規則のパスのglobを検証する。nameはエラーメッセージに使う規則の名前。
+func validatePathPatterns(name string, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return errors.Errorf("規則 %s のパスのパターンが不正です: %s", name, pattern)
+		}
+	}
+	return nil
+}
+
+//! パスがglobのパターンに一致するかどうかを返す。path.Matchに加えて、**は0個以上の任意の階層に一致する。
+func MatchGlob(pattern, name string) bool {
+	return matchGlobParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+//! 規則を適用する要素に付ける属性。適用する規則の番号を優先順に空白区切りで持つ。
+//! html-to-markdownは規則を適用しない場合に子要素を変換し直すため、適用後も属性は残す。
+const ruleMarkerAttr = "data-html2md-rules"
+
+//! 変換規則をコンパイルしたもの。
+type compiledRule struct {
+	Rule
+	matcher cascadia.Selector
+}
+
+//! HTMLをMarkdownに変換するコンバーター。html-to-markdownのコンバーターに変換規則を組み込む。
+//! 1回の実行で共有し、並行して呼び出せる。
+type Converter struct {
+	md       *md.Converter
+	rules    []*compiledRule
+	rewrites []*compiledRewrite
+	plugins  []*pluginRunner
+	scripts  []*scriptRunner
+	replaces []*compiledReplace
+
+	background *BackgroundRuns // 時間切れで結果を捨てたあとも実行中の変換。
+
+	mu   sync.Mutex
+	tags map[string]bool // 規則を振り分けるmd.Ruleを登録済みのタグ名。
+}
+
+//! optsの変換規則・書き換え規則・プラグイン・スクリプト・置換規則を組み込んだコンバーターを作成する。
+//! プラグインのプロセスは最初に使う時に起動するため、使い終えたらCloseを呼ぶこと。
+func NewConverter(opts *Options) (*Converter, error) {
+	c := &Converter{md: md.NewConverter("", true, nil), background: NewBackgroundRuns(opts.Jobs), tags: map[string]bool{}}
+	c.md.AddRules(admonitionRule())
+	for _, rw := range opts.Rewrites {
+		if err := validateRewrite(rw); err != nil {
+			return nil, err
+		}
+		matcher, _ := cascadia.Compile(rw.Selector)
+		c.rewrites = append(c.rewrites, &compiledRewrite{Rewrite: rw, matcher: matcher})
+	}
+	for _, p := range opts.Plugins {
+		if err := validatePlugin(p); err != nil {
+			return nil, err
+		}
+		c.plugins = append(c.plugins, &pluginRunner{Plugin: p})
+	}
+	for _, s := range opts.Scripts {
+		if err := validateScript(s); err != nil {
+			return nil, err
+		}
+		runner, err := newScriptRunner(s)
+		if err != nil {
+			return nil, err
+		}
+		c.scripts = append(c.scripts, runner)
+	}
+	for _, r := range opts.Replaces {
+		compiled, err := compileReplace(r)
+		if err != nil {
+			return nil, err
+		}
+		c.replaces = append(c.replaces, compiled)
+	}
+	for _, rule := range opts.effectiveRules() {
+		if rule.Convert == nil {
+			continue
+		}
+		matcher, err := cascadia.Compile(rule.Selector)
+		if err != nil {
+			return nil, errors.Errorf("規則 %s のセレクターが不正です: %s (%v)", rule.Name, rule.Selector, err)
+		}
+		c.rules = append(c.rules, &compiledRule{Rule: rule, matcher: matcher})
+	}
+	return c, nil
+}
+
+//! 時間切れで結果を捨てた変換が終わるまで待ってから、起動したプラグインのプロセスを終了する。
+func (c *Converter) Close() {
+	c.background.Wait()
+	for _, runner := range c.plugins {
+		runner.close()
+	}
+}
+
+//! 文書を変換する。pageRelは規則のパスの判定に使う入力の相対パス。
+func (c *Converter) Convert(doc *goquery.Document, pageRel string) string {
+	c.markRules(doc, pageRel)
+	return c.md.Convert(doc.Selection)
+}
+
+//! 規則に一致する要素に、適用する規則の番号を記録する。
+//! html-to-markdownはタグ名で変換を選ぶため、一致した要素のタグ名に規則を振り分けるmd.Ruleを登録する。
+func (c *Converter) markRules(doc *goquery.Document, pageRel string) {
+	for i := len(c.rules) - 1; i >= 0; i-- {
+		rule := c.rules[i]
+		if !rule.appliesTo(pageRel) {
+			continue
+		}
+		doc.FindMatcher(rule.matcher).Each(func(_ int, sel *goquery.Selection) {
+			marker := strconv.Itoa(i)
+			if existing, ok := sel.Attr(ruleMarkerAttr); ok {
+				marker = existing + " " + marker
+			}
+			sel.SetAttr(ruleMarkerAttr, marker)
+			c.registerTag(goquery.NodeName(sel))
+		})
+	}
+}
+
+//! 規則がページに適用されるかどうかを返す。
+func (rule *compiledRule) appliesTo(pageRel string) bool {
+	return matchPaths(rule.Paths, pageRel)
+}
+
+//! 入力の相対パスがいずれかのglobに一致するかどうかを返す。patternsが空の場合はすべてのパスに一致する。
+func matchPaths(patterns []string, pageRel string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if MatchGlob(pattern, pageRel) {
+			return true
+		}
+	}
+	return false
+}
+
+// html-to-markdownのcommonmarkの規則があるタグ。
+// それ以外のタグはmd.Ruleを登録すると既定の変換が使われなくなるため、規則を適用しない場合の変換も登録する。
+var commonmarkTags = map[string]bool{
+	"ul": true, "ol": true, "li": true, "#text": true, "p": true, "div": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"strong": true, "b": true, "i": true, "em": true, "img": true, "a": true,
+	"code": true, "kbd": true, "samp": true, "tt": true, "pre": true,
+	"hr": true, "br": true, "blockquote": true, "noscript": true,
+}
+
+// html-to-markdownが内容ごと除くタグ。
+var removedTags = map[string]bool{"script": true, "style": true, "textarea": true}
+
+//! タグ名に規則を振り分けるmd.Ruleを登録する。後から追加したmd.Ruleが優先されるため、組み込みの変換より先に呼ばれる。
+func (c *Converter) registerTag(tag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tags[tag] {
+		return
+	}
+	c.tags[tag] = true
+	if !commonmarkTags[tag] {
+		// html-to-markdownの既定の変換と同じく、内容だけを残すか、内容ごと除く。
+		c.md.AddRules(md.Rule{
+			Filter: []string{tag},
+			Replacement: func(content string, sel *goquery.Selection, opt *md.Options) *string {
+				if removedTags[tag] {
+					content = ""
+				}
+				return &content
+			},
+		})
+	}
+	c.md.AddRules(md.Rule{
+		Filter: []string{tag},
+		Replacement: func(content string, sel *goquery.Selection, opt *md.Options) *string {
+			return c.dispatch(content, sel)
+		},
+	})
+}
+
+//! 要素に記録された規則を優先順に適用する。適用する規則がなければnilを返し、組み込みの変換に任せる。
+func (c *Converter) dispatch(content string, sel *goquery.Selection) *string {
+	marker, ok := sel.Attr(ruleMarkerAttr)
+	if !ok {
+		return nil
+	}
+	for _, field := range strings.Fields(marker) {
+		i, err := strconv.Atoi(field)
+		if err != nil || i >= len(c.rules) {
+			continue
+		}
+		if markdown, ok := c.rules[i].Convert(content, sel); ok {
+			return &markdown
+		}
+	}
+	return nil
+}
+
+//! 規則の一覧を、前回の変換内容との比較に使う文字列にする。
+func rulesHash(rules []Rule) string {
+	var b strings.Builder
+	for _, rule := range rules {
+		fmt.Fprintf(&b, "%s|%s|%s|%s;", rule.Name, rule.Selector, strings.Join(rule.Paths, ","), rule.Version)
+	}
+	return b.String()
+}
@@ -0,0 +1,84 @@
+package convert
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+//! 内容を固定の文字列に変換する規則の関数を返す。
+func fixedRule(markdown string) RuleFunc {
+	return func(content string, sel *goquery.Selection) (string, bool) {
+		return markdown, true
+	}
+}
+
+func TestRules(t *testing.T) {
+	decline := func(content string, sel *goquery.Selection) (string, bool) { return "", false }
+	tests := []struct {
+		name  string
+		page  string
+		html  string
+		rules []Rule
+		want  string
+	}{
+		{"builtin kbd", "a.html", `<p>Press <kbd>a&lt;b</kbd></p>`, nil, "Press <kbd>a&lt;b</kbd>"},
+		{"disable builtin", "a.html", `<p>Press <kbd>Ctrl</kbd></p>`, []Rule{{Name: "kbd"}}, "Press `Ctrl`"},
+		{"replace builtin", "a.html", `<p>Press <kbd>Ctrl</kbd></p>`, []Rule{{Name: "kbd", Selector: "kbd", Convert: fixedRule("KEY")}}, "Press KEY"},
+		{"later rule wins", "a.html", `<p><span class="x">s</span></p>`, []Rule{
+			{Name: "a", Selector: "span", Convert: fixedRule("A")},
+			{Name: "b", Selector: "span.x", Convert: fixedRule("B")},
+		}, "B"},
+		{"declined rule falls back", "a.html", `<p><span class="x">s</span></p>`, []Rule{
+			{Name: "a", Selector: "span", Convert: fixedRule("A")},
+			{Name: "b", Selector: "span.x", Convert: decline},
+		}, "A"},
+		{"declined rule keeps default", "a.html", `<p><em>e</em></p>`, []Rule{{Name: "a", Selector: "em", Convert: decline}}, "_e_"},
+		{"unmatched element keeps content", "a.html", `<p>a <span class="x">x</span> and <span>y</span></p>`, []Rule{{Name: "a", Selector: "span.x", Convert: fixedRule("X")}}, "a X and y"},
+		{"path matches", "docs/sub/a.html", `<p><em>e</em></p>`, []Rule{{Name: "a", Selector: "em", Paths: []string{"docs/**"}, Convert: fixedRule("E")}}, "E"},
+		{"path does not match", "other/a.html", `<p><em>e</em></p>`, []Rule{{Name: "a", Selector: "em", Paths: []string{"docs/**"}, Convert: fixedRule("E")}}, "_e_"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Rules = tt.rules
+		page, err := Document(strings.NewReader(tt.html), tt.page, opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if page.Markdown != tt.want {
+			t.Errorf("%s: markdown = %q, want %q", tt.name, page.Markdown, tt.want)
+		}
+	}
+}
+
+func TestRulesInvalidSelector(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Rules = []Rule{{Name: "bad", Selector: "p[", Convert: fixedRule("")}}
+	if _, err := Document(strings.NewReader("<p>a</p>"), "a.html", opts); err == nil {
+		t.Error("err = nil, want an invalid selector error")
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.html", "a.html", true},
+		{"*.html", "docs/a.html", false},
+		{"docs/*.html", "docs/a.html", true},
+		{"docs/**", "docs/a/b/c.html", true},
+		{"docs/**", "docs", true},
+		{"**/a.html", "a.html", true},
+		{"**/a.html", "x/y/a.html", true},
+		{"docs/**/a.html", "docs/a.html", true},
+		{"docs/**/a.html", "other/a.html", false},
+	}
+	for _, tt := range tests {
+		if got := MatchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("MatchGlob(%q, %q) = %t, want %t", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
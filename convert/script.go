@@ -0,0 +1,395 @@
+package convert
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/dop251/goja"
+	"github.com/pkg/errors"
+)
+
+// スクリプトの1回の呼び出しの既定の制限時間。
+const DefaultScriptTimeout = 10 * time.Second
+
+//! JavaScriptによる変換のフック。組み込みのJavaScriptエンジンで実行するため、外部のプロセスを起動しない。
+//! スクリプトでは、次の関数を定義できる(どちらも省略できる)。
+//!   - beforeConvert(doc, page): Markdownに変換する前に呼ぶ。docはgoqueryに似たDOMの操作ができる。
+//!   - afterConvert(markdown, page): Markdownに変換した後に呼ぶ。文字列を返すと変換結果を置き換える。
+//!
+//! スクリプトからはファイルやネットワークにはアクセスできない。設定ファイルの[[script]]にも同じ項目で記述できる。
+type Script struct {
+	Name    string        `toml:"name"`    // スクリプトの名前。エラーメッセージに使う。省略時はファイル名。
+	File    string        `toml:"file"`    // スクリプトのファイル。Sourceが空の場合に読み込む。
+	Source  string        `toml:"-"`       // スクリプトの内容。
+	Paths   []string      `toml:"paths"`   // 適用するページの、入力の相対パスのglob。空の場合はすべてのページ。
+	Timeout time.Duration `toml:"timeout"` // 1ページの1回の呼び出しの制限時間。0の場合はDefaultScriptTimeout。
+}
+
+//! 報告とエラーメッセージに使うスクリプトの名前を返す。
+func (s *Script) displayName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	if s.File != "" {
+		return s.File
+	}
+	return "script"
+}
+
+//! スクリプトの内容を返す。Sourceが空の場合はFileを読み込む。
+func (s *Script) source() (string, error) {
+	if s.Source != "" || s.File == "" {
+		return s.Source, nil
+	}
+	data, err := os.ReadFile(s.File)
+	if err != nil {
+		return "", errors.Errorf("スクリプト %s の読み込みに失敗: %v", s.displayName(), err)
+	}
+	return string(data), nil
+}
+
+//! スクリプトの設定を検証する。構文の誤りはコンバーターの作成時に検出する。
+func validateScript(s Script) error {
+	if s.Source == "" && s.File == "" {
+		return errors.Errorf("スクリプト %s の file を指定してください", s.displayName())
+	}
+	if s.Timeout < 0 {
+		return errors.Errorf("スクリプト %s の timeout が負の値です: %v", s.displayName(), s.Timeout)
+	}
+	return validatePathPatterns(s.displayName(), s.Paths)
+}
+
+//! スクリプトを実行する環境。goja.Runtimeは並行して使えないため、ページを並列に変換する場合は複数作る。
+type scriptVM struct {
+	vm     *goja.Runtime
+	before goja.Callable // beforeConvert。定義されていなければnil。
+	after  goja.Callable // afterConvert。定義されていなければnil。
+}
+
+//! スクリプトの実行環境を管理する。空いている環境がなければ新しく作る。
+type scriptRunner struct {
+	Script
+	program *goja.Program
+
+	mu   sync.Mutex
+	idle []*scriptVM
+}
+
+//! スクリプトをコンパイルする。
+func newScriptRunner(s Script) (*scriptRunner, error) {
+	src, err := s.source()
+	if err != nil {
+		return nil, err
+	}
+	program, err := goja.Compile(s.displayName(), src, false)
+	if err != nil {
+		return nil, errors.Errorf("スクリプト %s の構文が不正です: %v", s.displayName(), err)
+	}
+	return &scriptRunner{Script: s, program: program}, nil
+}
+
+//! ページに適用する場合にtrueを返す。
+func (r *scriptRunner) appliesTo(pageRel string) bool {
+	return matchPaths(r.Paths, pageRel)
+}
+
+//! 空いている実行環境を取り出す。なければスクリプトを実行してフックを定義した環境を作る。
+func (r *scriptRunner) acquire() (*scriptVM, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		s := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return s, nil
+	}
+	r.mu.Unlock()
+
+	vm := goja.New()
+	vm.SetFieldNameMapper(goja.UncapFieldNameMapper())
+	vm.SetMaxCallStackSize(1024)
+	s := &scriptVM{vm: vm}
+	err := r.run(s, func() error {
+		_, err := vm.RunProgram(r.program)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.before, _ = goja.AssertFunction(vm.Get("beforeConvert"))
+	s.after, _ = goja.AssertFunction(vm.Get("afterConvert"))
+	return s, nil
+}
+
+//! 処理を終えた実行環境を空きに戻す。
+func (r *scriptRunner) release(s *scriptVM) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.idle = append(r.idle, s)
+}
+
+//! 制限時間を付けてfnを実行する。時間を過ぎた場合はスクリプトの実行を中断してエラーを返す。
+func (r *scriptRunner) run(s *scriptVM, fn func() error) error {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultScriptTimeout
+	}
+	fired := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		s.vm.Interrupt(errors.Errorf("制限時間 %v を過ぎました", timeout))
+		close(fired)
+	})
+	err := fn()
+	if !timer.Stop() {
+		// 終わる間際に中断を要求された場合も、使い回す環境に中断の要求を残さない。
+		<-fired
+		s.vm.ClearInterrupt()
+	}
+	if err != nil {
+		var interrupted *goja.InterruptedError
+		if errors.As(err, &interrupted) {
+			return errors.Errorf("スクリプト %s: %v", r.displayName(), interrupted.Value())
+		}
+		return errors.Errorf("スクリプト %s: %v", r.displayName(), err)
+	}
+	return nil
+}
+
+//! フックを呼び出す。中断されたなどで実行環境の状態が分からなくなった場合は、環境を使い回さない。
+func (r *scriptRunner) call(hook func(s *scriptVM) goja.Callable, page *Page, args func(vm *goja.Runtime) []goja.Value) (goja.Value, error) {
+	s, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	fn := hook(s)
+	if fn == nil {
+		r.release(s)
+		return nil, nil
+	}
+	pageObj := newScriptPage(s.vm, page)
+	var result goja.Value
+	err = r.run(s, func() error {
+		var err error
+		result, err = fn(goja.Undefined(), append(args(s.vm), pageObj)...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// page.frontMatterを別のオブジェクトに置き換えた場合も反映する。実行環境は他のページで使う前に読み出す。
+	frontMatter, ok := pageObj.Get("frontMatter").Export().(map[string]any)
+	r.release(s)
+	if !ok {
+		return nil, errors.Errorf("スクリプト %s: page.frontMatter はオブジェクトにしてください", r.displayName())
+	}
+	page.FrontMatter = frontMatter
+	return result, nil
+}
+
+//! スクリプトに渡すページの情報を作る。
+func newScriptPage(vm *goja.Runtime, page *Page) *goja.Object {
+	frontMatter := map[string]any{}
+	for key, value := range page.FrontMatter {
+		frontMatter[key] = value
+	}
+	obj := vm.NewObject()
+	obj.Set("source", page.Source)
+	obj.Set("output", page.Output)
+	obj.Set("title", page.Title)
+	obj.Set("frontMatter", frontMatter)
+	obj.Set("warn", func(message string) {
+		page.Warnings = append(page.Warnings, message)
+	})
+	return obj
+}
+
+//! ページに適用するスクリプトのbeforeConvertを順に呼び出す。
+func (c *Converter) runBeforeScripts(doc *goquery.Document, page *Page) error {
+	for _, runner := range c.scripts {
+		if !runner.appliesTo(page.Source) {
+			continue
+		}
+		_, err := runner.call(func(s *scriptVM) goja.Callable { return s.before }, page, func(vm *goja.Runtime) []goja.Value {
+			return []goja.Value{vm.ToValue(newScriptSelection(doc.Selection))}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//! ページに適用するスクリプトのafterConvertを順に呼び出し、書き換えたMarkdownを返す。
+func (c *Converter) runAfterScripts(markdown string, page *Page) (string, error) {
+	for _, runner := range c.scripts {
+		if !runner.appliesTo(page.Source) {
+			continue
+		}
+		result, err := runner.call(func(s *scriptVM) goja.Callable { return s.after }, page, func(vm *goja.Runtime) []goja.Value {
+			return []goja.Value{vm.ToValue(markdown)}
+		})
+		if err != nil {
+			return "", err
+		}
+		if result == nil || goja.IsUndefined(result) || goja.IsNull(result) {
+			continue
+		}
+		if _, ok := result.Export().(string); !ok {
+			return "", errors.Errorf("スクリプト %s: afterConvert は文字列を返してください", runner.displayName())
+		}
+		markdown = result.String()
+	}
+	return markdown, nil
+}
+
+//! スクリプトの一覧を、前回の変換内容との比較に使う文字列にする。スクリプトの内容が変わった場合も変換し直すため、内容を含める。
+func scriptsHash(scripts []Script) string {
+	var b strings.Builder
+	for _, s := range scripts {
+		src, _ := s.source()
+		fmt.Fprintf(&b, "%q;", []string{s.displayName(), src, strings.Join(s.Paths, ",")})
+	}
+	return b.String()
+}
+
+//! スクリプトに渡すDOMの要素の集合。goqueryのSelectionの操作の一部を、先頭を小文字にした名前で提供する。
+//! 値を設定する操作は、続けて操作できるよう自身を返す。
+type scriptSelection struct {
+	Length int // 要素の数。
+
+	sel *goquery.Selection
+}
+
+func newScriptSelection(sel *goquery.Selection) *scriptSelection {
+	return &scriptSelection{Length: sel.Length(), sel: sel}
+}
+
+// 要素の検索と絞り込み。
+
+func (s *scriptSelection) Find(selector string) *scriptSelection {
+	return newScriptSelection(s.sel.Find(selector))
+}
+func (s *scriptSelection) Filter(selector string) *scriptSelection {
+	return newScriptSelection(s.sel.Filter(selector))
+}
+func (s *scriptSelection) Is(selector string) bool { return s.sel.Is(selector) }
+func (s *scriptSelection) Parent() *scriptSelection {
+	return newScriptSelection(s.sel.Parent())
+}
+func (s *scriptSelection) Children() *scriptSelection {
+	return newScriptSelection(s.sel.Children())
+}
+func (s *scriptSelection) First() *scriptSelection { return newScriptSelection(s.sel.First()) }
+func (s *scriptSelection) Last() *scriptSelection  { return newScriptSelection(s.sel.Last()) }
+func (s *scriptSelection) Eq(i int) *scriptSelection {
+	return newScriptSelection(s.sel.Eq(i))
+}
+
+//! 要素ごとにfn(i, el)を呼び出す。
+func (s *scriptSelection) Each(fn func(int, *scriptSelection)) *scriptSelection {
+	s.sel.Each(func(i int, sel *goquery.Selection) {
+		fn(i, newScriptSelection(sel))
+	})
+	return s
+}
+
+// 要素の内容と属性。
+
+//! 先頭の要素のタグ名を返す。
+func (s *scriptSelection) Tag() string { return goquery.NodeName(s.sel) }
+
+//! 引数がなければテキストを返し、あればテキストに置き換える。
+func (s *scriptSelection) Text(value ...string) any {
+	if len(value) == 0 {
+		return s.sel.Text()
+	}
+	s.sel.SetText(value[0])
+	return s
+}
+
+//! 引数がなければ先頭の要素の内側のHTMLを返し、あれば内側のHTMLを置き換える。
+func (s *scriptSelection) Html(value ...string) any {
+	if len(value) == 0 {
+		html, _ := s.sel.Html()
+		return html
+	}
+	s.sel.SetHtml(value[0])
+	return s
+}
+
+//! 先頭の要素自身を含むHTMLを返す。
+func (s *scriptSelection) OuterHtml() string {
+	html, _ := goquery.OuterHtml(s.sel)
+	return html
+}
+
+//! valueがなければ先頭の要素の属性の値を返し(属性がなければnull)、あれば属性を設定する。
+func (s *scriptSelection) Attr(name string, value ...string) any {
+	if len(value) == 0 {
+		if v, ok := s.sel.Attr(name); ok {
+			return v
+		}
+		return nil
+	}
+	s.sel.SetAttr(name, value[0])
+	return s
+}
+func (s *scriptSelection) RemoveAttr(name string) *scriptSelection {
+	s.sel.RemoveAttr(name)
+	return s
+}
+func (s *scriptSelection) HasClass(class string) bool { return s.sel.HasClass(class) }
+func (s *scriptSelection) AddClass(class string) *scriptSelection {
+	s.sel.AddClass(class)
+	return s
+}
+func (s *scriptSelection) RemoveClass(class string) *scriptSelection {
+	s.sel.RemoveClass(class)
+	return s
+}
+
+// DOMの書き換え。
+
+func (s *scriptSelection) Remove() *scriptSelection {
+	s.sel.Remove()
+	return s
+}
+
+//! タグを除いて内容だけを残す。
+func (s *scriptSelection) Unwrap() *scriptSelection {
+	s.sel.Each(func(_ int, sel *goquery.Selection) {
+		unwrapElement(sel)
+	})
+	return s
+}
+
+//! タグ名を変える。属性と内容はそのまま残す。
+func (s *scriptSelection) Rename(tag string) *scriptSelection {
+	for _, node := range s.sel.Nodes {
+		renameElement(node, tag)
+	}
+	return s
+}
+func (s *scriptSelection) ReplaceWith(html string) *scriptSelection {
+	s.sel.ReplaceWithHtml(html)
+	return s
+}
+func (s *scriptSelection) Before(html string) *scriptSelection {
+	s.sel.BeforeHtml(html)
+	return s
+}
+func (s *scriptSelection) After(html string) *scriptSelection {
+	s.sel.AfterHtml(html)
+	return s
+}
+func (s *scriptSelection) Append(html string) *scriptSelection {
+	s.sel.AppendHtml(html)
+	return s
+}
+func (s *scriptSelection) Prepend(html string) *scriptSelection {
+	s.sel.PrependHtml(html)
+	return s
+}
@@ -0,0 +1,84 @@
+package convert
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+func TestScripts(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"before", `function beforeConvert(doc, page) { doc.find(".ad").remove(); doc.find("span").rename("em"); }`, "a _b_"},
+		{"after", `function afterConvert(markdown, page) { return markdown + "\n\n" + page.source; }`, "a b\n\nad\n\na.html"},
+		{"front matter", `function afterConvert(markdown, page) { page.frontMatter.title = page.title; }`, "---\ntitle: \"a\"\n---\n\na b\n\nad"},
+		{"warn", `function beforeConvert(doc, page) { page.warn("checked " + doc.find("span").length); }`, "a b\n\nad"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Scripts = []Script{{Name: tt.name, Source: tt.source}}
+		page, err := Document(strings.NewReader(`<p>a <span>b</span></p><div class="ad">ad</div>`), "a.html", opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if page.Markdown != tt.want {
+			t.Errorf("%s: markdown = %q, want %q", tt.name, page.Markdown, tt.want)
+		}
+		if tt.name == "warn" && (len(page.Warnings) != 1 || page.Warnings[0] != "checked 1") {
+			t.Errorf("%s: warnings = %v, want [checked 1]", tt.name, page.Warnings)
+		}
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"timeout", `function afterConvert(markdown) { for (;;) {} }`, "スクリプト timeout: 制限時間 100ms を過ぎました"},
+		{"throw", `function afterConvert(markdown) { throw new Error("boom"); }`, "スクリプト throw: Error: boom"},
+		{"result", `function afterConvert(markdown) { return 1; }`, "スクリプト result: afterConvert は文字列を返してください"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Scripts = []Script{{Name: tt.name, Source: tt.source, Timeout: 100 * time.Millisecond}}
+		_, err := Document(strings.NewReader(`<p>a</p>`), "a.html", opts)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+//! 制限時間の間際に終わった呼び出しの後も、同じ実行環境で次のページを処理できる。
+func TestScriptReuseAfterNearTimeout(t *testing.T) {
+	runner, err := newScriptRunner(Script{Name: "s", Source: `function afterConvert(markdown) { return markdown + "!"; }`, Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := runner.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// スクリプトを実行せずに制限時間を過ごし、中断の要求が実行環境に残る状況を作る。
+	if err := runner.run(s, func() error { time.Sleep(50 * time.Millisecond); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	runner.release(s)
+
+	result, err := runner.call(func(s *scriptVM) goja.Callable { return s.after }, &Page{Source: "a.html"}, func(vm *goja.Runtime) []goja.Value {
+		return []goja.Value{vm.ToValue("a")}
+	})
+	if err != nil {
+		t.Fatalf("call after a near-timeout run: %v", err)
+	}
+	if result.String() != "a!" {
+		t.Errorf("result = %q, want %q", result.String(), "a!")
+	}
+}
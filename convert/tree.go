@@ -0,0 +1,384 @@
+package convert
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+//! srcディレクトリのHTMLをMarkdownに変換し、mdbook用のファイルとともにdstディレクトリに出力する。
+//! 変換結果は作業用ディレクトリに書き込み、成功した場合だけdstと入れ替えるため、失敗した場合は前回の出力がそのまま残る。
+//! 一部のファイルの処理に失敗した場合は、残りのファイルを出力してResult.Failedに記録する(opts.FailFastの場合はエラーを返す)。
+//! ctxがキャンセルされた場合は処理中のファイルの完了を待って中断し、opts.Resumeで再開できるよう作業用ディレクトリを残す。
+func Tree(ctx context.Context, src, dst string, opts Options) (*Result, error) {
+	inputDir := filepath.Clean(src)
+	outputDir := filepath.Clean(dst)
+	if info, err := os.Stat(inputDir); err != nil || !info.IsDir() {
+		return nil, errors.Errorf("入力ディレクトリが存在しません: %s", src)
+	}
+	if err := opts.validateDirs(inputDir, outputDir); err != nil {
+		return nil, err
+	}
+	result, err := TreeFrom(ctx, os.DirFS(inputDir), outputDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	result.InputDir = inputDir
+	return result, nil
+}
+
+//! Treeと同じく、srcのHTMLをMarkdownに変換してdstディレクトリに出力する。
+//! 入力はディレクトリに限らず、zipアーカイブや埋め込みファイルなど任意のfs.FSを使える。
+func TreeFrom(ctx context.Context, src fs.FS, dst string, opts Options) (*Result, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	policy, err := ParseNamingPolicy(opts.Naming)
+	if err != nil {
+		return nil, err
+	}
+	outputDir := filepath.Clean(dst)
+	if opts.OriginalsDir != "" {
+		if err := ValidateOutputDir(outputDir, opts.OriginalsDir); err != nil {
+			return nil, err
+		}
+	}
+	bookName := opts.BookName
+	if bookName == "" {
+		bookName = filepath.Base(outputDir)
+	}
+
+	// 再開する場合は、中断された実行の作業用ディレクトリにジャーナルが残っていれば続きから変換する。
+	optionsHash := OptionsHash(&opts)
+	var done map[string]JournalRecord
+	if opts.Resume {
+		if done = ReadJournal(StagingDir(outputDir), optionsHash); done != nil {
+			opts.logf("中断された変換を再開します。出力済みのファイル: %d件", len(done))
+		} else {
+			opts.logf("再開できる中断された変換がないため、最初から変換します。")
+		}
+	}
+	resume := done != nil
+
+	// 中断された実行の残骸を後始末する。
+	if err := RecoverInterruptedRun(outputDir, resume, opts.Logger); err != nil {
+		return nil, err
+	}
+
+	// sync時は前回の変換内容が残っていれば、変更のあったファイルだけを反映する。
+	var previous *BuildCache
+	if opts.Mode == ModeSync {
+		previous = LoadBuildCache(outputDir, optionsHash, opts.Logger)
+	}
+
+	// 差分だけを反映する場合は、前回の出力をハードリンクで作業用ディレクトリに複製してから書き換える。
+	staging, err := PrepareStaging(outputDir, opts.Mode, previous != nil, resume)
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		// 中断された場合は、再開できるよう作業用ディレクトリを残す。
+		if !committed && ctx.Err() == nil {
+			os.RemoveAll(staging)
+		}
+	}()
+	if previous != nil {
+		opts.logf("前回の変換内容をもとに差分だけを反映します: %s", outputDir)
+	}
+
+	// 出力を終えたファイルをジャーナルに記録する。
+	journal, err := OpenJournal(staging, optionsHash, done)
+	if err != nil {
+		return nil, err
+	}
+	defer journal.Close()
+
+	out := NewDiskFS(staging)
+	var originals OutputFS = out
+	if opts.Direct {
+		originals = nil
+		if opts.OriginalsDir != "" {
+			originals = NewDiskFS(opts.OriginalsDir)
+		}
+	}
+	result, err := BuildOutput(ctx, src, out, originals, bookName, policy, previous, journal, &opts)
+	if ctx.Err() != nil {
+		return nil, errors.Wrapf(ctx.Err(), "中断しました。作業用ディレクトリ: %s", staging)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 前回の変換内容がないsync時は、今回の出力にない隠しファイルとmdbookの生成物を引き継ぐ。
+	if opts.Mode == ModeSync && previous == nil {
+		if err := CarryOverPreserved(outputDir, staging); err != nil {
+			return nil, errors.Errorf("前回の出力の引き継ぎに失敗: %v", err)
+		}
+	}
+
+	if err := journal.Remove(staging); err != nil {
+		return nil, errors.Errorf("ジャーナルの削除に失敗: %v", err)
+	}
+	if err := CommitStaging(staging, outputDir, opts.Logger); err != nil {
+		return nil, err
+	}
+	committed = true
+
+	result.OutputDir = outputDir
+	return result, nil
+}
+
+//! srcのHTMLをMarkdownに変換し、mdbook用のファイルとともにdstに出力する。
+//! dstにはメモリ上やzipアーカイブなど任意のOutputFSを使えるが、前回の出力との差分の反映や中断からの再開は行わず、常にすべてのファイルを出力する。
+//! book.tomlのタイトルはopts.BookName、空の場合は"book"になる。元のHTMLファイルの保存先を分ける opts.OriginalsDir は指定できない。
+func TreeTo(ctx context.Context, src fs.FS, dst OutputFS, opts Options) (*Result, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.OriginalsDir != "" {
+		return nil, errors.Errorf("TreeTo では OriginalsDir は指定できません")
+	}
+	policy, err := ParseNamingPolicy(opts.Naming)
+	if err != nil {
+		return nil, err
+	}
+	bookName := opts.BookName
+	if bookName == "" {
+		bookName = "book"
+	}
+	result, err := BuildOutput(ctx, src, dst, dst, bookName, policy, nil, nil, &opts)
+	if ctx.Err() != nil {
+		return nil, errors.Wrapf(ctx.Err(), "中断しました")
+	}
+	return result, err
+}
+
+//! 入力を1回走査してManifestを作り、それに従ってoutへのコピー・変換・mdbook用ファイル生成を行う。
+//! originalsは元のHTMLファイルの保存先で、保存しない場合はnilでもよい。bookNameはbook.tomlのタイトルに使う名前。
+//! previousが前回の変換内容の場合は、内容と出力先が変わっていないファイルの出力を省略し、不要になった出力を削除する。
+//! 出力を終えたファイルはjournalに記録し、journalに出力済みと記録されているファイルは省略する。
+//! ctxがキャンセルされた場合は、処理中のファイルの完了を待ってから中断する。
+func BuildOutput(ctx context.Context, src fs.FS, out, originals OutputFS, bookName string, policy *NamingPolicy, previous *BuildCache, journal *Journal, opts *Options) (*Result, error) {
+	opts.logf("入力ディレクトリの走査を開始します...")
+	manifest, err := ScanInput(ctx, src, policy, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// 衝突解決の内容が変わるとリンク先も変わるため、全ページを変換し直す。
+	reuse := previous
+	if previous != nil && !previous.SameRenames(manifest.Plan.Renames) {
+		opts.logf("衝突解決の内容が前回と異なるため、全ファイルを変換します。")
+		reuse = nil
+	}
+
+	// 空のディレクトリも出力に残すため、ディレクトリを先に作成。
+	for _, entry := range manifest.Entries {
+		if entry.Kind != EntryDir {
+			continue
+		}
+		if err := out.MkdirAll(entry.Output); err != nil {
+			return nil, errors.Errorf("出力ディレクトリ作成エラー: %v", err)
+		}
+	}
+
+	// HTMLファイルの変換とファイルのコピーを並列に実行。出力先はファイルごとに異なるため、実行順によらず同じ結果になる。
+	files := manifest.Files()
+	opts.logf("HTMLファイル変換とファイルコピーを開始します... (並列数: %d)", ResolveJobs(opts.Jobs))
+	converter, err := NewConverter(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer converter.Close()
+	digests := newRuleDigests(opts)
+	var converted, copied, skipped atomic.Int64
+	var resultMu sync.Mutex
+	result := &Result{Pages: []*Page{}, Warnings: manifest.Warnings()}
+	err = RunParallel(ctx, opts.Jobs, len(files), func(i int) error {
+		entry := files[i]
+		err := RecoverPanic(opts.Logger, func() error {
+			// 前回から変わっていないと分かっているファイルは読み込まない。
+			hash, ok := reuse.KnownHash(entry, opts.ChangedPaths)
+			if !ok {
+				h, herr := HashEntry(src, entry, opts)
+				if herr != nil {
+					return herr
+				}
+				hash = h
+			}
+			entry.Hash = hash
+			if entry.Kind == EntryConvert {
+				entry.RulesHash = digests.PageHash(entry.Source)
+			}
+			if reuse.IsUpToDate(entry, out, originals, manifest.Paths) || journal.Done(entry, out, manifest.Paths) {
+				skipped.Add(1)
+				converter.AddRewriteHits(entry.Rewrites)
+				converter.AddReplaceHits(entry.Replaces)
+				if entry.Kind == EntryConvert {
+					resultMu.Lock()
+					result.Pages = append(result.Pages, &Page{Source: entry.Source, Output: entry.Output, Title: entry.Title, Skipped: true})
+					// 変換を省略したページも、前回の変換時の警告を報告する。
+					for _, message := range entry.Warnings {
+						result.Warnings = append(result.Warnings, &Warning{Source: entry.Source, Message: message})
+					}
+					resultMu.Unlock()
+				}
+				return nil
+			}
+			page, err := WriteEntry(ctx, src, out, originals, entry, manifest.Paths, converter, opts)
+			if err != nil {
+				return err
+			}
+			switch {
+			case entry.Kind != EntryConvert:
+				copied.Add(1)
+			case page.Limit == nil || page.Limit.Action != LimitActionSkip:
+				converted.Add(1)
+			}
+			if page != nil {
+				entry.RecordPage(page, manifest.Paths)
+				converter.AddRewriteHits(entry.Rewrites)
+				converter.AddReplaceHits(entry.Replaces)
+				for _, message := range page.Warnings {
+					opts.logf("警告: %s: %s", entry.Source, message)
+				}
+				resultMu.Lock()
+				result.Pages = append(result.Pages, page)
+				if page.Limit != nil {
+					result.Limited = append(result.Limited, page.Limit)
+				}
+				for _, message := range entry.Warnings {
+					result.Warnings = append(result.Warnings, &Warning{Source: entry.Source, Message: message})
+				}
+				resultMu.Unlock()
+			}
+			return journal.RecordFile(entry)
+		})
+		if err == nil {
+			return nil
+		}
+		failure := &FileError{Source: entry.Source, Err: err}
+		if opts.FailFast {
+			return failure
+		}
+		// 失敗したファイルは記録して、残りのファイルの処理を続ける。
+		// 次回のsyncで変換し直すよう、ハッシュは記録しない。
+		opts.logf("処理に失敗: %v", failure)
+		entry.Hash = ""
+		resultMu.Lock()
+		result.Failed = append(result.Failed, failure)
+		resultMu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Errorf("HTMLファイル変換に失敗: %v", err)
+	}
+	result.sort()
+
+	// 出力しなかったファイルは目次に載せない。
+	var missing []string
+	for _, failure := range result.Failed {
+		missing = append(missing, failure.Source)
+	}
+	for _, hit := range result.Limited {
+		if hit.Action == LimitActionSkip {
+			missing = append(missing, hit.Source)
+		}
+	}
+	if len(missing) > 0 {
+		manifest.DropMissingOutputs(missing, out)
+	}
+	if len(opts.Rewrites) > 0 {
+		result.Rewrites = converter.RewriteHits()
+	}
+	if len(opts.Replaces) > 0 {
+		result.Replaces = converter.ReplaceHits()
+	}
+	result.Converted = int(converted.Load())
+	result.Copied = int(copied.Load())
+	result.Skipped = int(skipped.Load())
+	if previous != nil {
+		opts.logf("変更のない%d件のファイルをスキップしました。", result.Skipped)
+		result.Removed, err = previous.RemoveStaleOutputs(manifest, out, originals, opts.Logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// mdbook用ファイル生成。目次に載るページの構成とタイトルが変わっていなければ省略する。
+	if previous.SummaryChanged(manifest, bookName, out) {
+		opts.logf("mdbook用ファイル生成を開始します...")
+		if err := GenerateMdBookFiles(out, bookName, manifest); err != nil {
+			return nil, errors.Errorf("mdbook用ファイル生成に失敗: %v", err)
+		}
+		result.SummaryUpdated = true
+	} else {
+		opts.logf("ページの構成とタイトルに変更がないため、mdbook用ファイルの生成を省略します。")
+	}
+
+	// 次回の差分反映のために変換内容を記録。
+	if err := SaveBuildCache(out, OptionsHash(opts), bookName, manifest); err != nil {
+		return nil, errors.Errorf("変換内容の記録に失敗: %v", err)
+	}
+	return result, nil
+}
+
+//! Manifestの1ファイル分を出力する。HTMLはMarkdownに変換して書き出し、変換結果を返す。それ以外はコピーしてnilを返す。
+//! originalsは元のHTMLファイルの保存先。
+//! HTMLがサイズ・DOMの深さ・変換時間の制限に達した場合はopts.LimitActionに従って処理し、Page.Limitに記録する。
+func WriteEntry(ctx context.Context, src fs.FS, out, originals OutputFS, entry *ManifestEntry, paths *PathMap, converter *Converter, opts *Options) (*Page, error) {
+	// HTML以外のファイルはそのままコピー。
+	if entry.Kind != EntryConvert {
+		return nil, CopyFromFS(src, entry.Source, out, entry.Output)
+	}
+
+	// 元のHTMLファイルを保存。
+	if entry.Original != "" {
+		if err := CopyFromFS(src, entry.Source, originals, entry.Original); err != nil {
+			return nil, errors.Errorf("元のHTMLファイルの保存に失敗: %v", err)
+		}
+	}
+
+	opts.logf("変換中: %s", entry.Source)
+	page := &Page{Source: entry.Source, Output: entry.Output, Title: entry.Title}
+	info, err := fs.Stat(src, entry.Source)
+	if err != nil {
+		return nil, errors.Errorf("HTMLファイル読み込みエラー: %v", err)
+	}
+	if hit := sizeLimitHit(info.Size(), opts); hit != nil && opts.LimitAction == LimitActionSkip {
+		// 出力しない場合は、巨大なファイルを読み込まずに済ませる。
+		hit.Source = entry.Source
+		opts.logf("制限に達しました: %v", hit)
+		page.Limit = hit
+	} else {
+		htmlContent, err := fs.ReadFile(src, entry.Source)
+		if err != nil {
+			return nil, errors.Errorf("HTMLファイル読み込みエラー: %v", err)
+		}
+		if err := convertPage(ctx, converter, htmlContent, page, paths, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if page.Limit != nil && page.Limit.Action == LimitActionSkip {
+		// 前回の出力が残っていれば削除する。
+		if err := out.Remove(entry.Output); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, errors.Errorf("前回の出力の削除に失敗: %v", err)
+		}
+		return page, nil
+	}
+
+	if err := WriteFile(out, entry.Output, []byte(page.Markdown)); err != nil {
+		return nil, errors.Errorf("Markdownファイル書き込みエラー: %v", err)
+	}
+	// ツリーの変換結果には内容を含めない。
+	page.Markdown = ""
+	opts.logf("変換完了: %s → %s", entry.Source, entry.Output)
+	return page, nil
+}
@@ -0,0 +1,119 @@
+package convert
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+//! 変換の入力。index.htmlはguide/以下の2ページと画像にリンクする。
+var treeTestInput = fstest.MapFS{
+	"index.html":          {Data: []byte(`<html><head><title>Top</title></head><body><h1>Top</h1><p><a href="guide/My%20Page.html">page</a> <a href="Guide/Setup.html#run">setup</a> <img src="img/Logo.png"></p></body></html>`)},
+	"guide/My Page.html":  {Data: []byte(`<p>See <a href="../index.html">top</a> and <a href="gone.html">gone</a>.</p>`)},
+	"guide/Setup.html":    {Data: []byte(`<pre><code>make</code></pre>`)},
+	"img/Logo.png":        {Data: []byte("png")},
+	"notes/readme.md":     {Data: []byte("# Notes\n")},
+	"empty/.gitkeep":      {Data: []byte{}},
+	"guide/_old_page.png": {Data: []byte("old")},
+}
+
+func TestTreeToMemoryFS(t *testing.T) {
+	out := NewMemoryFS()
+	opts := DefaultOptions()
+	result, err := TreeTo(t.Context(), treeTestInput, out, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Converted != 3 || len(result.Failed) != 0 {
+		t.Errorf("converted %d, failed %v; want 3, none", result.Converted, result.Failed)
+	}
+	if len(result.Warnings) != 1 || result.Warnings[0].Source != "guide/My Page.html" {
+		t.Errorf("warnings = %v, want the missing link in guide/My Page.html", result.Warnings)
+	}
+
+	files := map[string][]string{
+		"index.md":               {"[page](guide/my%20page.md)", "[setup](guide/setup.md#run)", "![](img/logo.png)"},
+		"guide/my page.md":       {"See [top](../index.md) and [gone](gone.md)."},
+		"guide/setup.md":         {"```\nmake\n```"},
+		"_index.html":            {"<title>Top</title>"},
+		"guide/_my page.html":    {`href="../index.html"`},
+		"img/logo.png":           {"png"},
+		"notes/readme.md":        {"# Notes"},
+		"empty/.gitkeep":         nil,
+		"guide/_old_page.png":    {"old"},
+		"SUMMARY.md":             {"[index](index.md)", "[my page](<guide/my page.md>)", "[readme](notes/readme.md)"},
+		"book.toml":              {"[book]"},
+		".html2md/manifest.json": {`"source": "guide/My Page.html"`},
+	}
+	var names []string
+	for name, wants := range files {
+		names = append(names, name)
+		data, err := fs.ReadFile(out, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		for _, want := range wants {
+			if !strings.Contains(string(data), want) {
+				t.Errorf("%s = %q, want it to contain %q", name, data, want)
+			}
+		}
+	}
+	// MemoryFSはfs.FSとして、書き込んだファイルとディレクトリを一覧できる。
+	if err := fstest.TestFS(out, names...); err != nil {
+		t.Error(err)
+	}
+	if _, err := fs.Stat(out, "guide/My Page.md"); err == nil {
+		t.Error("guide/My Page.md exists, want only the lower-cased name")
+	}
+}
+
+//! TreeToでメモリ上に出力した内容は、Treeでディスクに出力した内容と同じになる。
+func TestTreeToMatchesTree(t *testing.T) {
+	dir := t.TempDir()
+	inputDir, outputDir := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	for name, file := range treeTestInput {
+		writeTestFile(t, filepath.Join(inputDir, filepath.FromSlash(name)), string(file.Data))
+	}
+	opts := DefaultOptions()
+	opts.BookName = "book"
+	if _, err := Tree(t.Context(), inputDir, outputDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	out := NewMemoryFS()
+	if _, err := TreeTo(t.Context(), os.DirFS(inputDir), out, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	disk := os.DirFS(outputDir)
+	var onDisk []string
+	err := fs.WalkDir(disk, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." || d.IsDir() {
+			return err
+		}
+		onDisk = append(onDisk, name)
+		want, _ := fs.ReadFile(disk, name)
+		got, err := fs.ReadFile(out, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if string(got) != string(want) {
+			t.Errorf("%s differs:\nTreeTo: %q\nTree:   %q", name, got, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inMemory []string
+	for _, name := range out.Names() {
+		if info, err := fs.Stat(out, name); err == nil && !info.IsDir() {
+			inMemory = append(inMemory, name)
+		}
+	}
+	if strings.Join(inMemory, "\n") != strings.Join(onDisk, "\n") {
+		t.Errorf("files differ:\nTreeTo: %v\nTree:   %v", inMemory, onDisk)
+	}
+}
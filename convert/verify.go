@@ -0,0 +1,344 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/pkg/errors"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	mdhtml "github.com/yuin/goldmark/renderer/html"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// 変換の忠実度の既定のしきい値。これより類似度が低いページを報告する。
+const DefaultVerifyThreshold = 0.9
+
+// 欠けたテキストとして報告する断片の最大の文字数。
+const maxFragmentRunes = 80
+
+//! 変換の忠実度の確認の設定。
+type VerifyOptions struct {
+	Threshold *float64 // 報告する類似度のしきい値(0〜1)。nilの場合はDefaultVerifyThreshold。0を指定するとすべてのページがしきい値以上になる。
+	Selector  string   // 元のページで比べる本文の範囲のCSSセレクター。空の場合、または一致しない場合はbody全体。
+}
+
+//! 変換結果全体の忠実度。
+type VerifyResult struct {
+	Threshold float64         `json:"threshold"`        // 使ったしきい値。
+	Pages     []*PageFidelity `json:"pages"`            // 変換したページの忠実度。入力の相対パス順。
+	Failed    []*FileError    `json:"failed,omitempty"` // 確認できなかったページ。入力の相対パス順。
+}
+
+//! しきい値より類似度が低いページを返す。
+func (r *VerifyResult) BelowThreshold() []*PageFidelity {
+	var pages []*PageFidelity
+	for _, page := range r.Pages {
+		if page.Score < r.Threshold {
+			pages = append(pages, page)
+		}
+	}
+	return pages
+}
+
+//! 1ページの忠実度。欠けた要素は元のページにあり、変換後のMarkdownを描画したHTMLにないもの。
+type PageFidelity struct {
+	Source        string   `json:"source"`                   // 入力の相対パス。
+	Output        string   `json:"output"`                   // 出力の相対パス。
+	Score         float64  `json:"score"`                    // 元のページの見えるテキストのうち、変換後にも残っている割合(0〜1)。
+	WholePage     bool     `json:"whole_page,omitempty"`     // 本文の範囲のセレクターに一致せず、body全体と比べたかどうか。
+	MissingText   []string `json:"missing_text,omitempty"`   // 欠けたテキストの断片。ブロック要素ごとに区切る。
+	MissingCells  []string `json:"missing_cells,omitempty"`  // 欠けた表のセルのテキスト。
+	MissingImages []string `json:"missing_images,omitempty"` // 欠けた画像の参照先(出力後のパス)。
+	MissingLinks  []string `json:"missing_links,omitempty"`  // 欠けたリンク先(出力後のパス)。
+}
+
+//! 変換結果の各ページのMarkdownをCommonMark(GFM)でHTMLに描画し、元のHTMLページと見えるテキストを比べる。
+//! srcは変換した入力、outはその変換結果(ディレクトリまたはzipアーカイブ)で、変換内容の記録(.html2md/manifest.json)でページを対応付ける。
+//! 元のページには変換と同じくoptsの書き換え規則とスクリプトを適用してから、本文の範囲のテキストを取り出す。
+func VerifyOutput(ctx context.Context, src, out fs.FS, opts Options, verify VerifyOptions) (*VerifyResult, error) {
+	threshold := DefaultVerifyThreshold
+	if verify.Threshold != nil {
+		threshold = *verify.Threshold
+	}
+	if threshold < 0 || threshold > 1 {
+		return nil, errors.Errorf("しきい値は0から1の間で指定してください: %v", threshold)
+	}
+	var region cascadia.Selector
+	if verify.Selector != "" {
+		var err error
+		if region, err = cascadia.Compile(verify.Selector); err != nil {
+			return nil, errors.Errorf("本文の範囲のセレクターが不正です: %s (%v)", verify.Selector, err)
+		}
+	}
+	policy, err := ParseNamingPolicy(opts.Naming)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := ReadBuildCacheFS(out)
+	if err != nil {
+		return nil, errors.Errorf("変換結果の変換内容の記録を読み込めません: %v", err)
+	}
+	converter, err := NewConverter(&opts)
+	if err != nil {
+		return nil, err
+	}
+	defer converter.Close()
+
+	// リンク先を変換時と同じ出力後のパスに書き換えるため、記録から対応表を作る。
+	paths := NewPathMap(policy)
+	paths.checked = true
+	for _, entry := range cache.Entries {
+		if entry.Kind != EntryDir {
+			paths.add(entry.Source, entry.Output)
+		}
+	}
+	markdown := goldmark.New(
+		goldmark.WithExtensions(extension.GFM),
+		goldmark.WithRendererOptions(mdhtml.WithUnsafe()), // 変換結果に残ったHTMLも元のページの一部として比べる。
+	)
+
+	result := &VerifyResult{Threshold: threshold}
+	entries := append([]*ManifestEntry(nil), cache.Entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Source < entries[j].Source })
+	for _, entry := range entries {
+		if entry.Kind != EntryConvert {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, errors.Errorf("中断しました")
+		}
+		page, err := verifyPage(src, out, entry, converter, paths, markdown, region)
+		if err != nil {
+			result.Failed = append(result.Failed, &FileError{Source: entry.Source, Err: err})
+			continue
+		}
+		result.Pages = append(result.Pages, page)
+	}
+	return result, nil
+}
+
+//! 1ページの忠実度を求める。
+func verifyPage(src, out fs.FS, entry *ManifestEntry, converter *Converter, paths *PathMap, markdown goldmark.Markdown, region cascadia.Selector) (*PageFidelity, error) {
+	htmlContent, err := fs.ReadFile(src, entry.Source)
+	if err != nil {
+		return nil, errors.Errorf("入力を読み込めません: %v", err)
+	}
+	md, err := fs.ReadFile(out, entry.Output)
+	if err != nil {
+		return nil, errors.Errorf("変換結果を読み込めません: %v", err)
+	}
+
+	// 元のページは、変換時と同じく書き換え規則とスクリプトを適用してから比べる。
+	source, err := goquery.NewDocumentFromReader(bytes.NewReader(htmlContent))
+	if err != nil {
+		return nil, errors.Errorf("HTML解析エラー: %v", err)
+	}
+	converter.Rewrite(source, entry.Source)
+	if err := converter.runBeforeScripts(source, &Page{Source: entry.Source, Output: entry.Output, Title: entry.Title}); err != nil {
+		return nil, err
+	}
+	ConvertHtmlLinksToMd(source, entry.Source, paths)
+
+	var rendered bytes.Buffer
+	if err := markdown.Convert(md, &rendered); err != nil {
+		return nil, errors.Errorf("Markdownの描画に失敗: %v", err)
+	}
+	converted, err := goquery.NewDocumentFromReader(&rendered)
+	if err != nil {
+		return nil, errors.Errorf("描画したHTMLの解析に失敗: %v", err)
+	}
+
+	page := &PageFidelity{Source: entry.Source, Output: entry.Output}
+	content := source.Find("body")
+	if region != nil {
+		if sel := source.FindMatcher(region); sel.Length() > 0 {
+			content = sel
+		} else {
+			page.WholePage = true
+		}
+	}
+	target := converted.Find("body")
+
+	sourceFragments := visibleFragments(content)
+	convertedText := strings.Join(visibleFragments(target), " ")
+	page.Score = tokenRecall(textTokens(strings.Join(sourceFragments, " ")), textTokens(convertedText))
+	compacted := compactText(convertedText)
+	for _, fragment := range sourceFragments {
+		if !strings.Contains(compacted, compactText(fragment)) {
+			page.MissingText = append(page.MissingText, truncateRunes(fragment, maxFragmentRunes))
+		}
+	}
+	page.MissingCells = missingValues(cellTexts(content), cellTexts(target))
+	page.MissingImages = missingValues(attrValues(content, "img[src]", "src"), attrValues(target, "img[src]", "src"))
+	page.MissingLinks = missingValues(attrValues(content, "a[href]", "href"), attrValues(target, "a[href]", "href"))
+	return page, nil
+}
+
+//! 見えないテキストを持つ要素。
+var invisibleElements = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true, atom.Title: true,
+}
+
+//! テキストの断片を区切るブロック要素。
+var blockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true, atom.Br: true, atom.Caption: true,
+	atom.Dd: true, atom.Details: true, atom.Div: true, atom.Dl: true, atom.Dt: true, atom.Figcaption: true, atom.Figure: true,
+	atom.Footer: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Header: true, atom.Hr: true, atom.Li: true, atom.Main: true, atom.Nav: true, atom.Ol: true, atom.P: true,
+	atom.Pre: true, atom.Section: true, atom.Summary: true, atom.Table: true, atom.Td: true, atom.Th: true, atom.Tr: true,
+	atom.Ul: true,
+}
+
+//! 選択した要素の見えるテキストを、ブロック要素ごとの空白を詰めた断片にして文書順に返す。
+func visibleFragments(sel *goquery.Selection) []string {
+	var fragments []string
+	var current strings.Builder
+	flush := func() {
+		if text := strings.Join(strings.Fields(current.String()), " "); text != "" {
+			fragments = append(fragments, text)
+		}
+		current.Reset()
+	}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			current.WriteString(n.Data)
+			return
+		case html.ElementNode:
+			if invisibleElements[n.DataAtom] || hasAttr(n, "hidden") {
+				return
+			}
+		}
+		block := n.Type == html.ElementNode && blockElements[n.DataAtom]
+		if block {
+			flush()
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+		if block {
+			flush()
+		}
+	}
+	for _, n := range sel.Nodes {
+		walk(n)
+		flush()
+	}
+	return fragments
+}
+
+//! 要素が属性を持つかどうかを返す。
+func hasAttr(n *html.Node, key string) bool {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+//! 空白の違いを無視して比べるため、空白をすべて除いた文字列を返す。
+func compactText(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+//! 長い文字列を指定した文字数で切り詰める。
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + "…"
+}
+
+//! 類似度を求めるために、テキストを文字の2-gramに分ける。
+//! Markdownへの変換ではインライン要素の間の空白が増減するため、空白と記号を除き、英字を小文字にしてから分ける。
+func textTokens(s string) []string {
+	var runes []rune
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			runes = append(runes, unicode.ToLower(r))
+		}
+	}
+	if len(runes) == 1 {
+		return []string{string(runes)}
+	}
+	var tokens []string
+	for i := 0; i+1 < len(runes); i++ {
+		tokens = append(tokens, string(runes[i:i+2]))
+	}
+	return tokens
+}
+
+//! 元のテキストの2-gramのうち、変換後にも残っているものの割合を返す。同じ2-gramは出現回数まで数える。元のテキストが空の場合は1。
+func tokenRecall(source, converted []string) float64 {
+	if len(source) == 0 {
+		return 1
+	}
+	counts := map[string]int{}
+	for _, token := range converted {
+		counts[token]++
+	}
+	kept := 0
+	for _, token := range source {
+		if counts[token] > 0 {
+			counts[token]--
+			kept++
+		}
+	}
+	return float64(kept) / float64(len(source))
+}
+
+//! 表のセルの空でないテキストを文書順に返す。
+func cellTexts(sel *goquery.Selection) []string {
+	var cells []string
+	sel.Find("td, th").Each(func(_ int, cell *goquery.Selection) {
+		if text := strings.Join(strings.Fields(cell.Text()), " "); text != "" {
+			cells = append(cells, text)
+		}
+	})
+	return cells
+}
+
+//! 要素の属性の空でない値を文書順に返す。リンク先のエンコードの違いを無視するため、パーセントデコードする。
+func attrValues(sel *goquery.Selection, selector, attr string) []string {
+	var values []string
+	sel.Find(selector).Each(func(_ int, s *goquery.Selection) {
+		value := strings.TrimSpace(s.AttrOr(attr, ""))
+		if decoded, err := url.PathUnescape(value); err == nil {
+			value = decoded
+		}
+		if value != "" {
+			values = append(values, value)
+		}
+	})
+	return values
+}
+
+//! 元の値のうち、変換後の値にないものを文書順に返す。空白の違いは無視し、同じ値は1回だけ返す。
+func missingValues(source, converted []string) []string {
+	present := map[string]bool{}
+	for _, value := range converted {
+		present[compactText(value)] = true
+	}
+	var missing []string
+	reported := map[string]bool{}
+	for _, value := range source {
+		key := compactText(value)
+		if !present[key] && !reported[key] {
+			reported[key] = true
+			missing = append(missing, truncateRunes(value, maxFragmentRunes))
+		}
+	}
+	return missing
+}
@@ -0,0 +1,88 @@
+package convert
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+//! 確認する変換の入力。b.htmlの本文はmain要素の中にある。
+var verifyTestInput = fstest.MapFS{
+	"a.html": {Data: []byte(`<h1>Alpha</h1><p>first paragraph</p>`)},
+	"b.html": {Data: []byte(`<nav>menu</nav><main><h1>Title</h1><p>kept paragraph</p><p>dropped paragraph here</p><p><img src="Logo.png"> <a href="a.html">alpha</a></p></main>`)},
+}
+
+//! verifyTestInputを変換した後に、b.mdから段落と画像とリンクを取り除いた変換結果を返す。
+func verifyTestOutput(t *testing.T) *MemoryFS {
+	t.Helper()
+	out := NewMemoryFS()
+	if _, err := TreeTo(t.Context(), verifyTestInput, out, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(out, "b.md", []byte("# Title\n\nkept paragraph\n")); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestVerifyOutput(t *testing.T) {
+	out := verifyTestOutput(t)
+	zero, one, invalid := 0.0, 1.0, 1.5
+
+	tests := []struct {
+		name      string
+		verify    VerifyOptions
+		threshold float64
+		below     []string
+	}{
+		{"default", VerifyOptions{}, DefaultVerifyThreshold, []string{"b.html"}},
+		// しきい値0は既定値に置き換えず、どのページも報告しない。
+		{"zero", VerifyOptions{Threshold: &zero}, 0, nil},
+		{"one", VerifyOptions{Threshold: &one}, 1, []string{"b.html"}},
+	}
+	for _, tt := range tests {
+		result, err := VerifyOutput(t.Context(), verifyTestInput, out, DefaultOptions(), tt.verify)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if result.Threshold != tt.threshold {
+			t.Errorf("%s: threshold = %v, want %v", tt.name, result.Threshold, tt.threshold)
+		}
+		var below []string
+		for _, page := range result.BelowThreshold() {
+			below = append(below, page.Source)
+		}
+		if !reflect.DeepEqual(below, tt.below) {
+			t.Errorf("%s: below threshold = %v, want %v", tt.name, below, tt.below)
+		}
+	}
+
+	if _, err := VerifyOutput(t.Context(), verifyTestInput, out, DefaultOptions(), VerifyOptions{Threshold: &invalid}); err == nil {
+		t.Error("threshold 1.5: err = nil, want an error")
+	}
+}
+
+func TestVerifyPageFidelity(t *testing.T) {
+	out := verifyTestOutput(t)
+	result, err := VerifyOutput(t.Context(), verifyTestInput, out, DefaultOptions(), VerifyOptions{Selector: "main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Pages) != 2 || len(result.Failed) != 0 {
+		t.Fatalf("pages %d, failed %v; want 2, none", len(result.Pages), result.Failed)
+	}
+	a, b := result.Pages[0], result.Pages[1]
+	if a.Score != 1 || !a.WholePage || len(a.MissingText) != 0 || len(a.MissingImages) != 0 || len(a.MissingLinks) != 0 {
+		t.Errorf("a.html = %+v, want a faithful whole page", a)
+	}
+	if b.Score >= 1 || b.WholePage {
+		t.Errorf("b.html score = %v, whole page %t; want < 1 within main", b.Score, b.WholePage)
+	}
+	if !reflect.DeepEqual(b.MissingText, []string{"dropped paragraph here", "alpha"}) {
+		t.Errorf("b.html missing text = %q", b.MissingText)
+	}
+	if !reflect.DeepEqual(b.MissingImages, []string{"logo.png"}) || !reflect.DeepEqual(b.MissingLinks, []string{"a.md"}) {
+		t.Errorf("b.html missing images %v, links %v; want [logo.png], [a.md]", b.MissingImages, b.MissingLinks)
+	}
+}
@@ -0,0 +1,65 @@
+package convert
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+//! 並列数の指定を解決する。0以下の場合はCPU数を使う。
+func ResolveJobs(jobs int) int {
+	if jobs <= 0 {
+		return runtime.NumCPU()
+	}
+	return jobs
+}
+
+//! 0からn-1までの各インデックスについてfnを最大jobs個のゴルーチンで並列に実行する。
+//! エラーが発生すると新しいタスクの開始を止め、実行中のタスクの完了を待ってから、
+//! インデックスが最も小さいタスクのエラーを返す。
+//! ctxがキャンセルされた場合も新しいタスクの開始を止め、実行中のタスクの完了を待ってからctxのエラーを返す。
+func RunParallel(ctx context.Context, jobs, n int, fn func(i int) error) error {
+	jobs = ResolveJobs(jobs)
+	if jobs > n {
+		jobs = n
+	}
+
+	errs := make([]error, n)
+	indexes := make(chan int)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var wg sync.WaitGroup
+
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := fn(i); err != nil {
+					errs[i] = err
+					stopOnce.Do(func() { close(stop) })
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := 0; i < n; i++ {
+		select {
+		case indexes <- i:
+		case <-stop:
+			break dispatch
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
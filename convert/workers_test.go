@@ -0,0 +1,110 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunParallel(t *testing.T) {
+	tests := []struct {
+		jobs, n int
+	}{
+		{1, 10},
+		{4, 100},
+		{8, 3},
+		{0, 20},
+		{4, 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("jobs=%d,n=%d", tt.jobs, tt.n), func(t *testing.T) {
+			var running, peak atomic.Int64
+			results := make([]int, tt.n)
+			err := RunParallel(context.Background(), tt.jobs, tt.n, func(i int) error {
+				current := running.Add(1)
+				defer running.Add(-1)
+				for {
+					old := peak.Load()
+					if current <= old || peak.CompareAndSwap(old, current) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				results[i] = i * i
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 結果はインデックスごとに格納するため、実行順によらず入力の順になる。
+			for i, got := range results {
+				if got != i*i {
+					t.Errorf("results[%d] = %d, want %d", i, got, i*i)
+				}
+			}
+			if limit := int64(ResolveJobs(tt.jobs)); peak.Load() > limit {
+				t.Errorf("peak concurrency = %d, want <= %d", peak.Load(), limit)
+			}
+		})
+	}
+}
+
+//! 複数のタスクが失敗した場合は、完了順によらずインデックスが最も小さいタスクのエラーを返す。
+func TestRunParallelLowestError(t *testing.T) {
+	var mu sync.Mutex
+	var started []int
+	err := RunParallel(context.Background(), 4, 4, func(i int) error {
+		mu.Lock()
+		started = append(started, i)
+		mu.Unlock()
+		// インデックスが小さいタスクほど遅く失敗させる。
+		time.Sleep(time.Duration(4-i) * 5 * time.Millisecond)
+		if i == 0 || i == 2 {
+			return fmt.Errorf("task %d", i)
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "task 0" {
+		t.Errorf("err = %v, want task 0", err)
+	}
+}
+
+func TestRunParallelStopsAfterError(t *testing.T) {
+	var calls atomic.Int64
+	failure := errors.New("failure")
+	err := RunParallel(context.Background(), 1, 100, func(i int) error {
+		calls.Add(1)
+		if i == 3 {
+			return failure
+		}
+		return nil
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("err = %v, want %v", err, failure)
+	}
+	// 並列数1では、失敗したタスクの後に開始できるタスクは高々1件。
+	if got := calls.Load(); got > 5 {
+		t.Errorf("%d tasks ran, want at most 5", got)
+	}
+}
+
+func TestRunParallelCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls atomic.Int64
+	err := RunParallel(ctx, 2, 100, func(i int) error {
+		if calls.Add(1) == 5 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+	if got := calls.Load(); got == 100 {
+		t.Error("all tasks ran after cancel")
+	}
+}
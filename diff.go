@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/xcd0/html2md/convert"
+)
+
+//! diffサブコマンドを実行する。2つの変換結果をページごとに比べ、--diff-formatの形式で表示する。
+//! 差分があればExitPartialを返すため、CIで想定外の変更を検出できる。
+func RunDiff(w io.Writer) (int, error) {
+	if err := ValidatePlanFormat(args.DiffFormat); err != nil {
+		return ExitFatal, err
+	}
+	if args.Target == "" {
+		return ExitFatal, errors.Errorf("比べる2つの変換結果を指定してください")
+	}
+	oldOut, closeOld, err := OpenInput(filepath.Clean(args.InputDir))
+	if err != nil {
+		return ExitFatal, err
+	}
+	defer closeOld()
+	newOut, closeNew, err := OpenInput(filepath.Clean(args.Target))
+	if err != nil {
+		return ExitFatal, err
+	}
+	defer closeNew()
+
+	diff, err := convert.CompareOutputs(oldOut, newOut)
+	if err != nil {
+		return ExitFatal, err
+	}
+	if args.DiffFormat == PlanFormatJSON {
+		data, err := json.MarshalIndent(diff, "", "\t")
+		if err != nil {
+			return ExitFatal, err
+		}
+		fmt.Fprintln(w, string(data))
+	} else {
+		PrintOutputDiff(w, diff)
+	}
+	if diff.HasChanges() {
+		return ExitPartial, nil
+	}
+	return ExitSuccess, nil
+}
+
+//! 比較結果を、ページの一覧、SUMMARY.mdの差分、ページごとのMarkdownの差分、集計の順に表示する。
+func PrintOutputDiff(w io.Writer, diff *convert.OutputDiff) {
+	fmt.Fprintf(w, "比較: %s → %s\n", args.InputDir, args.Target)
+	if diff.OptionsChanged {
+		fmt.Fprintln(w, "出力に影響するオプションまたは設定ファイルの規則が異なります。")
+	}
+	if len(diff.Added) > 0 {
+		fmt.Fprintf(w, "追加したページ (%d):\n", len(diff.Added))
+		for _, page := range diff.Added {
+			fmt.Fprintf(w, "  + %s → %s\n", page.Source, page.NewOutput)
+		}
+	}
+	if len(diff.Removed) > 0 {
+		fmt.Fprintf(w, "削除したページ (%d):\n", len(diff.Removed))
+		for _, page := range diff.Removed {
+			fmt.Fprintf(w, "  - %s → %s\n", page.Source, page.OldOutput)
+		}
+	}
+	if len(diff.Changed) > 0 {
+		fmt.Fprintf(w, "変更したページ (%d):\n", len(diff.Changed))
+		for _, page := range diff.Changed {
+			fmt.Fprintf(w, "  ~ %s → %s\n", page.Source, page.NewOutput)
+			if page.Moved() {
+				fmt.Fprintf(w, "      出力先: %s → %s\n", page.OldOutput, page.NewOutput)
+			}
+			if page.OldTitle != page.NewTitle {
+				fmt.Fprintf(w, "      タイトル: %q → %q\n", page.OldTitle, page.NewTitle)
+			}
+			for _, link := range page.LinksRemoved {
+				fmt.Fprintf(w, "      リンク - %s\n", link)
+			}
+			for _, link := range page.LinksAdded {
+				fmt.Fprintf(w, "      リンク + %s\n", link)
+			}
+		}
+	}
+	if diff.SummaryDiff != "" {
+		fmt.Fprintln(w, "=== SUMMARY.md")
+		fmt.Fprint(w, diff.SummaryDiff)
+	}
+	for _, pages := range [][]*convert.PageDiff{diff.Added, diff.Removed, diff.Changed} {
+		for _, page := range pages {
+			if page.Diff != "" {
+				fmt.Fprintf(w, "=== %s\n", page.Source)
+				fmt.Fprint(w, page.Diff)
+			}
+		}
+	}
+	fmt.Fprintf(w, "ページ 追加 %d, 削除 %d, 変更 %d, 変更なし %d / リンク 増 %d, 減 %d\n",
+		len(diff.Added), len(diff.Removed), len(diff.Changed), diff.Unchanged, diff.LinksAdded, diff.LinksRemoved)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xcd0/html2md/convert"
+)
+
+//! pagesを入力ディレクトリに書き出して変換し、出力ディレクトリを返す。
+func convertPages(t *testing.T, pages map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	inputDir, outputDir := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	for name, content := range pages {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(inputDir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(inputDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := convert.Tree(t.Context(), inputDir, outputDir, convert.DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	return outputDir
+}
+
+//! 差分があればExitPartial、なければExitSuccess、比べられなければExitFatalを返す。
+func TestRunDiff(t *testing.T) {
+	base := convertPages(t, map[string]string{"a.html": "<p>a</p>", "b.html": "<p>b</p>"})
+	same := convertPages(t, map[string]string{"a.html": "<p>a</p>", "b.html": "<p>b</p>"})
+	changed := convertPages(t, map[string]string{"a.html": "<p>a2</p>", "b.html": "<p>b</p>"})
+
+	tests := []struct {
+		name     string
+		target   string
+		format   string
+		wantCode int
+		wantErr  bool
+	}{
+		{"same", same, PlanFormatText, ExitSuccess, false},
+		{"changed", changed, PlanFormatText, ExitPartial, false},
+		{"changed json", changed, PlanFormatJSON, ExitPartial, false},
+		{"no manifest", t.TempDir(), PlanFormatText, ExitFatal, true},
+	}
+	// 引数は他の試験と共有するため、試験の後に2つ目の位置引数を残さない。
+	t.Cleanup(func() { args = Args{} })
+	for _, tt := range tests {
+		ParseArgs(CommandDiff, []string{base, tt.target, "--diff-format", tt.format})
+		var out bytes.Buffer
+		code, err := RunDiff(&out)
+		if code != tt.wantCode || (err != nil) != tt.wantErr {
+			t.Errorf("%s: code = %d, err = %v; want %d, error %t", tt.name, code, err, tt.wantCode, tt.wantErr)
+		}
+		if tt.format == PlanFormatJSON {
+			diff := &convert.OutputDiff{}
+			if err := json.Unmarshal(out.Bytes(), diff); err != nil || len(diff.Changed) != 1 || diff.Changed[0].Source != "a.html" {
+				t.Errorf("%s: output = %s, want a JSON diff with a.html changed", tt.name, out.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/xcd0/html2md/convert"
+)
+
+// 試験用ファイルの名前。
+const (
+	FixtureInputHtml   = "input.html"  // 1ページの試験の入力。
+	FixtureExpectedMd  = "expected.md" // 1ページの試験の期待する出力。
+	FixtureInputDir    = "input"       // ツリーの試験の入力ディレクトリ。
+	FixtureExpectedDir = "expected"    // ツリーの試験の期待する出力(.mdのファイルだけ)。
+	FixtureConfig      = "config.toml" // 試験ごとの設定ファイル。--configの設定に追加する。
+)
+
+//! 1つの試験の結果。
+type fixtureResult struct {
+	name    string
+	diffs   []string // 期待する出力と異なるファイルの差分。
+	updated bool     // --updateで期待する出力を書き換えたかどうか。
+	err     error    // 変換に失敗した場合のエラー。
+}
+
+//! testサブコマンドを実行する。試験用ディレクトリの各試験を変換し、期待する出力との差分を表示する。
+//! input.htmlとexpected.mdの組は1ページの変換を、inputとexpectedのディレクトリの組はリンクの変換やSUMMARY.mdを含むツリーの変換を試験する。
+//! --update時は期待する出力を変換結果で書き換える。差分があるか変換に失敗した試験があればExitPartialを返す。
+func RunFixtureTest(ctx context.Context, w io.Writer) (int, error) {
+	root := filepath.Clean(args.InputDir)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return ExitFatal, errors.Errorf("試験用ディレクトリが存在しません: %s", args.InputDir)
+	}
+	dirs, err := findFixtures(root)
+	if err != nil {
+		return ExitFatal, err
+	}
+	if len(dirs) == 0 {
+		return ExitFatal, errors.Errorf("試験がありません (%s と %s、または %s/ と %s/ を置いたディレクトリを指定してください): %s",
+			FixtureInputHtml, FixtureExpectedMd, FixtureInputDir, FixtureExpectedDir, args.InputDir)
+	}
+
+	passed, mismatched, failed, updated := 0, 0, 0, 0
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			return ExitFatal, errors.Errorf("中断しました")
+		}
+		result := runFixture(ctx, root, dir)
+		switch {
+		case result.err != nil:
+			failed++
+			fmt.Fprintf(w, "=== %s: 失敗: %v\n", result.name, result.err)
+		case result.updated:
+			updated++
+			fmt.Fprintf(w, "=== %s: 期待する出力を更新しました\n", result.name)
+		case len(result.diffs) > 0:
+			mismatched++
+			fmt.Fprintf(w, "=== %s: 不一致\n", result.name)
+			for _, diff := range result.diffs {
+				fmt.Fprint(w, diff)
+			}
+		default:
+			passed++
+			fmt.Fprintf(w, "=== %s: 一致\n", result.name)
+		}
+	}
+	fmt.Fprintf(w, "試験 %d, 一致 %d, 不一致 %d, 更新 %d, 失敗 %d\n", len(dirs), passed, mismatched, updated, failed)
+	if mismatched+failed > 0 {
+		return ExitPartial, nil
+	}
+	return ExitSuccess, nil
+}
+
+//! root以下で、試験の入力を置いたディレクトリをパス順に返す。試験のinputディレクトリの中は探さない。
+func findFixtures(root string) ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if isFile(filepath.Join(p, FixtureInputHtml)) || isDir(filepath.Join(p, FixtureInputDir)) {
+			dirs = append(dirs, p)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Errorf("試験用ディレクトリの走査に失敗: %v", err)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+func isFile(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && !info.IsDir()
+}
+
+func isDir(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
+
+//! 1つの試験を実行する。
+func runFixture(ctx context.Context, root, dir string) *fixtureResult {
+	name, _ := filepath.Rel(root, dir)
+	result := &fixtureResult{name: filepath.ToSlash(name)}
+
+	// 引数と--configの設定に、試験ごとの設定を追加する。
+	opts, err := NewOptions()
+	if err != nil {
+		result.err = err
+		return result
+	}
+	if configPath := filepath.Join(dir, FixtureConfig); isFile(configPath) {
+		config, err := convert.LoadConfig(configPath)
+		if err == nil {
+			err = config.Apply(&opts)
+		}
+		if err != nil {
+			result.err = errors.Errorf("%s: %v", FixtureConfig, err)
+			return result
+		}
+	}
+	opts.Logger = nil
+
+	var actual map[string]string
+	if isFile(filepath.Join(dir, FixtureInputHtml)) {
+		actual, result.err = convertFixturePage(dir, opts)
+	} else {
+		actual, result.err = convertFixtureTree(ctx, dir, opts)
+	}
+	if result.err != nil {
+		return result
+	}
+
+	if args.Update {
+		result.err = writeExpected(dir, actual)
+		result.updated = result.err == nil
+		return result
+	}
+	result.diffs, result.err = compareExpected(dir, actual)
+	return result
+}
+
+//! input.htmlを1ページとして変換し、expected.mdと比べる内容を返す。
+func convertFixturePage(dir string, opts convert.Options) (map[string]string, error) {
+	html, err := os.ReadFile(filepath.Join(dir, FixtureInputHtml))
+	if err != nil {
+		return nil, err
+	}
+	page, err := convert.Document(bytes.NewReader(html), FixtureInputHtml, opts)
+	if err != nil {
+		return nil, err
+	}
+	if page.Limit != nil {
+		return nil, errors.Errorf("制限に達しました: %v", page.Limit)
+	}
+	return map[string]string{FixtureExpectedMd: page.Markdown}, nil
+}
+
+//! inputディレクトリをツリーとしてメモリ上に変換し、expectedディレクトリと比べる.mdのファイルの内容を、expectedからの相対パスで返す。
+func convertFixtureTree(ctx context.Context, dir string, opts convert.Options) (map[string]string, error) {
+	out := convert.NewMemoryFS()
+	opts.BookName = "book"
+	result, err := convert.TreeTo(ctx, os.DirFS(filepath.Join(dir, FixtureInputDir)), out, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Failed) > 0 {
+		return nil, result.Failed[0]
+	}
+	actual := map[string]string{}
+	for _, name := range out.Names() {
+		if path.Ext(name) != ".md" {
+			continue
+		}
+		data, err := fs.ReadFile(out, name)
+		if err != nil {
+			return nil, err
+		}
+		actual[path.Join(FixtureExpectedDir, name)] = string(data)
+	}
+	return actual, nil
+}
+
+//! 期待する出力を変換結果で書き換える。ツリーの試験では、変換結果にない古いファイルが残らないようexpectedディレクトリを作り直す。
+func writeExpected(dir string, actual map[string]string) error {
+	if !isFile(filepath.Join(dir, FixtureInputHtml)) {
+		if err := os.RemoveAll(filepath.Join(dir, FixtureExpectedDir)); err != nil {
+			return err
+		}
+	}
+	for name, content := range actual {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//! 期待する出力と変換結果を比べ、異なるファイルの差分を返す。期待する出力にないファイルと、変換結果にないファイルも差分にする。
+func compareExpected(dir string, actual map[string]string) ([]string, error) {
+	expected := map[string]string{}
+	if isFile(filepath.Join(dir, FixtureInputHtml)) {
+		data, err := os.ReadFile(filepath.Join(dir, FixtureExpectedMd))
+		if err != nil {
+			return nil, errors.Errorf("%s がありません (--update で作成できます)", FixtureExpectedMd)
+		}
+		expected[FixtureExpectedMd] = string(data)
+	} else {
+		expectedDir := filepath.Join(dir, FixtureExpectedDir)
+		if !isDir(expectedDir) {
+			return nil, errors.Errorf("%s/ がありません (--update で作成できます)", FixtureExpectedDir)
+		}
+		err := filepath.WalkDir(expectedDir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(dir, p)
+			expected[filepath.ToSlash(rel)] = string(data)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := map[string]bool{}
+	for name := range expected {
+		names[name] = true
+	}
+	for name := range actual {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var diffs []string
+	for _, name := range sorted {
+		want, wantOk := expected[name]
+		got, gotOk := actual[name]
+		if wantOk && gotOk && want == got {
+			continue
+		}
+		fromFile, toFile := name+" (期待)", name+" (実際)"
+		if !wantOk {
+			fromFile = "(期待する出力になし)"
+		}
+		if !gotOk {
+			toFile = "(変換結果になし)"
+		}
+		diff, err := convert.UnifiedDiff(want, got, fromFile, toFile, 3)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
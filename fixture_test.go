@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+//! testdata/fixturesの試験を、testサブコマンドと同じ手順で実行する。
+//! 期待する出力を更新する場合は、html2md test testdata/fixtures --update を実行する。
+func TestFixtures(t *testing.T) {
+	ParseArgs(CommandTest, []string{"testdata/fixtures"})
+	var out bytes.Buffer
+	code, err := RunFixtureTest(t.Context(), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != ExitSuccess {
+		t.Errorf("exit code = %d, want %d\n%s", code, ExitSuccess, out.String())
+	}
+}
@@ -3,14 +3,25 @@ module github.com/xcd0/html2md
 go 1.24.3
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/JohannesKaufmann/html-to-markdown v1.6.0
+	github.com/PuerkitoBio/goquery v1.9.2
 	github.com/alexflint/go-arg v1.5.1
+	github.com/andybalholm/cascadia v1.3.2
+	github.com/dop251/goja v0.0.0-20241024094426-79f3a7efcdbd
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/pkg/errors v0.9.1
+	github.com/pmezard/go-difflib v1.0.0
+	github.com/rainycape/unidecode v0.0.0-20150907023854-cb7f23ec59be
+	github.com/yuin/goldmark v1.7.1
+	golang.org/x/net v0.25.0
+	golang.org/x/text v0.25.0
 )
 
 require (
-	github.com/PuerkitoBio/goquery v1.9.2 // indirect
 	github.com/alexflint/go-scalar v1.2.0 // indirect
-	github.com/andybalholm/cascadia v1.3.2 // indirect
-	golang.org/x/net v0.25.0 // indirect
+	github.com/dlclark/regexp2 v1.11.4 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
+	golang.org/x/sys v0.20.0 // indirect
 )
@@ -2,33 +2,52 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"regexp"
 	"runtime/debug"
 	"strings"
+	"syscall"
+	"time"
 
-	md "github.com/JohannesKaufmann/html-to-markdown"
 	"github.com/alexflint/go-arg"
 	"github.com/pkg/errors"
+	"github.com/xcd0/html2md/convert"
 )
 
 //! 引数を管理する構造体。
 type Args struct {
-	InputDir     string `arg:"positional,required" help:"変換対象のディレクトリパス"`
-	Suffix       string `arg:"-s,--suffix" default:"_converted" help:"出力ディレクトリのサフィックス"`
-	RenamePrefix string `arg:"--rename-prefix" default:"_" help:"元のHTMLファイル名に付与するプレフィックス"`
-}
-
-//! ディレクトリエントリを表す構造体。
-type DirEntry struct {
-	Name     string      // ファイル名またはディレクトリ名。
-	Path     string      // 相対パス。
-	IsDir    bool        // ディレクトリかどうか。
-	Children []*DirEntry // 子要素(ディレクトリの場合)。
+	InputDir        string           `arg:"positional,required" help:"変換対象のディレクトリパス"`
+	Target          string           `arg:"positional" help:"diff時に比べる新しい変換結果、verify時に確認する変換結果 (ディレクトリまたはzipアーカイブ)"`
+	Output          string           `arg:"-o,--output" help:"出力ディレクトリ (省略時は入力ディレクトリの隣に「入力ディレクトリ名+サフィックス」で作成)"`
+	Suffix          string           `arg:"-s,--suffix" default:"_converted" help:"出力ディレクトリのサフィックス"`
+	Mode            string           `arg:"--mode" default:"fail-if-exists" help:"出力ディレクトリが既に存在する場合の動作 (fail-if-exists: エラー, clean: 削除して作り直す, sync: 差分を反映し不要な出力を削除)"`
+	RenamePrefix    string           `arg:"--rename-prefix" default:"_" help:"元のHTMLファイル名に付与するプレフィックス"`
+	Direct          bool             `arg:"--direct" help:"入力ディレクトリをコピーせず、Markdownとアセットだけを出力ディレクトリに直接書き出す"`
+	OriginalsDir    string           `arg:"--originals-dir" help:"--direct指定時に元のHTMLファイルを保存するディレクトリ (省略時は保存しない)"`
+	Jobs            int              `arg:"-j,--jobs" help:"並列に変換するファイル数 (省略時はCPU数)"`
+	Collision       string           `arg:"--collision" default:"suffix" help:"命名ポリシーの適用で衝突するファイルの解決方法 (suffix: 連番付与, newest: 最新を残す, fail: エラー)"`
+	Naming          string           `arg:"--naming" default:"lower" help:"ファイル名・ディレクトリ名の命名ポリシー。keep, lower, slug, translit, nfcをカンマ区切りで組み合わせる"`
+	Debounce        time.Duration    `arg:"--debounce" default:"300ms" help:"watch時に連続した変更をまとめて1回の再変換にする待ち時間"`
+	Addr            string           `arg:"--addr" default:"127.0.0.1:3000" help:"serve時にプレビューを公開するアドレス"`
+	DryRun          bool             `arg:"--dry-run" help:"ディスクに書き込まず、実行予定の操作を表示する"`
+	PlanFormat      string           `arg:"--plan-format" default:"text" help:"--dry-run時の表示形式 (text, json)"`
+	Resume          bool             `arg:"--resume" help:"中断された変換を、出力済みのファイルを省略して続きから再開する"`
+	MaxFileSize     convert.ByteSize `arg:"--max-file-size" default:"0" help:"変換するHTMLファイルの最大サイズ。KB, MB, GBの単位を付けられる (0: 制限なし)"`
+	MaxDepth        int              `arg:"--max-depth" default:"0" help:"変換するHTMLのDOMの入れ子の最大の深さ (0: 制限なし)"`
+	Timeout         time.Duration    `arg:"--timeout" default:"0" help:"1ファイルの変換にかける最大の時間 (0: 制限なし)"`
+	LimitAction     string           `arg:"--limit-action" default:"raw" help:"制限に達したHTMLファイルの扱い (skip: 出力しない, raw: HTMLをコードブロックとして出力, text: テキストだけを出力)"`
+	FailFast        bool             `arg:"--fail-fast" help:"いずれかのファイルの処理に失敗した時点で変換を中止する (省略時は残りのファイルの処理を続ける)"`
+	Config          string           `arg:"-c,--config" help:"変換規則などを記述した設定ファイル (TOML)"`
+	RulesTest       bool             `arg:"--rules-test" help:"入力の試験用ファイル (.md, .html) に設定ファイルの置換規則を適用し、適用前後の差分を表示する"`
+	Update          bool             `arg:"--update" help:"test時に、期待する出力を現在の変換結果で書き換える"`
+	DiffFormat      string           `arg:"--diff-format" default:"text" help:"diff時の表示形式 (text, json)"`
+	VerifyThreshold float64          `arg:"--verify-threshold" default:"0.9" help:"verify時に報告する、変換前後の見えるテキストの類似度のしきい値 (0〜1)"`
+	VerifySelector  string           `arg:"--verify-selector" help:"verify時に元のページで比べる本文の範囲のCSSセレクター (省略時はbody全体)"`
+	VerifyFormat    string           `arg:"--verify-format" default:"text" help:"verify時の表示形式 (text, json)"`
 }
 
 // グローバル変数。
@@ -67,823 +86,255 @@ func init() {
 	log.SetFlags(log.Ltime | log.Lshortfile)
 }
 
-//! メイン関数。引数解析後に変換処理を実行する。
+//! メイン関数。引数解析後に変換処理を実行し、結果に応じた終了コードで終了する。
 func main() {
-	ParseArgs()
-	err := ConvertHtmlToMarkdown()
-	if err != nil {
-		panic(errors.Errorf("変換処理に失敗しました: %v", err))
-	}
-}
-
-func (Args) Version() string {
-	return GetVersion()
-}
-
-func ShowHelp(post string) {
-	buf := new(bytes.Buffer)
-	parser.WriteHelp(buf)
-	help := buf.String()
-	help = strings.ReplaceAll(help, "display this help and exit", "ヘルプを出力する。")
-	help = strings.ReplaceAll(help, "display version and exit", "バージョンを出力する。")
-	fmt.Printf("%v\n", help)
-	if len(post) != 0 {
-		fmt.Println(post)
-	}
-	os.Exit(1)
-}
-
-func GetFileNameWithoutExt(path string) string {
-	return filepath.Base(path[:len(path)-len(filepath.Ext(path))])
-}
-
-func GetVersion() string {
-	if len(revision) == 0 {
-		// go installでビルドされた場合、gitの情報がなくなる。その場合v0.0.0.のように末尾に.がついてしまうのを避ける。
-		return fmt.Sprintf("%v version %v", GetFileNameWithoutExt(os.Args[0]), version)
-	} else {
-		return fmt.Sprintf("%v version %v.%v", GetFileNameWithoutExt(os.Args[0]), version, revision)
-	}
+	command, arguments := SplitCommand(os.Args[1:])
+	ParseArgs(command, arguments)
+	os.Exit(run(command))
 }
 
-func ShowVersion() {
-	fmt.Printf("%s\n", GetVersion())
-	os.Exit(0)
-}
+//! サブコマンドに応じた処理を実行し、終了コードを返す。
+func run(command string) int {
+	// Ctrl+CやSIGTERMを受けたら、処理中のファイルの完了を待ってから停止する。
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-//! go-argを使用して引数を解析する。
-func ParseArgs() {
+	var result *convert.Result
 	var err error
-	parser, err = arg.NewParser(arg.Config{Program: GetFileNameWithoutExt(os.Args[0]), IgnoreEnv: false}, &args)
-	if err != nil {
-		ShowHelp(fmt.Sprintf("%v", errors.Errorf("%v", err)))
-		os.Exit(1)
-	}
-
-	err = parser.Parse(os.Args[1:])
-	if err != nil {
-		if err.Error() == "help requested by user" {
-			ShowHelp("")
-			os.Exit(1)
-		} else if err.Error() == "version requested by user" {
-			ShowVersion()
-			os.Exit(0)
-		} else if strings.Contains(err.Error(), "unknown argument") {
-			fmt.Printf("%s\n", errors.Errorf("%v", err))
-			os.Exit(1)
-		} else {
-			panic(errors.Errorf("%v", err))
-		}
-	}
-}
-
-//! HTML→Markdown変換のメイン処理を行う。
-func ConvertHtmlToMarkdown() error {
-	// 入力ディレクトリの存在確認。
-	if _, err := os.Stat(args.InputDir); os.IsNotExist(err) {
-		return errors.Errorf("入力ディレクトリが存在しません: %s", args.InputDir)
-	}
-
-	// 出力ディレクトリ名を生成。
-	// 入力パスの親ディレクトリと基底名を分離。
-	inputDir := filepath.Clean(args.InputDir)
-	parentDir := filepath.Dir(inputDir)
-	baseName := filepath.Base(inputDir)
-	
-	// 出力ディレクトリは親ディレクトリ直下に作成。
-	outputDir := filepath.Join(parentDir, baseName+args.Suffix)
-	
-	// 出力ディレクトリが存在しない場合のみ作成。
-	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			return errors.Errorf("出力ディレクトリの作成に失敗: %v", err)
-		}
-		
-		// ディレクトリ全体をコピー。
-		if err := CopyDirectory(args.InputDir, outputDir); err != nil {
-			return errors.Errorf("ディレクトリコピーに失敗: %v", err)
-		}
-	} else {
-		log.Printf("出力ディレクトリが既に存在します: %s", outputDir)
-	}
-
-	// HTMLファイルを変換。
-	log.Printf("HTMLファイル変換を開始します...")
-	if err := ProcessHtmlFiles(outputDir); err != nil {
-		return errors.Errorf("HTMLファイル変換に失敗: %v", err)
-	}
-	
-	// HTMLファイルをリネーム。
-	log.Printf("HTMLファイルリネームを開始します...")
-	if err := RenameHtmlFiles(outputDir); err != nil {
-		return errors.Errorf("HTMLファイルリネームに失敗: %v", err)
-	}
-	
-	// ディレクトリ名を小文字にリネーム。
-	log.Printf("ディレクトリ名小文字化を開始します...")
-	if err := RenameDirectoriesToLowercase(outputDir); err != nil {
-		return errors.Errorf("ディレクトリ名小文字化に失敗: %v", err)
-	}
-
-	// mdbook用ファイル生成。
-	log.Printf("mdbook用ファイル生成を開始します...")
-	if err := GenerateMdBookFiles(outputDir); err != nil {
-		return errors.Errorf("mdbook用ファイル生成に失敗: %v", err)
-	}
-	
-	fmt.Printf("変換完了: %s → %s\n", args.InputDir, outputDir)
-	return nil
-}
-
-//! ディレクトリを再帰的にコピーする。
-func CopyDirectory(src, dst string) error {
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+	switch {
+	case command == CommandWatch:
+		err = RunWatch(ctx)
+	case command == CommandServe:
+		err = RunServe(ctx)
+	case command == CommandTest:
+		code, err := RunFixtureTest(ctx, os.Stdout)
 		if err != nil {
-			return err
+			fmt.Fprintf(os.Stderr, "試験に失敗しました: %v\n", err)
 		}
-
-		// 相対パスを計算。
-		relPath, err := filepath.Rel(src, path)
+		return code
+	case command == CommandDiff:
+		code, err := RunDiff(os.Stdout)
 		if err != nil {
-			return err
-		}
-		dstPath := filepath.Join(dst, relPath)
-
-		if info.IsDir() {
-			// ディレクトリを作成。
-			return os.MkdirAll(dstPath, info.Mode())
-		} else {
-			// ファイルをコピー。
-			return CopyFile(path, dstPath)
+			fmt.Fprintf(os.Stderr, "比較に失敗しました: %v\n", err)
 		}
-	})
-}
-
-//! 単一ファイルをコピーする。
-func CopyFile(src, dst string) error {
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
-
-	// 出力ファイルのディレクトリを作成。
-	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
-		return err
-	}
-
-	dstFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer dstFile.Close()
-
-	_, err = io.Copy(dstFile, srcFile)
-	return err
-}
-
-//! 出力ディレクトリ内のHTMLファイルを処理する。
-func ProcessHtmlFiles(dir string) error {
-	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		return code
+	case command == CommandVerify:
+		code, err := RunVerify(ctx, os.Stdout)
 		if err != nil {
-			return err
+			fmt.Fprintf(os.Stderr, "確認に失敗しました: %v\n", err)
 		}
-
-		// HTMLファイルのみを対象とする。
-		if !info.IsDir() && strings.HasSuffix(strings.ToLower(path), ".html") {
-			return ConvertSingleHtmlFile(path)
+		return code
+	case args.RulesTest:
+		code, err := RunRulesTest(os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "置換規則の試験に失敗しました: %v\n", err)
 		}
-		return nil
-	})
-}
-
-//! 単一のHTMLファイルをMarkdownに変換する。
-func ConvertSingleHtmlFile(htmlPath string) error {
-	log.Printf("変換中: %s", htmlPath)
-
-	// HTMLファイルを読み込み。
-	htmlContent, err := os.ReadFile(htmlPath)
-	if err != nil {
-		return errors.Errorf("HTMLファイル読み込みエラー: %v", err)
+		return code
+	default:
+		result, err = ConvertHtmlToMarkdown(ctx, nil)
 	}
-
-	// html-to-markdownコンバーターを作成。
-	converter := md.NewConverter("", true, nil)
-	
-	// HTMLをMarkdownに変換。
-	markdownContent, err := converter.ConvertString(string(htmlContent))
 	if err != nil {
-		return errors.Errorf("HTML→Markdown変換エラー: %v", err)
+		fmt.Fprintf(os.Stderr, "変換処理に失敗しました: %v\n", err)
+		return ExitFatal
 	}
-
-	// HTMLへの相対リンクをMarkdownリンクに変換。
-	markdownContent = ConvertHtmlLinksToMd(markdownContent)
-
-	// 出力ファイルパスを生成(.html → .md、.md.md問題を回避)。
-	mdPath := strings.TrimSuffix(htmlPath, ".html")
-	mdPath = strings.TrimSuffix(mdPath, ".md") + ".md"
-	
-	// 出力ディレクトリが存在することを確認。
-	mdDir := filepath.Dir(mdPath)
-	if err := os.MkdirAll(mdDir, 0755); err != nil {
-		return errors.Errorf("出力ディレクトリ作成エラー: %v", err)
-	}
-	
-	// Markdownファイルを書き出し。
-	if err := os.WriteFile(mdPath, []byte(markdownContent), 0644); err != nil {
-		return errors.Errorf("Markdownファイル書き込みエラー: %v", err)
+	if result != nil {
+		PrintReport(os.Stdout, result)
 	}
-
-	// ファイルが正常に作成されたか確認。
-	if _, err := os.Stat(mdPath); err != nil {
-		log.Printf("警告: 作成されたMarkdownファイルが見つかりません: %s", mdPath)
-	} else {
-		log.Printf("変換完了: %s → %s", htmlPath, mdPath)
-	}
-	
-	return nil
+	return ExitCode(result)
 }
 
-//! 出力ディレクトリ内のHTMLファイルをリネームする。
-func RenameHtmlFiles(dir string) error {
-	var htmlFiles []string
-	
-	// HTMLファイルのパスを収集。
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+//! 引数から変換のオプションを作る。--configの指定があれば設定ファイルを読み込んで反映する。
+func NewOptions() (convert.Options, error) {
+	opts := convert.Options{
+		Mode:         args.Mode,
+		RenamePrefix: args.RenamePrefix,
+		Direct:       args.Direct,
+		OriginalsDir: args.OriginalsDir,
+		Jobs:         args.Jobs,
+		Collision:    args.Collision,
+		Naming:       args.Naming,
+		MaxFileSize:  int64(args.MaxFileSize),
+		MaxDepth:     args.MaxDepth,
+		Timeout:      args.Timeout,
+		LimitAction:  args.LimitAction,
+		FailFast:     args.FailFast,
+		Resume:       args.Resume,
+		Version:      version + "." + revision,
+		Logger:       log.Default(),
+	}
+	if args.Config != "" {
+		config, err := convert.LoadConfig(args.Config)
 		if err != nil {
-			return err
-		}
-
-		// HTMLファイルのみを対象とする。
-		if !info.IsDir() && strings.HasSuffix(strings.ToLower(path), ".html") {
-			htmlFiles = append(htmlFiles, path)
-		}
-		return nil
-	})
-	
-	if err != nil {
-		return err
-	}
-
-	// 各HTMLファイルをリネーム。
-	for _, htmlPath := range htmlFiles {
-		// 新しいファイル名を生成（小文字 + プレフィックス）。
-		dir := filepath.Dir(htmlPath)
-		filename := filepath.Base(htmlPath)
-		
-		// ファイル名を小文字に変換。
-		lowerFilename := strings.ToLower(filename)
-		newFilename := args.RenamePrefix + lowerFilename
-		newPath := filepath.Join(dir, newFilename)
-
-		// 同名ファイルが既に存在する場合はスキップ。
-		if _, err := os.Stat(newPath); err == nil {
-			log.Printf("リネーム先ファイルが既に存在するためスキップ: %s", newPath)
-			continue
-		}
-
-		// ファイルをリネーム。
-		if err := os.Rename(htmlPath, newPath); err != nil {
-			log.Printf("HTMLファイルリネームエラー %s → %s: %v", htmlPath, newPath, err)
-			continue // エラーが発生しても他のファイルの処理を続行。
-		}
-
-		log.Printf("リネーム完了: %s → %s", htmlPath, newPath)
-	}
-
-	return nil
-}
-
-//! Markdown内のHTMLリンクを.mdリンクに変換する。
-func ConvertHtmlLinksToMd(content string) string {
-	// リンクパターンをマッチする正規表現。
-	// [text](path.html) または [text](path.html#anchor) の形式。
-	linkPattern := regexp.MustCompile(`\[([^\]]*)\]\(([^)]*\.html)([^)]*)\)`)
-	
-	// HTMLリンクを.mdリンクに置換。
-	result := linkPattern.ReplaceAllStringFunc(content, func(match string) string {
-		// マッチした部分を解析。
-		matches := linkPattern.FindStringSubmatch(match)
-		if len(matches) < 4 {
-			return match // 解析失敗時は元のまま。
+			return opts, err
 		}
-		
-		linkText := matches[1]    // リンクテキスト。
-		htmlPath := matches[2]    // HTMLファイルパス。
-		anchor := matches[3]      // アンカー部分(#section等)。
-		
-		// リネーム後のHTMLファイル名を考慮したリンクに変換。
-		// 相対パスの場合、プレフィックスを追加。
-		if !strings.HasPrefix(htmlPath, "http") && !strings.HasPrefix(htmlPath, "/") {
-			// パス区切り文字を統一 (Windows環境での%5C問題を回避)。
-			htmlPath = strings.ReplaceAll(htmlPath, "\\", "/")
-			
-			// 相対パスの場合、ファイル名部分にプレフィックスを追加。
-			dir := filepath.Dir(htmlPath)
-			filename := filepath.Base(htmlPath)
-			
-			// .htmlを.mdに変換。
-			baseFilename := strings.TrimSuffix(filename, ".html")
-			baseFilename = strings.TrimSuffix(baseFilename, ".md")
-			var mdPath string
-			if dir == "." || dir == "" {
-				mdPath = baseFilename + ".md"
-			} else {
-				// ディレクトリ部分を小文字に変換、ファイル名は維持。
-				lowerDir := ConvertDirectoryToLowercase(dir)
-				// パス区切り文字を/で統一。
-				mdPath = strings.ReplaceAll(filepath.Join(lowerDir, baseFilename+".md"), "\\", "/")
-			}
-			
-			return fmt.Sprintf("[%s](%s%s)", linkText, mdPath, anchor)
-		} else {
-			// 絶対パスやURLの場合は通常の変換。
-			baseFilename := strings.TrimSuffix(filepath.Base(htmlPath), ".html")
-			baseFilename = strings.TrimSuffix(baseFilename, ".md")
-			dir := filepath.Dir(htmlPath)
-			var mdPath string
-			if dir == "." || dir == "" {
-				mdPath = baseFilename + ".md"
-			} else {
-				// ディレクトリ部分を小文字に変換、ファイル名は維持。
-				lowerDir := ConvertDirectoryToLowercase(dir)
-				// パス区切り文字を/で統一。
-				mdPath = strings.ReplaceAll(filepath.Join(lowerDir, baseFilename+".md"), "\\", "/")
-			}
-			return fmt.Sprintf("[%s](%s%s)", linkText, mdPath, anchor)
+		if err := config.Apply(&opts); err != nil {
+			return opts, errors.Errorf("設定ファイル %s: %v", args.Config, err)
 		}
-	})
-	
-	return result
-}
-
-//! ディレクトリパスの各階層を小文字に変換する。ファイル名は変換しない。
-func ConvertDirectoryToLowercase(dirPath string) string {
-	// パス区切り文字を統一。
-	dirPath = strings.ReplaceAll(dirPath, "\\", "/")
-	
-	// パスの各部分を分割。
-	parts := strings.Split(dirPath, "/")
-	
-	// 各ディレクトリ名を小文字に変換。
-	for i, part := range parts {
-		parts[i] = strings.ToLower(part)
 	}
-	
-	return strings.Join(parts, "/")
+	return opts, nil
 }
 
-//! mdbook用のbook.tomlとSUMMARY.mdを生成する。
-func GenerateMdBookFiles(outputDir string) error {
-	// book.tomlを生成。
-	if err := GenerateBookToml(outputDir); err != nil {
-		return errors.Errorf("book.toml生成に失敗: %v", err)
+//! 引数で指定された入力ディレクトリまたはzipアーカイブを変換する。--dry-run時は実行予定の操作を表示するだけでnilを返す。
+//! changedは前回の変換から変わった入力の相対パスで、sync時にそれ以外のファイルの読み込みを省く。nilの場合は全ファイルを確認する。
+func ConvertHtmlToMarkdown(ctx context.Context, changed []string) (*convert.Result, error) {
+	if err := ValidatePlanFormat(args.PlanFormat); err != nil {
+		return nil, err
 	}
-
-	// SUMMARY.mdを生成。
-	if err := GenerateSummaryMd(outputDir); err != nil {
-		return errors.Errorf("SUMMARY.md生成に失敗: %v", err)
+	if args.OriginalsDir != "" && !args.Direct {
+		return nil, errors.Errorf("--originals-dir は --direct と組み合わせて指定してください")
 	}
 
-	return nil
-}
-
-//! book.tomlファイルを生成する。
-func GenerateBookToml(outputDir string) error {
-	// 出力ディレクトリ名からタイトルを生成。
-	baseDirName := filepath.Base(outputDir)
-	// アンダースコアをスペースに置換してタイトル化。
-	title := strings.ReplaceAll(baseDirName, "_", " ")
-	title = strings.ReplaceAll(title, "-", " ")
-	
-	// book.tomlの内容を動的生成。
-	bookTomlContent := fmt.Sprintf(`[book]
-title = "%s"
-description = "%s"
-authors = ["Generated by html2md"]
-src = "%s"
-
-[build]
-build-dir = "book"
-create-missing = false
-
-[output.html]
-default-theme = "navy"
-preferred-dark-theme = "navy"
-`, title, title, baseDirName)
-
-	bookTomlPath := filepath.Join(outputDir, "book.toml")
-	return os.WriteFile(bookTomlPath, []byte(bookTomlContent), 0644)
-}
-
-//! SUMMARY.mdファイルを生成する。
-func GenerateSummaryMd(outputDir string) error {
-	// ディレクトリ構造を解析（リネーム後の状態で）。
-	rootEntry, err := BuildDirectoryTreeAfterRename(outputDir)
+	// 入力を開く。zipアーカイブはディスクに展開せずに読み込む。
+	inputPath := filepath.Clean(args.InputDir)
+	src, closeInput, err := OpenInput(inputPath)
 	if err != nil {
-		return errors.Errorf("ディレクトリ構造解析に失敗: %v", err)
-	}
-
-	// SUMMARY.mdの内容を生成。
-	var summaryBuilder strings.Builder
-	summaryBuilder.WriteString("# Summary\n\n")
-	
-	// ルートレベルのindex.htmlまたはREADME.mdがあれば導入として追加。
-	if hasIntroFile(outputDir) {
-		summaryBuilder.WriteString("- [Introduction](README.md)\n\n")
+		return nil, err
 	}
+	defer closeInput()
+	zipInput := IsZipPath(inputPath)
 
-	// 階層構造を再帰的に出力。
-	writeSummaryEntries(&summaryBuilder, rootEntry.Children, 0)
-
-	// SUMMARY.mdファイルを書き出し。
-	summaryPath := filepath.Join(outputDir, "SUMMARY.md")
-	return os.WriteFile(summaryPath, []byte(summaryBuilder.String()), 0644)
-}
-
-//! ディレクトリツリーを構築する。
-func BuildDirectoryTree(rootDir string) (*DirEntry, error) {
-	root := &DirEntry{
-		Name:     filepath.Base(rootDir),
-		Path:     "",
-		IsDir:    true,
-		Children: []*DirEntry{},
+	// 出力先を決定。zipアーカイブの入力は拡張子を除いた名前を基準にする。
+	base := inputPath
+	if zipInput {
+		base = strings.TrimSuffix(inputPath, filepath.Ext(inputPath))
 	}
-
-	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// ルートディレクトリ自身はスキップ。
-		if path == rootDir {
-			return nil
-		}
-
-		// 隠しファイルとbook.toml、SUMMARY.mdはスキップ。
-		name := info.Name()
-		if strings.HasPrefix(name, ".") || name == "book.toml" || name == "SUMMARY.md" {
-			return nil
-		}
-
-		// プレフィックス付きのHTMLファイル（リネーム後）はスキップ。
-		if strings.HasSuffix(strings.ToLower(name), ".html") && strings.HasPrefix(name, args.RenamePrefix) {
-			return nil
-		}
-
-		// 相対パスを計算。
-		relPath, err := filepath.Rel(rootDir, path)
-		if err != nil {
-			return err
-		}
-
-		// パス区切り文字を/で統一。
-		relPath = strings.ReplaceAll(relPath, "\\", "/")
-
-		// HTMLファイルの場合は.mdファイルに置き換え。
-		displayPath := relPath
-		if strings.HasSuffix(strings.ToLower(name), ".html") {
-			// ディレクトリ部分を小文字に変換。
-			dir := filepath.Dir(relPath)
-			filename := filepath.Base(relPath)
-			baseFilename := strings.TrimSuffix(filename, ".html")
-			baseFilename = strings.TrimSuffix(baseFilename, ".md")
-			
-			if dir == "." || dir == "" {
-				displayPath = baseFilename + ".md"
-			} else {
-				lowerDir := ConvertDirectoryToLowercase(dir)
-				displayPath = lowerDir + "/" + baseFilename + ".md"
-			}
-		}
-
-		entry := &DirEntry{
-			Name:     name,
-			Path:     displayPath,
-			IsDir:    info.IsDir(),
-			Children: []*DirEntry{},
-		}
-
-		// 親ディレクトリを見つけて追加。
-		// パス区切り文字を/で統一してから検索。
-		parentPath := strings.ReplaceAll(filepath.Dir(relPath), "\\", "/")
-		parent := findParentEntry(root, parentPath)
-		if parent != nil {
-			parent.Children = append(parent.Children, entry)
-		}
-
-		return nil
-	})
-
+	outputDir := convert.ResolveOutputDir(base, args.Output, args.Suffix)
+	opts, err := NewOptions()
 	if err != nil {
 		return nil, err
 	}
+	opts.ChangedPaths = changed
 
-	// 各ディレクトリの子要素をソート。
-	sortDirectoryTree(root)
-	return root, nil
-}
-
-//! リネーム後のディレクトリツリーを構築する。
-func BuildDirectoryTreeAfterRename(rootDir string) (*DirEntry, error) {
-	root := &DirEntry{
-		Name:     filepath.Base(rootDir),
-		Path:     "",
-		IsDir:    true,
-		Children: []*DirEntry{},
-	}
-
-	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// ルートディレクトリ自身はスキップ。
-		if path == rootDir {
-			return nil
+	var result *convert.Result
+	switch {
+	case IsZipPath(outputDir):
+		if args.DryRun {
+			return nil, errors.Errorf("--dry-run はzipアーカイブへの出力には対応していません")
 		}
-
-		// 隠しファイルとbook.toml、SUMMARY.mdはスキップ。
-		name := info.Name()
-		if strings.HasPrefix(name, ".") || name == "book.toml" || name == "SUMMARY.md" {
-			return nil
+		if !zipInput {
+			if err := convert.ValidateOutputDir(inputPath, outputDir); err != nil {
+				return nil, err
+			}
 		}
-
-		// プレフィックス付きのHTMLファイル（リネーム後）はスキップ。
-		if strings.HasSuffix(strings.ToLower(name), ".html") && strings.HasPrefix(name, args.RenamePrefix) {
-			return nil
+		result, err = ConvertToZip(ctx, src, outputDir, opts)
+	case args.DryRun:
+		// 実行予定の操作を表示するだけで終了する。
+		var plan *convert.DryRunPlan
+		if zipInput {
+			plan, err = convert.PlanTreeFrom(ctx, src, outputDir, opts)
+		} else {
+			plan, err = convert.PlanTree(ctx, inputPath, outputDir, opts)
 		}
-
-		// 相対パスを計算。
-		relPath, err := filepath.Rel(rootDir, path)
 		if err != nil {
-			return err
-		}
-
-		// パス区切り文字を/で統一。
-		relPath = strings.ReplaceAll(relPath, "\\", "/")
-
-		// .mdファイルのみを対象とする。
-		displayPath := relPath
-		if strings.HasSuffix(strings.ToLower(name), ".md") {
-			// .md.md問題を回避して小文字パスを生成。
-			tempPath := strings.TrimSuffix(relPath, ".md")
-			tempPath = strings.TrimSuffix(tempPath, ".md") + ".md"
-			displayPath = strings.ToLower(tempPath)
-		} else if !info.IsDir() {
-			// .mdファイル以外のファイルはスキップ。
-			return nil
-		}
-
-		entry := &DirEntry{
-			Name:     name,
-			Path:     displayPath,
-			IsDir:    info.IsDir(),
-			Children: []*DirEntry{},
+			return nil, err
 		}
-
-		// 親ディレクトリを見つけて追加。
-		// パス区切り文字を/で統一してから検索。
-		parentPath := strings.ReplaceAll(filepath.Dir(relPath), "\\", "/")
-		parent := findParentEntry(root, parentPath)
-		if parent != nil {
-			parent.Children = append(parent.Children, entry)
+		plan.InputDir = inputPath
+		return nil, PrintDryRun(plan)
+	case zipInput:
+		result, err = convert.TreeFrom(ctx, src, outputDir, opts)
+	default:
+		result, err = convert.Tree(ctx, inputPath, outputDir, opts)
+	}
+	if ctx.Err() != nil {
+		if IsZipPath(outputDir) {
+			return nil, errors.Errorf("中断しました")
 		}
-
-		return nil
-	})
-
+		return nil, errors.Errorf("中断しました。--resume を指定して同じ引数で実行すると続きから変換します: %s", convert.StagingDir(outputDir))
+	}
 	if err != nil {
 		return nil, err
 	}
-
-	// 各ディレクトリの子要素をソート。
-	sortDirectoryTree(root)
-	return root, nil
+	result.InputDir = inputPath
+	fmt.Printf("変換完了: %s → %s\n", args.InputDir, outputDir)
+	return result, nil
 }
 
-//! 指定パスの親エントリを見つける。
-func findParentEntry(root *DirEntry, targetPath string) *DirEntry {
-	if targetPath == "" || targetPath == "." {
-		return root
-	}
-
-	// パス区切り文字を/で統一。
-	targetPath = strings.ReplaceAll(targetPath, "\\", "/")
-	parts := strings.Split(targetPath, "/")
-	current := root
+// サブコマンド。
+const (
+	CommandWatch  = "watch"  // 入力ディレクトリを監視し、変更のたびに再変換する。
+	CommandServe  = "serve"  // watchに加えて、変換結果をプレビューするHTTPサーバーを起動する。
+	CommandTest   = "test"   // 試験用ディレクトリの入力を変換し、期待する出力と比べる。
+	CommandDiff   = "diff"   // 2つの変換結果をページごとに比べる。
+	CommandVerify = "verify" // 変換結果を描画し直して、元のページと見えるテキストを比べる。
+)
 
-	for _, part := range parts {
-		found := false
-		for _, child := range current.Children {
-			if child.IsDir && child.Name == part {
-				current = child
-				found = true
-				break
-			}
-		}
-		if !found {
-			return nil
+//! 引数の先頭がサブコマンドであれば、サブコマンドと残りの引数に分ける。サブコマンドがなければ空文字列を返す。
+//! go-argでは位置引数とサブコマンドを併用できないため、サブコマンドは引数解析の前に取り出す。
+func SplitCommand(arguments []string) (string, []string) {
+	if len(arguments) > 0 {
+		switch arguments[0] {
+		case CommandWatch, CommandServe, CommandTest, CommandDiff, CommandVerify:
+			return arguments[0], arguments[1:]
 		}
 	}
+	return "", arguments
+}
 
-	return current
+func (Args) Version() string {
+	return GetVersion()
 }
 
-//! ディレクトリツリーをソートする。
-func sortDirectoryTree(entry *DirEntry) {
-	if !entry.IsDir {
-		return
+func ShowHelp(post string) {
+	buf := new(bytes.Buffer)
+	parser.WriteHelp(buf)
+	help := buf.String()
+	help = strings.ReplaceAll(help, "display this help and exit", "ヘルプを出力する。")
+	help = strings.ReplaceAll(help, "display version and exit", "バージョンを出力する。")
+	fmt.Printf("%v\n", help)
+	if len(post) != 0 {
+		fmt.Println(post)
+		os.Exit(ExitFatal)
 	}
+	os.Exit(ExitSuccess)
+}
 
-	// 子要素をソート(ディレクトリ優先、その後アルファベット順)。
-	for i := 0; i < len(entry.Children); i++ {
-		for j := i + 1; j < len(entry.Children); j++ {
-			a, b := entry.Children[i], entry.Children[j]
-			
-			// ディレクトリを優先。
-			if a.IsDir && !b.IsDir {
-				continue
-			}
-			if !a.IsDir && b.IsDir {
-				entry.Children[i], entry.Children[j] = b, a
-				continue
-			}
-			
-			// 同じ種類の場合はアルファベット順。
-			if a.Name > b.Name {
-				entry.Children[i], entry.Children[j] = b, a
-			}
-		}
-	}
+func GetFileNameWithoutExt(path string) string {
+	return filepath.Base(path[:len(path)-len(filepath.Ext(path))])
+}
 
-	// 再帰的にソート。
-	for _, child := range entry.Children {
-		sortDirectoryTree(child)
+func GetVersion() string {
+	if len(revision) == 0 {
+		// go installでビルドされた場合、gitの情報がなくなる。その場合v0.0.0.のように末尾に.がついてしまうのを避ける。
+		return fmt.Sprintf("%v version %v", GetFileNameWithoutExt(os.Args[0]), version)
+	} else {
+		return fmt.Sprintf("%v version %v.%v", GetFileNameWithoutExt(os.Args[0]), version, revision)
 	}
 }
 
-//! SUMMARY.mdのエントリを書き出す。
-func writeSummaryEntries(builder *strings.Builder, entries []*DirEntry, depth int) {
-	indent := strings.Repeat("  ", depth)
-
-	for _, entry := range entries {
-		if entry.IsDir {
-			// ディレクトリの場合（リンクなし）。
-			builder.WriteString(fmt.Sprintf("%s  %s\n", indent, entry.Name))
-			writeSummaryEntries(builder, entry.Children, depth+1)
-		} else {
-			// ファイルの場合(.mdファイルのみを対象)。
-			if strings.HasSuffix(strings.ToLower(entry.Name), ".md") {
-				// 表示名から.mdを除去。
-				displayName := strings.TrimSuffix(entry.Name, ".md")
-				builder.WriteString(fmt.Sprintf("%s- [%s](%s)\n", indent, displayName, entry.Path))
-			}
-		}
-	}
+func ShowVersion() {
+	fmt.Printf("%s\n", GetVersion())
+	os.Exit(0)
 }
 
-//! 導入ファイルの存在確認。
-func hasIntroFile(dir string) bool {
-	introFiles := []string{"index.html", "README.md", "readme.md"}
-	for _, file := range introFiles {
-		if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
-			return true
-		}
+//! go-argを使用して引数を解析する。commandはサブコマンド名で、ヘルプのプログラム名に使う。
+func ParseArgs(command string, arguments []string) {
+	program := GetFileNameWithoutExt(os.Args[0])
+	if command != "" {
+		program += " " + command
 	}
-	return false
-}
 
-//! ディレクトリ名を小文字にリネームする。Windows環境対応。
-func RenameDirectoriesToLowercase(rootDir string) error {
-	var directories []string
-	
-	// 全ディレクトリのパスを収集（深い階層から順に処理するため逆順で格納）。
-	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		
-		// ディレクトリのみを対象とし、ルートディレクトリは除外。
-		if info.IsDir() && path != rootDir {
-			directories = append(directories, path)
-		}
-		return nil
-	})
-	
+	var err error
+	parser, err = arg.NewParser(arg.Config{Program: program, IgnoreEnv: false}, &args)
 	if err != nil {
-		return err
-	}
-	
-	// 深い階層から順に処理するため逆順にソート。
-	for i := len(directories)/2 - 1; i >= 0; i-- {
-		opp := len(directories) - 1 - i
-		directories[i], directories[opp] = directories[opp], directories[i]
-	}
-	
-	// 各ディレクトリをリネーム。
-	for _, dirPath := range directories {
-		if err := renameSingleDirectoryToLowercase(dirPath); err != nil {
-			log.Printf("ディレクトリリネームエラー %s: %v", dirPath, err)
-			continue // エラーが発生しても他のファイルの処理を続行。
-		}
+		ShowHelp(fmt.Sprintf("%v", errors.Errorf("%v", err)))
 	}
-	
-	return nil
-}
 
-//! 単一ディレクトリを小文字にリネームする。
-func renameSingleDirectoryToLowercase(dirPath string) error {
-	dir := filepath.Dir(dirPath)
-	currentName := filepath.Base(dirPath)
-	lowerName := strings.ToLower(currentName)
-	
-	// 既に小文字の場合はスキップ。
-	if currentName == lowerName {
-		return nil
-	}
-	
-	finalPath := filepath.Join(dir, lowerName)
-	
-	// 目的のディレクトリが既に存在する場合の処理。
-	if _, err := os.Stat(finalPath); err == nil {
-		log.Printf("リネーム先ディレクトリが既に存在: %s", finalPath)
-		
-		// 既存の小文字ディレクトリの内容を大文字ディレクトリにマージ。
-		if err := mergeDirectories(finalPath, dirPath); err != nil {
-			return errors.Errorf("ディレクトリマージ失敗 %s → %s: %v", finalPath, dirPath, err)
+	err = parser.Parse(arguments)
+	if err != nil {
+		if err.Error() == "help requested by user" {
+			ShowHelp("")
+		} else if err.Error() == "version requested by user" {
+			ShowVersion()
+			os.Exit(ExitSuccess)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s\n", errors.Errorf("%v", err))
+			os.Exit(ExitFatal)
 		}
-		
-		log.Printf("既存小文字ディレクトリをマージ完了: %s → %s", finalPath, dirPath)
-		// 削除はせず、マージのみ実行。
-		// 大文字ディレクトリに統合されたファイルがあるため、そのまま大文字→小文字リネームを続行。
-	}
-	
-	// ソースディレクトリが存在することを確認。
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		log.Printf("リネーム対象ディレクトリが存在しません: %s", dirPath)
-		return nil // 既に処理済みとして正常終了。
 	}
-	
-	// Windows環境では大文字小文字の違いのみのリネームは直接できないため、
-	// 一時的に別の名前にリネームしてから目的の名前にリネーム。
-	tempName := currentName + "_temp_rename"
-	tempPath := filepath.Join(dir, tempName)
-	
-	// ステップ1: 現在の名前 → 一時的な名前。
-	if err := os.Rename(dirPath, tempPath); err != nil {
-		return errors.Errorf("一時リネーム失敗 %s → %s: %v", dirPath, tempPath, err)
+	// 2つ目の位置引数はdiffとverifyでだけ使う。
+	if args.Target != "" && command != CommandDiff && command != CommandVerify {
+		fmt.Fprintf(os.Stderr, "余分な引数です: %s\n", args.Target)
+		os.Exit(ExitFatal)
 	}
-	
-	// ステップ2: 一時的な名前 → 小文字の名前。
-	if err := os.Rename(tempPath, finalPath); err != nil {
-		// 失敗した場合は元の名前に戻す。
-		os.Rename(tempPath, dirPath)
-		return errors.Errorf("最終リネーム失敗 %s → %s: %v", tempPath, finalPath, err)
-	}
-	
-	log.Printf("ディレクトリリネーム完了: %s → %s", dirPath, finalPath)
-	return nil
 }
 
-//! 2つのディレクトリの内容をマージする。
-func mergeDirectories(srcDir, dstDir string) error {
-	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		
-		// ソースディレクトリ自身はスキップ。
-		if path == srcDir {
-			return nil
-		}
-		
-		// 相対パスを計算。
-		relPath, err := filepath.Rel(srcDir, path)
-		if err != nil {
-			return err
-		}
-		
-		dstPath := filepath.Join(dstDir, relPath)
-		
-		if info.IsDir() {
-			// ディレクトリの場合は作成。
-			if err := os.MkdirAll(dstPath, info.Mode()); err != nil {
-				return err
-			}
-		} else {
-			// ファイルの場合はコピー。
-			// 既に存在する場合は上書きしない（大文字ディレクトリのファイルを優先）。
-			if _, err := os.Stat(dstPath); err == nil {
-				log.Printf("ファイルが既に存在するためスキップ: %s", dstPath)
-				return nil
-			}
-			
-			if err := CopyFile(path, dstPath); err != nil {
-				return err
-			}
-		}
-		
-		return nil
-	})
-}
\ No newline at end of file
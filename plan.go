@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/xcd0/html2md/convert"
+)
+
+// --dry-runの表示形式。
+const (
+	PlanFormatText = "text"
+	PlanFormatJSON = "json"
+)
+
+//! --dry-run、diff、verifyの表示形式の値を検証する。
+func ValidatePlanFormat(format string) error {
+	switch format {
+	case PlanFormatText, PlanFormatJSON:
+		return nil
+	}
+	return errors.Errorf("不明な表示形式です: %s (text, jsonのいずれかを指定してください)", format)
+}
+
+//! 実行予定の操作を--plan-formatの形式で標準出力に表示する。
+func PrintDryRun(plan *convert.DryRunPlan) error {
+	if args.PlanFormat == PlanFormatJSON {
+		data, err := json.MarshalIndent(plan, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	fmt.Print(plan.Text())
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/xcd0/html2md/convert"
+)
+
+// 終了コード。
+const (
+	ExitSuccess = 0 // すべてのファイルを処理できた。
+	ExitPartial = 1 // 一部のファイルの処理に失敗したが、残りのファイルは出力した。
+	ExitFatal   = 2 // 引数の誤りや中断などにより、出力を完了できなかった。
+)
+
+//! 変換結果の件数と、制限に達したファイルと失敗したファイルの一覧を表示する。
+//! 書き換え規則と置換規則を指定した場合は、使われていない規則に気付けるよう規則ごとの適用数も表示する。
+func PrintReport(w io.Writer, result *convert.Result) {
+	fmt.Fprintf(w, "変換 %d, コピー %d, 省略 %d, 削除 %d, 制限 %d, 失敗 %d\n",
+		result.Converted, result.Copied, result.Skipped, result.Removed, len(result.Limited), len(result.Failed))
+	if len(result.Limited) > 0 {
+		fmt.Fprintf(w, "制限に達したファイル:\n")
+		for _, hit := range result.Limited {
+			fmt.Fprintf(w, "  %s\n", hit)
+		}
+	}
+	if len(result.Rewrites) > 0 {
+		// 変更がなく変換を省略したページは、前回の変換時の記録から数える。
+		fmt.Fprintf(w, "書き換え規則の適用数 (%dページ):\n", len(result.Pages))
+		for _, hit := range result.Rewrites {
+			fmt.Fprintf(w, "  %s\n", hit)
+		}
+	}
+	if len(result.Replaces) > 0 {
+		fmt.Fprintf(w, "置換規則の置換数 (%dページ):\n", len(result.Pages))
+		for _, hit := range result.Replaces {
+			fmt.Fprintf(w, "  %s\n", hit)
+		}
+	}
+	if len(result.Failed) > 0 {
+		fmt.Fprintf(w, "失敗したファイル:\n")
+		for _, failure := range result.Failed {
+			fmt.Fprintf(w, "  %s\n", failure)
+		}
+	}
+}
+
+//! 変換結果に対応する終了コードを返す。
+func ExitCode(result *convert.Result) int {
+	if result != nil && len(result.Failed) > 0 {
+		return ExitPartial
+	}
+	return ExitSuccess
+}
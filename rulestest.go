@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/xcd0/html2md/convert"
+)
+
+//! --rules-test: 入力の試験用ファイルに設定ファイルの置換規則を適用し、適用前後の差分を表示する。
+//! いずれかの試験用ファイルの変換に失敗した場合はExitPartialを返す。
+func RunRulesTest(w io.Writer) (int, error) {
+	opts, err := NewOptions()
+	if err != nil {
+		return ExitFatal, err
+	}
+	if len(opts.Replaces) == 0 {
+		return ExitFatal, errors.Errorf("置換規則がありません (--config の設定ファイルに [[replace]] を記述してください)")
+	}
+	src, closeInput, err := OpenInput(filepath.Clean(args.InputDir))
+	if err != nil {
+		return ExitFatal, err
+	}
+	defer closeInput()
+	cases, err := convert.TestReplaces(src, opts)
+	if err != nil {
+		return ExitFatal, err
+	}
+
+	changed, failed := 0, 0
+	for _, tc := range cases {
+		switch {
+		case tc.Err != nil:
+			failed++
+			fmt.Fprintf(w, "=== %s: 変換に失敗: %v\n", tc.Source, tc.Err)
+			continue
+		case tc.Before == tc.After:
+			fmt.Fprintf(w, "=== %s: 変更なし\n", tc.Source)
+			continue
+		}
+		changed++
+		fmt.Fprintf(w, "=== %s\n", tc.Source)
+		for _, hit := range tc.Hits {
+			fmt.Fprintf(w, "  %s: %d箇所\n", hit.Name, hit.Count)
+		}
+		diff, err := convert.UnifiedDiff(tc.Before, tc.After, tc.Source+" (置換前)", tc.Source+" (置換後)", 2)
+		if err != nil {
+			return ExitFatal, err
+		}
+		fmt.Fprint(w, diff)
+	}
+	fmt.Fprintf(w, "試験用ファイル %d, 変更あり %d, 失敗 %d\n", len(cases), changed, failed)
+	if failed > 0 {
+		return ExitPartial, nil
+	}
+	return ExitSuccess, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/xcd0/html2md/convert"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// プレビューサーバーのURLの接頭辞。
+const (
+	servePrefixView     = "/view/"     // 元のHTMLと変換結果を並べて表示するページ。
+	servePrefixOriginal = "/original/" // 入力ディレクトリのファイル。
+	servePrefixBook     = "/book/"     // 出力ディレクトリのファイル。.mdファイルはHTMLに変換して返す。
+	servePathEvents     = "/events"    // 再変換を通知するServer-Sent Events。
+)
+
+//! serveサブコマンドを実行する。入力ディレクトリを監視して再変換しながら、変換結果をブラウザでプレビューできるようにする。
+//! mdbookがなくても確認できるよう、Markdownはこのプロセス内でHTMLに変換する。
+func RunServe(ctx context.Context) error {
+	server := &PreviewServer{
+		inputDir:  filepath.Clean(args.InputDir),
+		outputDir: convert.ResolveOutputDir(filepath.Clean(args.InputDir), args.Output, args.Suffix),
+		markdown: goldmark.New(
+			goldmark.WithExtensions(extension.GFM),
+			goldmark.WithRendererOptions(html.WithUnsafe()), // 変換結果に残ったHTMLもそのまま表示する。
+		),
+		clients: map[chan struct{}]bool{},
+	}
+
+	if IsZipPath(server.outputDir) {
+		return errors.Errorf("プレビューする出力にはディレクトリを指定してください: %s", server.outputDir)
+	}
+
+	httpServer := &http.Server{Addr: args.Addr, Handler: server.Handler()}
+	listenErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("プレビュー: http://%s/\n", args.Addr)
+		listenErr <- httpServer.ListenAndServe()
+	}()
+
+	// 再変換でファイルが変わった場合だけブラウザを再読み込みする。
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- WatchInput(ctx, func(result *convert.Result) {
+			if result.Converted+result.Copied+result.Removed > 0 || result.SummaryUpdated {
+				server.NotifyReload()
+			}
+		})
+	}()
+
+	select {
+	case err := <-listenErr:
+		return errors.Errorf("プレビューサーバーの起動に失敗: %v", err)
+	case err := <-watchErr:
+		// 接続中のServer-Sent Eventsは終了を待たずに切断する。
+		httpServer.Close()
+		return err
+	}
+}
+
+//! 変換結果をプレビューするHTTPサーバー。
+type PreviewServer struct {
+	inputDir  string
+	outputDir string
+	markdown  goldmark.Markdown
+
+	mu      sync.Mutex
+	clients map[chan struct{}]bool // 再読み込みの通知先。
+}
+
+//! ルーティングを設定したハンドラーを返す。
+func (s *PreviewServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveView(w, "")
+	})
+	mux.HandleFunc(servePrefixView, func(w http.ResponseWriter, r *http.Request) {
+		s.serveView(w, strings.TrimPrefix(r.URL.Path, servePrefixView))
+	})
+	mux.Handle(servePrefixOriginal, http.StripPrefix(servePrefixOriginal, http.FileServer(http.Dir(s.inputDir))))
+	mux.HandleFunc(servePrefixBook, s.serveBook)
+	mux.HandleFunc(servePathEvents, s.serveEvents)
+	return mux
+}
+
+//! 接続中のブラウザに再読み込みを通知する。
+func (s *PreviewServer) NotifyReload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for client := range s.clients {
+		select {
+		case client <- struct{}{}:
+		default: // 未処理の通知がある場合は重ねて送らない。
+		}
+	}
+}
+
+//! 目次と、1ページ分の元のHTMLと変換結果を左右に並べたページを返す。pageは出力ディレクトリからの.mdファイルの相対パス。
+func (s *PreviewServer) serveView(w http.ResponseWriter, page string) {
+	data := viewData{Page: page}
+
+	// 目次はSUMMARY.mdをHTMLに変換して表示する。リンク先は<base>で/view/からの相対パスになる。
+	if summary, err := os.ReadFile(filepath.Join(s.outputDir, "SUMMARY.md")); err == nil {
+		var buf bytes.Buffer
+		if err := s.markdown.Convert(summary, &buf); err == nil {
+			data.Summary = template.HTML(buf.String())
+		}
+	}
+
+	if page != "" {
+		data.Converted = template.URL(servePrefixBook + convert.EncodeLinkTarget(page))
+		if cache, err := convert.ReadBuildCache(s.outputDir); err == nil {
+			if entry := cache.FindOutput(page); entry != nil && entry.Kind == convert.EntryConvert {
+				data.Original = template.URL(servePrefixOriginal + convert.EncodeLinkTarget(entry.Source))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := viewTemplate.Execute(w, data); err != nil {
+		log.Printf("プレビューの表示に失敗: %v", err)
+	}
+}
+
+//! 出力ディレクトリのファイルを返す。.mdファイルはHTMLに変換して返す。
+func (s *PreviewServer) serveBook(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, servePrefixBook))
+	if !strings.HasSuffix(strings.ToLower(name), ".md") {
+		http.StripPrefix(servePrefixBook, http.FileServer(http.Dir(s.outputDir))).ServeHTTP(w, r)
+		return
+	}
+
+	f, err := http.Dir(s.outputDir).Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	source, err := io.ReadAll(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := s.markdown.Convert(source, &buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := bookTemplate.Execute(w, template.HTML(buf.String())); err != nil {
+		log.Printf("Markdownの表示に失敗 %s: %v", name, err)
+	}
+}
+
+//! 再変換のたびにreloadイベントを送るServer-Sent Eventsのエンドポイント。
+func (s *PreviewServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	client := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.clients[client] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, client)
+		s.mu.Unlock()
+	}()
+
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client:
+			fmt.Fprint(w, "event: reload\ndata: reload\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+//! プレビューページのテンプレートに渡す値。
+type viewData struct {
+	Page      string        // 表示中のページの出力ディレクトリからの相対パス。
+	Summary   template.HTML // HTMLに変換したSUMMARY.md。
+	Original  template.URL  // 元のHTMLのURL。変換元がない場合は空。
+	Converted template.URL  // 変換結果のURL。
+}
+
+var viewTemplate = template.Must(template.New("view").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<base href="` + servePrefixView + `">
+<title>{{if .Page}}{{.Page}} - {{end}}html2md preview</title>
+<style>
+body { margin: 0; display: flex; height: 100vh; font-family: sans-serif; }
+nav { width: 260px; overflow: auto; padding: 0 1em; border-right: 1px solid #ccc; font-size: 14px; }
+nav ul { padding-left: 1.2em; }
+main { flex: 1; display: flex; flex-direction: column; min-width: 0; }
+header { padding: 4px 8px; border-bottom: 1px solid #ccc; font-size: 14px; }
+.panes { flex: 1; display: flex; }
+.pane { flex: 1; display: flex; flex-direction: column; border-left: 1px solid #ccc; }
+.pane h2 { margin: 0; padding: 4px 8px; font-size: 13px; background: #f4f4f4; }
+.pane iframe { flex: 1; border: 0; }
+.empty { padding: 1em; color: #888; }
+</style>
+</head>
+<body>
+<nav>{{.Summary}}</nav>
+<main>
+{{if .Page}}
+<header>{{.Page}}</header>
+<div class="panes">
+<div class="pane"><h2>元のHTML</h2>{{if .Original}}<iframe src="{{.Original}}"></iframe>{{else}}<p class="empty">変換元のHTMLはありません。</p>{{end}}</div>
+<div class="pane"><h2>変換後</h2><iframe src="{{.Converted}}"></iframe></div>
+</div>
+{{else}}
+<p class="empty">左の目次からページを選択してください。</p>
+{{end}}
+</main>
+<script>
+new EventSource("` + servePathEvents + `").addEventListener("reload", () => location.reload());
+</script>
+</body>
+</html>
+`))
+
+var bookTemplate = template.Must(template.New("book").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<style>
+body { font-family: sans-serif; line-height: 1.6; padding: 0 1em; }
+pre { background: #f4f4f4; padding: 8px; overflow: auto; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+{{.}}
+<script>
+// 変換結果内の.mdへのリンクは、並べて表示するページとして開く。
+document.addEventListener("click", (e) => {
+	const a = e.target.closest("a");
+	if (!a) return;
+	const url = new URL(a.href, location.href);
+	if (url.origin === location.origin && url.pathname.startsWith("` + servePrefixBook + `") && url.pathname.endsWith(".md")) {
+		e.preventDefault();
+		top.location.href = "` + servePrefixView + `" + url.pathname.slice(` + fmt.Sprint(len(servePrefixBook)) + `) + url.hash;
+	}
+});
+</script>
+</body>
+</html>
+`))
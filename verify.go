@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/xcd0/html2md/convert"
+)
+
+//! verifyサブコマンドを実行する。変換結果の各ページを描画し直して元のページと見えるテキストを比べ、--verify-formatの形式で表示する。
+//! 変換結果は2つ目の引数か-oで指定し、省略時は通常の変換と同じ出力先を使う。
+//! しきい値より類似度が低いページか確認できなかったページがあればExitPartialを返す。
+func RunVerify(ctx context.Context, w io.Writer) (int, error) {
+	if err := ValidatePlanFormat(args.VerifyFormat); err != nil {
+		return ExitFatal, err
+	}
+	inputPath := filepath.Clean(args.InputDir)
+	src, closeInput, err := OpenInput(inputPath)
+	if err != nil {
+		return ExitFatal, err
+	}
+	defer closeInput()
+
+	outputPath := args.Target
+	if outputPath == "" {
+		base := inputPath
+		if IsZipPath(inputPath) {
+			base = strings.TrimSuffix(inputPath, filepath.Ext(inputPath))
+		}
+		outputPath = convert.ResolveOutputDir(base, args.Output, args.Suffix)
+	}
+	out, closeOutput, err := OpenInput(filepath.Clean(outputPath))
+	if err != nil {
+		return ExitFatal, err
+	}
+	defer closeOutput()
+
+	opts, err := NewOptions()
+	if err != nil {
+		return ExitFatal, err
+	}
+	opts.Logger = nil
+	result, err := convert.VerifyOutput(ctx, src, out, opts, convert.VerifyOptions{Threshold: &args.VerifyThreshold, Selector: args.VerifySelector})
+	if err != nil {
+		return ExitFatal, err
+	}
+	if args.VerifyFormat == PlanFormatJSON {
+		data, err := json.MarshalIndent(result, "", "\t")
+		if err != nil {
+			return ExitFatal, err
+		}
+		fmt.Fprintln(w, string(data))
+	} else {
+		PrintVerifyResult(w, result)
+	}
+	if len(result.BelowThreshold()) > 0 || len(result.Failed) > 0 {
+		return ExitPartial, nil
+	}
+	return ExitSuccess, nil
+}
+
+//! 忠実度の確認結果を、ページごとの類似度と欠けた要素、集計の順に表示する。
+func PrintVerifyResult(w io.Writer, result *convert.VerifyResult) {
+	total := 0.0
+	for _, page := range result.Pages {
+		total += page.Score
+		mark := ""
+		if page.Score < result.Threshold {
+			mark = " (しきい値未満)"
+		}
+		fmt.Fprintf(w, "=== %s → %s: %.3f%s\n", page.Source, page.Output, page.Score, mark)
+		if page.WholePage {
+			fmt.Fprintf(w, "  本文の範囲のセレクターに一致しないため、body全体と比べました\n")
+		}
+		for _, missing := range []struct {
+			label  string
+			values []string
+		}{
+			{"テキスト", page.MissingText},
+			{"表のセル", page.MissingCells},
+			{"画像", page.MissingImages},
+			{"リンク", page.MissingLinks},
+		} {
+			for _, value := range missing.values {
+				fmt.Fprintf(w, "  欠けた%s: %q\n", missing.label, value)
+			}
+		}
+	}
+	for _, failed := range result.Failed {
+		fmt.Fprintf(w, "=== %s: 確認に失敗: %v\n", failed.Source, failed.Err)
+	}
+	average := 1.0
+	if len(result.Pages) > 0 {
+		average = total / float64(len(result.Pages))
+	}
+	fmt.Fprintf(w, "ページ %d, しきい値(%.2f)未満 %d, 失敗 %d, 平均 %.3f\n",
+		len(result.Pages), result.Threshold, len(result.BelowThreshold()), len(result.Failed), average)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//! しきい値より類似度が低いページがあればExitPartialを返す。しきい値0を指定した場合は報告しない。
+func TestRunVerify(t *testing.T) {
+	outputDir := convertPages(t, map[string]string{"a.html": "<p>kept</p><p>dropped paragraph</p>"})
+	inputDir := filepath.Join(filepath.Dir(outputDir), "in")
+	if err := os.WriteFile(filepath.Join(outputDir, "a.md"), []byte("kept\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		threshold string
+		wantCode  int
+	}{
+		{"", ExitPartial},
+		{"0", ExitSuccess},
+		{"0.1", ExitSuccess},
+		{"1", ExitPartial},
+	}
+	t.Cleanup(func() { args = Args{} })
+	for _, tt := range tests {
+		arguments := []string{inputDir, outputDir}
+		if tt.threshold != "" {
+			arguments = append(arguments, "--verify-threshold", tt.threshold)
+		}
+		args = Args{}
+		ParseArgs(CommandVerify, arguments)
+		var out bytes.Buffer
+		code, err := RunVerify(t.Context(), &out)
+		if err != nil || code != tt.wantCode {
+			t.Errorf("threshold %q: code = %d, err = %v; want %d\n%s", tt.threshold, code, err, tt.wantCode, out.String())
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/xcd0/html2md/convert"
+)
+
+//! watchサブコマンドを実行する。
+func RunWatch(ctx context.Context) error {
+	return WatchInput(ctx, nil)
+}
+
+//! 入力ディレクトリと--configの設定ファイルを監視し、変更があるたびに差分だけを再変換する。
+//! 再変換では変更のあったファイルだけを読み込み、設定ファイルの規則が変わった場合はその規則を適用するページだけを変換し直す。
+//! 連続した変更は--debounceの間まとめてから1回だけ再変換し、再変換に成功するたびにonRebuildを呼ぶ(nilの場合は呼ばない)。
+//! ctxがキャンセルされると、実行中の再変換の中断を待ってから終了する。
+func WatchInput(ctx context.Context, onRebuild func(result *convert.Result)) error {
+	inputDir := filepath.Clean(args.InputDir)
+	if info, err := os.Stat(inputDir); err != nil || !info.IsDir() {
+		return errors.Errorf("監視する入力にはディレクトリを指定してください: %s", args.InputDir)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Errorf("ファイル監視の開始に失敗: %v", err)
+	}
+	defer watcher.Close()
+	if err := addWatchDirs(watcher, inputDir); err != nil {
+		return errors.Errorf("ファイル監視の開始に失敗: %v", err)
+	}
+	// 設定ファイルはエディタが置き換えて保存すると監視が外れるため、ディレクトリごと監視する。
+	configPath := ""
+	if args.Config != "" {
+		configPath = filepath.Clean(args.Config)
+		if err := watcher.Add(filepath.Dir(configPath)); err != nil {
+			return errors.Errorf("設定ファイルの監視の開始に失敗: %v", err)
+		}
+	}
+
+	// 初回は指定されたモードで変換する。2回目以降は前回の変換内容をもとに差分だけを反映する。
+	if _, err := rebuild(ctx, "初回変換", nil); err != nil {
+		return err
+	}
+	args.Mode = convert.ModeSync
+	fmt.Printf("監視中: %s (Ctrl+Cで終了)\n", inputDir)
+
+	changed := map[string]bool{}
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Printf("監視を終了します。\n")
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// 属性の変更だけでは出力は変わらない。
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			// 設定ファイルのディレクトリでは、設定ファイルとスクリプト以外の変更を無視する。
+			if !isUnderDir(inputDir, event.Name) && event.Name != configPath && filepath.Ext(event.Name) != ".js" {
+				continue
+			}
+			// 新しく作られたディレクトリも監視対象に加える。
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := addWatchDirs(watcher, event.Name); err != nil {
+						log.Printf("ディレクトリを監視できません %s: %v", event.Name, err)
+					}
+				}
+			}
+			changed[event.Name] = true
+			debounce = time.After(args.Debounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("ファイル監視エラー: %v", err)
+
+		case <-debounce:
+			debounce = nil
+			reason := fmt.Sprintf("%d件の変更", len(changed))
+			// 再変換に失敗しても監視は続ける。
+			result, err := rebuild(ctx, reason, changedInputPaths(inputDir, changed))
+			if ctx.Err() != nil {
+				fmt.Printf("監視を終了します。\n")
+				return nil
+			}
+			if err != nil {
+				// 変換内容の記録が更新されていないため、変更は次の再変換に持ち越す。
+				log.Printf("再変換に失敗しました: %v", err)
+				continue
+			}
+			changed = map[string]bool{}
+			if onRebuild != nil {
+				onRebuild(result)
+			}
+		}
+	}
+}
+
+//! 変換を1回実行し、結果の概要を表示する。changedは前回の変換から変わった入力の相対パスで、nilの場合は全ファイルを確認する。
+func rebuild(ctx context.Context, reason string, changed []string) (*convert.Result, error) {
+	start := time.Now()
+	result, err := ConvertHtmlToMarkdown(ctx, changed)
+	if err != nil {
+		return nil, err
+	}
+	summary := "変更なし"
+	if result.SummaryUpdated {
+		summary = "更新"
+	}
+	fmt.Printf("[%s] %s: 変換 %d, コピー %d, 省略 %d, 削除 %d, 制限 %d, 失敗 %d, SUMMARY.md %s (%v)\n",
+		start.Format("15:04:05"), reason, result.Converted, result.Copied, result.Skipped, result.Removed, len(result.Limited), len(result.Failed), summary,
+		time.Since(start).Round(time.Millisecond))
+	for _, hit := range result.Limited {
+		fmt.Printf("  制限: %s\n", hit)
+	}
+	for _, failure := range result.Failed {
+		fmt.Printf("  失敗: %s\n", failure)
+	}
+	return result, nil
+}
+
+//! 変更のあったパスのうち入力ディレクトリ以下のものを、入力ディレクトリからの相対パス(スラッシュ区切り)にする。
+//! 入力ディレクトリ自体が変わった場合は、どのファイルが変わったか分からないためnilを返す。
+func changedInputPaths(inputDir string, changed map[string]bool) []string {
+	paths := []string{}
+	for name := range changed {
+		if !isUnderDir(inputDir, name) {
+			continue
+		}
+		rel, err := filepath.Rel(inputDir, name)
+		if err != nil || rel == "." {
+			return nil
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+//! pがdir以下のパスかどうかを返す。
+func isUnderDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+//! dir以下の全ディレクトリを監視対象に加える。fsnotifyはサブディレクトリを自動では監視しないため。
+func addWatchDirs(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}